@@ -2,12 +2,19 @@ package main
 
 import (
 	"tritonhttp"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/go-ini/ini"
 	"path/filepath"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -19,6 +26,9 @@ const CONFIG_FILE_INDEX int = 1
 const EX_USAGE int = 64
 const EX_CONFIG int = 78
 
+// How long a shutdown waits for in-flight responses
+const SHUTDOWN_TIMEOUT = 30 * time.Second
+
 // Usage string
 const USAGE_STRING string = "Usage: ./run-server [config_file]"
 
@@ -28,6 +38,68 @@ const USE_DEFAULT_SERVER string = "use_default_server"
 const SERVER_PORT string = "port"
 const DOC_ROOT_PATH string = "doc_root"
 const MIME_TYPE_PATH string = "mime_types"
+const MAX_BODY_SIZE string = "max_body_size"
+const AUTO_INDEX string = "autoindex"
+const WRITABLE string = "writable"
+const MAX_UPLOAD_SIZE string = "max_upload_size"
+const TLS_PORT string = "tls_port"
+const CERT_FILE string = "cert_file"
+const KEY_FILE string = "key_file"
+const TLS_MIN_VERSION string = "tls_min_version"
+const REDIRECT_HTTP string = "redirect_http"
+const ACCESS_LOG string = "access_log"
+const ACCESS_LOG_FORMAT string = "access_log_format"
+const LOG_LEVEL string = "log_level"
+const DEFAULT_VHOST string = "default_vhost"
+const CGI_BIN string = "cgi_bin"
+const CGI_PREFIX string = "cgi_prefix"
+const CGI_TIMEOUT string = "cgi_timeout"
+const MAX_HEADER_SIZE string = "max_header_size"
+const IDLE_TIMEOUT string = "idle_timeout"
+const HEADER_TIMEOUT string = "header_timeout"
+const READ_TIMEOUT string = "read_timeout"
+const WRITE_TIMEOUT string = "write_timeout"
+const MAX_CONNS string = "max_conns"
+const MAX_REQUESTS_PER_CONN string = "max_requests_per_conn"
+const RATE_LIMIT string = "rate_limit"
+const RATE_BURST string = "rate_burst"
+const FILE_CACHE_SIZE string = "file_cache_size"
+const CONTENT_CACHE_SIZE string = "content_cache_size"
+const CONTENT_CACHE_MAX_FILE string = "content_cache_max_file"
+const WATCH_POLL_INTERVAL string = "watch_poll_interval"
+const METRICS_PATH string = "metrics_path"
+const METRICS_PORT string = "metrics_port"
+const RELOAD_PATH string = "reload_path"
+const CHANGES_PATH string = "changes_path"
+const SYMLINK_POLICY string = "symlink_policy"
+const HTTP2 string = "http2"
+
+// Virtual hosts are configured in sections named "vhost.<name>"
+const VHOST_PREFIX string = "vhost."
+const VHOST_SERVER_NAMES string = "server_names"
+
+// Error pages are html templates, one per status code, e.g. 404=./404.html
+const ERROR_PAGES string = "error_pages"
+
+// Reverse proxies are configured in sections named "proxy.<name>"
+const PROXY_PREFIX string = "proxy."
+const PROXY_PATH string = "prefix"
+const PROXY_UPSTREAMS string = "upstreams"
+const PROXY_BALANCE string = "balance"
+const PROXY_STRIP_PREFIX string = "strip_prefix"
+const PROXY_MAX_FAILS string = "max_fails"
+const PROXY_FAIL_TIMEOUT string = "fail_timeout"
+const PROXY_TIMEOUT string = "timeout"
+
+// Protected paths are configured in sections named "auth.<name>"
+const AUTH_PREFIX string = "auth."
+const AUTH_PATH string = "prefix"
+const AUTH_REALM string = "realm"
+const AUTH_VHOST string = "vhost"
+const AUTH_HTPASSWD string = "htpasswd"
+const AUTH_HTDIGEST string = "htdigest"
+const AUTH_ALLOW string = "allow"
+const AUTH_DENY string = "deny"
 
 func main() {
 	var err error
@@ -81,14 +153,273 @@ func main() {
 		log.Println("Server has doc root as:", docRoot)
 		log.Println("Server has mime types file at:", mimeTypes)
 
-		// Initialize tritonhttp server
-		absDocRoot, _ := filepath.Abs(docRoot)
-		httpdServer, err := tritonhttp.NewHttpdServer(serverPort, absDocRoot, mimeTypes)
+		httpdServer, err := loadServer(configFilePath)
 		if err != nil {
-			log.Fatal(err)
+			log.Println(err)
+			os.Exit(EX_CONFIG)
 		}
+		httpdServer.Loader = func() (*tritonhttp.HttpServer, error) {
+			return loadServer(configFilePath)
+		}
+
+		// Reload the config file on SIGHUP, connections that are already
+		// open finish on the configuration they started with
+		go func() {
+			hups := make(chan os.Signal, 1)
+			signal.Notify(hups, syscall.SIGHUP)
+			for range hups {
+				log.Println("Received SIGHUP - reloading", configFilePath)
+				if _, err := httpdServer.ReloadConfig(); err != nil {
+					log.Println("Reload failed, keeping the running configuration:", err)
+				}
+			}
+		}()
+
+		// Stop gracefully on SIGINT/SIGTERM, letting in-flight responses finish
+		stopped := make(chan bool)
+		go func() {
+			sigs := make(chan os.Signal, 1)
+			signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+			log.Println("Received", <-sigs, "- shutting down")
+
+			ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+			defer cancel()
+			if err := httpdServer.Shutdown(ctx); err != nil {
+				log.Println("Shutdown incomplete:", err)
+			}
+			close(stopped)
+		}()
 
 		// Start tritonhttp server
-		log.Fatal(httpdServer.Start())
+		if err := httpdServer.Start(); err != tritonhttp.ErrServerClosed {
+			log.Fatal(err)
+		}
+		<-stopped
+	}
+}
+
+/**
+	Build a tritonhttp server from the config file, main starts the first one
+	and each reload swaps in another
+**/
+func loadServer(configFilePath string) (*tritonhttp.HttpServer, error) {
+	configContent, err := ini.Load(configFilePath)
+	if err != nil {
+		return nil, err
+	}
+	httpdConfigs := configContent.Section(HTTPD)
+	serverPort := httpdConfigs.Key(SERVER_PORT).String()
+	docRoot := httpdConfigs.Key(DOC_ROOT_PATH).String()
+	mimeTypes := httpdConfigs.Key(MIME_TYPE_PATH).String()
+
+	// Initialize tritonhttp server
+	absDocRoot, _ := filepath.Abs(docRoot)
+	httpdServer, err := tritonhttp.NewHttpdServer(serverPort, absDocRoot, mimeTypes)
+	if err != nil {
+		return nil, err
+	}
+	if httpdConfigs.HasKey(MAX_BODY_SIZE) {
+		httpdServer.MaxBodySize = httpdConfigs.Key(MAX_BODY_SIZE).MustInt64(tritonhttp.DefaultMaxBodySize)
+	}
+	httpdServer.AutoIndex = httpdConfigs.Key(AUTO_INDEX).MustBool(false)
+
+	// WebDAV uploads, only users of an [auth.*] rule may write
+	httpdServer.Writable = httpdConfigs.Key(WRITABLE).MustBool(false)
+	httpdServer.MaxUploadSize = httpdConfigs.Key(MAX_UPLOAD_SIZE).MustInt64(tritonhttp.DefaultMaxUploadSize)
+
+	// connection limits, unset keys keep the server defaults
+	httpdServer.MaxHeaderSize = httpdConfigs.Key(MAX_HEADER_SIZE).MustInt(httpdServer.MaxHeaderSize)
+	httpdServer.IdleTimeout = httpdConfigs.Key(IDLE_TIMEOUT).MustDuration(httpdServer.IdleTimeout)
+	httpdServer.HeaderTimeout = httpdConfigs.Key(HEADER_TIMEOUT).MustDuration(httpdServer.HeaderTimeout)
+	httpdServer.ReadTimeout = httpdConfigs.Key(READ_TIMEOUT).MustDuration(httpdServer.ReadTimeout)
+	httpdServer.WriteTimeout = httpdConfigs.Key(WRITE_TIMEOUT).MustDuration(0)
+	httpdServer.MaxConns = httpdConfigs.Key(MAX_CONNS).MustInt(0)
+	httpdServer.MaxRequestsPerConn = httpdConfigs.Key(MAX_REQUESTS_PER_CONN).MustInt(0)
+	httpdServer.RateLimit = httpdConfigs.Key(RATE_LIMIT).MustFloat64(0)
+	httpdServer.RateBurst = httpdConfigs.Key(RATE_BURST).MustInt(1)
+	httpdServer.FileCacheSize = httpdConfigs.Key(FILE_CACHE_SIZE).MustInt(tritonhttp.DefaultFileCacheSize)
+	httpdServer.ContentCacheSize = httpdConfigs.Key(CONTENT_CACHE_SIZE).MustInt64(0)
+	httpdServer.ContentCacheMaxFile = httpdConfigs.Key(CONTENT_CACHE_MAX_FILE).MustInt64(tritonhttp.DefaultContentCacheMaxFile)
+	httpdServer.WatchPollInterval = httpdConfigs.Key(WATCH_POLL_INTERVAL).MustDuration(tritonhttp.DefaultWatchPollInterval)
+
+	// metrics are off unless a path is set
+	httpdServer.MetricsPath = httpdConfigs.Key(METRICS_PATH).String()
+	httpdServer.MetricsPort = httpdConfigs.Key(METRICS_PORT).String()
+
+	// POST here on the metrics port to reload this file, like SIGHUP
+	httpdServer.ReloadPath = httpdConfigs.Key(RELOAD_PATH).String()
+	if httpdServer.ReloadPath != "" && httpdServer.MetricsPort == "" {
+		log.Println("reload_path is only served on metrics_port, which isn't set")
+	}
+
+	// WebSocket feed of doc root changes, off unless a path is set
+	httpdServer.ChangesPath = httpdConfigs.Key(CHANGES_PATH).String()
+
+	httpdServer.SymlinkPolicy = httpdConfigs.Key(SYMLINK_POLICY).In(tritonhttp.SymlinksFollow,
+		[]string{tritonhttp.SymlinksFollow, tritonhttp.SymlinksOwnerMatch, tritonhttp.SymlinksDeny})
+	if httpdConfigs.HasKey(SYMLINK_POLICY) && httpdServer.SymlinkPolicy != httpdConfigs.Key(SYMLINK_POLICY).String() {
+		return nil, errors.New("Unknown symlink_policy: " + httpdConfigs.Key(SYMLINK_POLICY).String())
+	}
+
+	// HTTP/2 is negotiated with ALPN over TLS, and with h2c on the plain port
+	httpdServer.DisableHTTP2 = !httpdConfigs.Key(HTTP2).MustBool(true)
+
+	// HTTPS is on when a TLS port is configured
+	httpdServer.TLSPort = httpdConfigs.Key(TLS_PORT).String()
+	if httpdServer.TLSPort != "" {
+		log.Println("Serving HTTPS on port:", httpdServer.TLSPort)
+		httpdServer.CertFile = httpdConfigs.Key(CERT_FILE).String()
+		httpdServer.KeyFile = httpdConfigs.Key(KEY_FILE).String()
+		httpdServer.RedirectToHTTPS = httpdConfigs.Key(REDIRECT_HTTP).MustBool(false)
+		if httpdConfigs.HasKey(TLS_MIN_VERSION) {
+			httpdServer.TLSMinVersion, err = tritonhttp.ParseTLSVersion(httpdConfigs.Key(TLS_MIN_VERSION).String())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Virtual hosts, each falling back to the [httpd] settings
+	for _, section := range configContent.Sections() {
+		if !strings.HasPrefix(section.Name(), VHOST_PREFIX) {
+			continue
+		}
+		name := strings.TrimPrefix(section.Name(), VHOST_PREFIX)
+		vhost, err := tritonhttp.NewVirtualHost(name,
+			section.Key(VHOST_SERVER_NAMES).Strings(","),
+			section.Key(DOC_ROOT_PATH).MustString(docRoot),
+			section.Key(MIME_TYPE_PATH).MustString(mimeTypes))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load virtual host %s: %v", name, err)
+		}
+		vhost.AutoIndex = section.Key(AUTO_INDEX).MustBool(httpdServer.AutoIndex)
+		log.Println("Virtual host", name, "serves", vhost.HostNames, "from", vhost.DocRoot)
+		httpdServer.VirtualHosts = append(httpdServer.VirtualHosts, vhost)
+	}
+	httpdServer.DefaultHost = httpdConfigs.Key(DEFAULT_VHOST).String()
+
+	// Error pages, keyed by status code
+	for _, key := range configContent.Section(ERROR_PAGES).Keys() {
+		statusCode, err := strconv.Atoi(key.Name())
+		if err == nil {
+			err = httpdServer.LoadErrorPage(statusCode, key.String())
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load error page %s: %v", key.Name(), err)
+		}
+	}
+
+	// Protected paths. htpasswd files may hold bcrypt ("htpasswd -B")
+	// or SHA ("htpasswd -s") hashes, htdigest files are for Digest auth
+	for _, section := range configContent.Sections() {
+		if !strings.HasPrefix(section.Name(), AUTH_PREFIX) {
+			continue
+		}
+		name := strings.TrimPrefix(section.Name(), AUTH_PREFIX)
+		prefix := section.Key(AUTH_PATH).String()
+		rule := tritonhttp.NewAuthRule(prefix, section.Key(AUTH_REALM).MustString(name))
+		rule.VirtualHost = section.Key(AUTH_VHOST).String()
+		var err error
+		if rule.VirtualHost != "" && !hasVirtualHost(httpdServer, rule.VirtualHost) {
+			err = errors.New("No virtual host named " + rule.VirtualHost)
+		}
+		if htpasswd := section.Key(AUTH_HTPASSWD).String(); htpasswd != "" && err == nil {
+			err = rule.LoadHtpasswd(htpasswd)
+		}
+		if htdigest := section.Key(AUTH_HTDIGEST).String(); htdigest != "" && err == nil {
+			err = rule.LoadHtdigest(htdigest)
+		}
+		if err == nil {
+			rule.Allow, err = tritonhttp.ParseIPList(section.Key(AUTH_ALLOW).String())
+		}
+		if err == nil {
+			rule.Deny, err = tritonhttp.ParseIPList(section.Key(AUTH_DENY).String())
+		}
+		if err != nil || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("Failed to load auth rule %s: %v %s", name, err, prefix)
+		}
+		if rule.VirtualHost != "" {
+			log.Println("Protecting", prefix, "on", rule.VirtualHost, "as realm", rule.Realm)
+		} else {
+			log.Println("Protecting", prefix, "as realm", rule.Realm)
+		}
+		httpdServer.AuthRules = append(httpdServer.AuthRules, rule)
+	}
+	if httpdServer.Writable && len(httpdServer.AuthRules) == 0 {
+		log.Println("writable is set, but without an [auth.*] section nobody may write")
+	}
+
+	// Reverse proxies, mounted in front of the file server
+	for _, section := range configContent.Sections() {
+		if !strings.HasPrefix(section.Name(), PROXY_PREFIX) {
+			continue
+		}
+		name := strings.TrimPrefix(section.Name(), PROXY_PREFIX)
+		prefix := section.Key(PROXY_PATH).String()
+		proxy, err := tritonhttp.NewProxyHandler(prefix,
+			section.Key(PROXY_UPSTREAMS).Strings(","), section.Key(PROXY_BALANCE).String())
+		if err != nil || !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("Failed to load proxy %s: %v %s", name, err, prefix)
+		}
+		proxy.StripPrefix = section.Key(PROXY_STRIP_PREFIX).MustBool(false)
+		proxy.MaxFails = section.Key(PROXY_MAX_FAILS).MustInt(proxy.MaxFails)
+		proxy.FailTimeout = section.Key(PROXY_FAIL_TIMEOUT).MustDuration(proxy.FailTimeout)
+		proxy.Timeout = section.Key(PROXY_TIMEOUT).MustDuration(proxy.Timeout)
+		log.Println("Proxying", prefix, "to", section.Key(PROXY_UPSTREAMS).String())
+		httpdServer.Mux.Handle(prefix, proxy)
+	}
+
+	// CGI scripts, only if a script directory is configured
+	if cgiBin := httpdConfigs.Key(CGI_BIN).String(); cgiBin != "" {
+		cgiPrefix := httpdConfigs.Key(CGI_PREFIX).MustString("/cgi-bin/")
+		cgi, err := tritonhttp.NewCGIHandler(cgiPrefix, cgiBin,
+			httpdConfigs.Key(CGI_TIMEOUT).MustDuration(30*time.Second))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to set up CGI: %v", err)
+		}
+		log.Println("Running CGI scripts from", cgi.Dir, "under", cgiPrefix)
+		httpdServer.Mux.Handle(cgiPrefix, cgi)
+	}
+
+	// Access log, appended to across restarts
+	if accessLogPath := httpdConfigs.Key(ACCESS_LOG).String(); accessLogPath != "" {
+		accessLog, err := openAccessLog(accessLogPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open access log: %v", err)
+		}
+		httpdServer.AccessLog = accessLog
+		httpdServer.AccessLogFormat = httpdConfigs.Key(ACCESS_LOG_FORMAT).In(
+			tritonhttp.AccessLogCombined, []string{tritonhttp.AccessLogCombined, tritonhttp.AccessLogJSON})
+	}
+	httpdServer.LogLevel = httpdConfigs.Key(LOG_LEVEL).MustInt(tritonhttp.LogInfo)
+
+	return httpdServer, nil
+}
+
+// access logs by path, kept open across reloads since connections on the
+// old configuration may still be writing to them
+var accessLogs = map[string]*os.File{}
+var accessLogsMu sync.Mutex
+
+func openAccessLog(path string) (*os.File, error) {
+	accessLogsMu.Lock()
+	defer accessLogsMu.Unlock()
+	if accessLog, ok := accessLogs[path]; ok {
+		return accessLog, nil
+	}
+	accessLog, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	accessLogs[path] = accessLog
+	return accessLog, nil
+}
+
+func hasVirtualHost(httpdServer *tritonhttp.HttpServer, name string) bool {
+	for _, vhost := range httpdServer.VirtualHosts {
+		if vhost.Name == name {
+			return true
+		}
 	}
+	return false
 }
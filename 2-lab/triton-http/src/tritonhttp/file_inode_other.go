@@ -0,0 +1,15 @@
+//go:build !unix
+
+package tritonhttp
+
+import "os"
+
+// no portable inode here, size and mtime have to do
+func fileInode(fileInfo os.FileInfo) uint64 {
+	return 0
+}
+
+// no owners either, so the owner-match symlink policy never matches
+func fileOwner(fileInfo os.FileInfo) (uint32, bool) {
+	return 0, false
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package tritonhttp
+
+import (
+	"os"
+	"syscall"
+)
+
+func fileInode(fileInfo os.FileInfo) uint64 {
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
+
+// the uid that owns the file, for the owner-match symlink policy
+func fileOwner(fileInfo os.FileInfo) (uint32, bool) {
+	if stat, ok := fileInfo.Sys().(*syscall.Stat_t); ok {
+		return stat.Uid, true
+	}
+	return 0, false
+}
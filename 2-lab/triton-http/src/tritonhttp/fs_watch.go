@@ -0,0 +1,123 @@
+package tritonhttp
+
+import (
+	"io/fs"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// how often the doc roots are rescanned when there's no inotify
+const DefaultWatchPollInterval = 2 * time.Second
+
+// reports changes under a set of directories, onChange gets the path of
+// whatever was created, modified, moved or deleted
+type fsWatcher interface {
+	Close() error
+}
+
+// watches roots with inotify where we have it, otherwise by rescanning
+// them every pollInterval
+func watchDirs(roots []string, pollInterval time.Duration, onChange func(path string)) fsWatcher {
+	watcher, err := newNotifyWatcher(roots, onChange)
+	if err == nil {
+		return watcher
+	}
+	log.Println("Watching doc roots by polling:", err)
+	return newPollWatcher(roots, pollInterval, onChange)
+}
+
+type fileState struct {
+	modTime	time.Time
+	size	int64
+}
+
+// rescans the roots and reports every path whose mtime or size changed,
+// appeared or disappeared since the previous scan
+type pollWatcher struct {
+	roots		[]string
+	onChange	func(path string)
+	seen		map[string]fileState
+	done		chan bool
+}
+
+func newPollWatcher(roots []string, interval time.Duration, onChange func(path string)) *pollWatcher {
+	pw := &pollWatcher{roots: roots, onChange: onChange, done: make(chan bool)}
+	pw.seen = pw.scan()
+	go pw.run(interval)
+	return pw
+}
+
+func (pw *pollWatcher) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pw.done:
+			return
+		case <-ticker.C:
+		}
+
+		current := pw.scan()
+		for path, state := range current {
+			if old, ok := pw.seen[path]; !ok || old != state {
+				pw.onChange(path)
+			}
+		}
+		for path := range pw.seen {
+			if _, ok := current[path]; !ok {
+				pw.onChange(path)
+			}
+		}
+		pw.seen = current
+	}
+}
+
+func (pw *pollWatcher) scan() map[string]fileState {
+	states := map[string]fileState{}
+	for _, root := range pw.roots {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil // gone since we listed its directory
+			}
+			if info, err := d.Info(); err == nil {
+				states[path] = fileState{info.ModTime(), info.Size()}
+			}
+			return nil
+		})
+	}
+	return states
+}
+
+func (pw *pollWatcher) Close() error {
+	close(pw.done)
+	return nil
+}
+
+// starts watching the doc roots, if nothing has yet. the caller holds hs.mu
+func (hs *HttpServer) watchDocRootsLocked() {
+	if hs.watcher != nil {
+		return
+	}
+	hs.watcher = watchDirs(hs.active.docRoots(), hs.active.WatchPollInterval, hs.docRootChanged)
+}
+
+// the server's doc root and those of its virtual hosts
+func (hs *HttpServer) docRoots() []string {
+	roots := []string{hs.DocRoot}
+	for _, vhost := range hs.VirtualHosts {
+		roots = append(roots, vhost.DocRoot)
+	}
+	return roots
+}
+
+// called by the doc root watcher for every path that changed
+func (hs *HttpServer) docRootChanged(path string) {
+	hs.mu.Lock()
+	cc := hs.contentCache
+	hs.mu.Unlock()
+	if cc != nil {
+		cc.invalidate(path)
+	}
+	hs.broadcastChange(path)
+}
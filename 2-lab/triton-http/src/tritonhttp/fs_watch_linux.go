@@ -0,0 +1,120 @@
+//go:build linux
+
+package tritonhttp
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+/*
+Watches every directory under the roots with inotify
+	1. a directory created or moved in gets watched as well
+	2. a queue overflow reports the roots themselves, everything under
+	   them has to be assumed changed
+The fd is non-blocking so reads go through the runtime poller and Close
+wakes up the reading goroutine.
+*/
+type notifyWatcher struct {
+	file		*os.File
+	fd		int
+	roots		[]string
+	onChange	func(path string)
+
+	mu	sync.Mutex
+	dirs	map[int]string // watch descriptor to directory
+}
+
+func newNotifyWatcher(roots []string, onChange func(path string)) (fsWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	nw := &notifyWatcher{file: os.NewFile(uintptr(fd), "inotify"), fd: fd,
+		roots: roots, onChange: onChange, dirs: map[int]string{}}
+	for _, root := range roots {
+		if err := nw.watchTree(root); err != nil {
+			nw.file.Close()
+			return nil, err
+		}
+	}
+	go nw.run()
+	return nw, nil
+}
+
+// adds a watch for dir and every directory below it
+func (nw *notifyWatcher) watchTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(nw.fd, path, inotifyMask)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		nw.mu.Lock()
+		nw.dirs[wd] = path
+		nw.mu.Unlock()
+		return nil
+	})
+}
+
+func (nw *notifyWatcher) run() {
+	buf := make([]byte, 64*KB)
+	for {
+		n, err := nw.file.Read(buf)
+		if err != nil {
+			return // closed
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			name := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+			nw.handle(event, string(bytes.TrimRight(name, "\x00")))
+		}
+	}
+}
+
+func (nw *notifyWatcher) handle(event *syscall.InotifyEvent, name string) {
+	if event.Mask&syscall.IN_Q_OVERFLOW != 0 {
+		for _, root := range nw.roots {
+			nw.onChange(root)
+		}
+		return
+	}
+
+	nw.mu.Lock()
+	dir, ok := nw.dirs[int(event.Wd)]
+	if event.Mask&syscall.IN_IGNORED != 0 {
+		delete(nw.dirs, int(event.Wd))
+	}
+	nw.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	path := dir
+	if name != "" {
+		path = filepath.Join(dir, name)
+	}
+	if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		nw.watchTree(path)
+	}
+	if event.Mask&inotifyMask != 0 {
+		nw.onChange(path)
+	}
+}
+
+func (nw *notifyWatcher) Close() error {
+	return nw.file.Close()
+}
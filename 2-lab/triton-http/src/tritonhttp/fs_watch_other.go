@@ -0,0 +1,11 @@
+//go:build !linux
+
+package tritonhttp
+
+import (
+	"errors"
+)
+
+func newNotifyWatcher(roots []string, onChange func(path string)) (fsWatcher, error) {
+	return nil, errors.New("inotify is only available on linux")
+}
@@ -0,0 +1,59 @@
+package tritonhttp
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waits for want to be reported by a watcher
+func expectChange(t *testing.T, changes chan string, want string) {
+	t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case path := <-changes:
+			if path == want {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no change reported for %s", want)
+		}
+	}
+}
+
+func testWatcher(t *testing.T, newWatcher func(root string, onChange func(string)) fsWatcher) {
+	root := t.TempDir()
+	changes := make(chan string, 100)
+	watcher := newWatcher(root, func(path string) { changes <- path })
+	defer watcher.Close()
+
+	file := filepath.Join(root, "a.txt")
+	os.WriteFile(file, []byte("a"), 0644)
+	expectChange(t, changes, file)
+
+	// new directories are watched too
+	sub := filepath.Join(root, "sub")
+	os.Mkdir(sub, 0755)
+	expectChange(t, changes, sub)
+	time.Sleep(100 * time.Millisecond)
+	nested := filepath.Join(sub, "b.txt")
+	os.WriteFile(nested, []byte("b"), 0644)
+	expectChange(t, changes, nested)
+
+	os.Remove(file)
+	expectChange(t, changes, file)
+}
+
+func TestPollWatcher(t *testing.T) {
+	testWatcher(t, func(root string, onChange func(string)) fsWatcher {
+		return newPollWatcher([]string{root}, 20*time.Millisecond, onChange)
+	})
+}
+
+func TestWatchDirs(t *testing.T) {
+	testWatcher(t, func(root string, onChange func(string)) fsWatcher {
+		return watchDirs([]string{root}, 20*time.Millisecond, onChange)
+	})
+}
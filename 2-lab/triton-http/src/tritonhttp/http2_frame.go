@@ -0,0 +1,160 @@
+package tritonhttp
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+)
+
+// what a client sends first on an HTTP/2 connection (RFC 9113 3.4)
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// frame types (RFC 9113 6)
+const (
+	frameData		= 0x0
+	frameHeaders		= 0x1
+	framePriority		= 0x2
+	frameRSTStream		= 0x3
+	frameSettings		= 0x4
+	framePushPromise	= 0x5
+	framePing		= 0x6
+	frameGoAway		= 0x7
+	frameWindowUpdate	= 0x8
+	frameContinuation	= 0x9
+)
+
+// frame flags, which ones apply depends on the type
+const (
+	flagEndStream	= 0x1
+	flagAck		= 0x1
+	flagEndHeaders	= 0x4
+	flagPadded	= 0x8
+	flagPriority	= 0x20
+)
+
+// SETTINGS parameters (RFC 9113 6.5.2)
+const (
+	settingHeaderTableSize		= 0x1
+	settingEnablePush		= 0x2
+	settingMaxConcurrentStreams	= 0x3
+	settingInitialWindowSize	= 0x4
+	settingMaxFrameSize		= 0x5
+	settingMaxHeaderListSize	= 0x6
+)
+
+// error codes for RST_STREAM and GOAWAY (RFC 9113 7)
+const (
+	h2NoError		= 0x0
+	h2ProtocolError		= 0x1
+	h2InternalError		= 0x2
+	h2FlowControlError	= 0x3
+	h2StreamClosed		= 0x5
+	h2FrameSizeError	= 0x6
+	h2RefusedStream		= 0x7
+	h2Cancel		= 0x8
+	h2CompressionError	= 0x9
+	h2EnhanceYourCalm	= 0xb
+	h2InadequateSecurity	= 0xc
+)
+
+const (
+	h2FrameHeaderLen	= 9
+	h2DefaultFrameSize	= 16*KB  // largest frame payload until SETTINGS say otherwise
+	h2MaxFrameSize		= 1<<24 - 1
+	h2DefaultWindow		= 65535
+	h2MaxWindow		= 1<<31 - 1
+)
+
+// a connection error, the connection is closed with a GOAWAY carrying the code
+type h2ConnError uint32
+
+func (e h2ConnError) Error() string {
+	return "HTTP/2 connection error " + strconv.Itoa(int(e))
+}
+
+type h2Frame struct {
+	typ		uint8
+	flags		uint8
+	streamID	uint32
+	payload		[]byte
+}
+
+func (f h2Frame) has(flag uint8) bool {
+	return f.flags&flag != 0
+}
+
+/*
+Reads the next frame, its payload is only valid until the next call since
+buf is reused. A frame larger than maxSize is a FRAME_SIZE_ERROR.
+*/
+func readFrame(r io.Reader, buf []byte, maxSize uint32) (h2Frame, []byte, error) {
+	var header [h2FrameHeaderLen]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return h2Frame{}, buf, err
+	}
+	length := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	if length > maxSize {
+		return h2Frame{}, buf, h2ConnError(h2FrameSizeError)
+	}
+	if uint32(cap(buf)) < length {
+		buf = make([]byte, length)
+	}
+	f := h2Frame{
+		typ: header[3],
+		flags: header[4],
+		streamID: binary.BigEndian.Uint32(header[5:]) & (1<<31 - 1),
+		payload: buf[:length],
+	}
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return h2Frame{}, buf, err
+	}
+	return f, buf, nil
+}
+
+func appendFrameHeader(dst []byte, length int, typ uint8, flags uint8, streamID uint32) []byte {
+	dst = append(dst, byte(length>>16), byte(length>>8), byte(length), typ, flags)
+	return binary.BigEndian.AppendUint32(dst, streamID)
+}
+
+/*
+Strips the padding (and for HEADERS the priority fields) off a DATA or
+HEADERS payload. Padding that covers the whole frame is a PROTOCOL_ERROR.
+*/
+func framePayload(f h2Frame) ([]byte, error) {
+	p := f.payload
+	padding := 0
+	if f.has(flagPadded) {
+		if len(p) < 1 {
+			return nil, h2ConnError(h2ProtocolError)
+		}
+		padding = int(p[0])
+		p = p[1:]
+	}
+	if f.typ == frameHeaders && f.has(flagPriority) {
+		if len(p) < 5 {
+			return nil, h2ConnError(h2ProtocolError)
+		}
+		p = p[5:]
+	}
+	if padding > len(p) {
+		return nil, h2ConnError(h2ProtocolError)
+	}
+	return p[:len(p)-padding], nil
+}
+
+type h2Setting struct {
+	id	uint16
+	value	uint32
+}
+
+// the parameters of a SETTINGS payload, also used for HTTP2-Settings
+func parseSettings(p []byte) ([]h2Setting, error) {
+	if len(p)%6 != 0 {
+		return nil, h2ConnError(h2FrameSizeError)
+	}
+	settings := make([]h2Setting, 0, len(p)/6)
+	for ; len(p) > 0; p = p[6:] {
+		settings = append(settings, h2Setting{binary.BigEndian.Uint16(p), binary.BigEndian.Uint32(p[2:])})
+	}
+	return settings, nil
+}
@@ -0,0 +1,264 @@
+package tritonhttp
+
+import (
+	"errors"
+)
+
+var errHpack = errors.New("Invalid HPACK header block")
+
+// the size of the dynamic table we let clients use, the protocol default
+const hpackTableSize = 4096
+
+type hpackField struct {
+	name	string
+	value	string
+}
+
+// what a field counts for against table and header list sizes (RFC 7541 4.1)
+func (f hpackField) size() int {
+	return len(f.name) + len(f.value) + 32
+}
+
+// RFC 7541 Appendix A, index 1 is the first entry
+var hpackStaticTable = []hpackField{
+	{":authority", ""}, {":method", "GET"}, {":method", "POST"}, {":path", "/"},
+	{":path", "/index.html"}, {":scheme", "http"}, {":scheme", "https"}, {":status", "200"},
+	{":status", "204"}, {":status", "206"}, {":status", "304"}, {":status", "400"},
+	{":status", "404"}, {":status", "500"}, {"accept-charset", ""}, {"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""}, {"accept-ranges", ""}, {"accept", ""}, {"access-control-allow-origin", ""},
+	{"age", ""}, {"allow", ""}, {"authorization", ""}, {"cache-control", ""},
+	{"content-disposition", ""}, {"content-encoding", ""}, {"content-language", ""}, {"content-length", ""},
+	{"content-location", ""}, {"content-range", ""}, {"content-type", ""}, {"cookie", ""},
+	{"date", ""}, {"etag", ""}, {"expect", ""}, {"expires", ""},
+	{"from", ""}, {"host", ""}, {"if-match", ""}, {"if-modified-since", ""},
+	{"if-none-match", ""}, {"if-range", ""}, {"if-unmodified-since", ""}, {"last-modified", ""},
+	{"link", ""}, {"location", ""}, {"max-forwards", ""}, {"proxy-authenticate", ""},
+	{"proxy-authorization", ""}, {"range", ""}, {"referer", ""}, {"refresh", ""},
+	{"retry-after", ""}, {"server", ""}, {"set-cookie", ""}, {"strict-transport-security", ""},
+	{"transfer-encoding", ""}, {"user-agent", ""}, {"vary", ""}, {"via", ""},
+	{"www-authenticate", ""},
+}
+
+// static table indexes by name and by name and value, for the encoder
+var hpackStaticNames, hpackStaticFields = indexStaticTable()
+
+func indexStaticTable() (map[string]int, map[hpackField]int) {
+	names, fields := map[string]int{}, map[hpackField]int{}
+	for i, f := range hpackStaticTable {
+		if _, ok := names[f.name]; !ok {
+			names[f.name] = i + 1
+		}
+		fields[f] = i + 1
+	}
+	return names, fields
+}
+
+/*
+Decodes the header blocks of one connection. The dynamic table carries over
+from block to block so they have to be decoded in the order they arrive,
+even the ones for streams we're going to refuse.
+*/
+type hpackDecoder struct {
+	dynamic		[]hpackField // newest first
+	size		int
+	maxSize		int // as last updated by the client
+	maxListSize	int // decoded fields beyond this fail the block
+}
+
+func newHpackDecoder(maxListSize int) *hpackDecoder {
+	return &hpackDecoder{maxSize: hpackTableSize, maxListSize: maxListSize}
+}
+
+var errHeaderListTooLarge = errors.New("Header list too large")
+
+/*
+Decodes a complete header block (RFC 7541 6). errHeaderListTooLarge comes
+back after the whole block has been decoded, the table is still in sync.
+*/
+func (d *hpackDecoder) decode(block []byte) ([]hpackField, error) {
+	var fields []hpackField
+	listSize, tooLarge, started := 0, false, false
+	for len(block) > 0 {
+		var f hpackField
+		var err error
+		b := block[0]
+		switch {
+		case b&0x80 != 0: // indexed
+			var index uint64
+			if index, block, err = readHpackInt(block, 7); err != nil {
+				return nil, err
+			}
+			if f, err = d.lookup(index); err != nil {
+				return nil, err
+			}
+		case b&0xc0 == 0x40: // literal, added to the table
+			if f, block, err = d.readLiteral(block, 6); err != nil {
+				return nil, err
+			}
+			d.add(f)
+		case b&0xe0 == 0x20: // table size update, only before any field
+			var size uint64
+			if size, block, err = readHpackInt(block, 5); err != nil {
+				return nil, err
+			}
+			if started || size > hpackTableSize {
+				return nil, errHpack
+			}
+			d.maxSize = int(size)
+			d.evict()
+			continue
+		default: // literal, not indexed or never indexed
+			if f, block, err = d.readLiteral(block, 4); err != nil {
+				return nil, err
+			}
+		}
+
+		started = true
+		listSize += f.size()
+		if listSize > d.maxListSize {
+			tooLarge, fields = true, nil
+		}
+		if !tooLarge {
+			fields = append(fields, f)
+		}
+	}
+	if tooLarge {
+		return nil, errHeaderListTooLarge
+	}
+	return fields, nil
+}
+
+func (d *hpackDecoder) lookup(index uint64) (hpackField, error) {
+	if index == 0 {
+		return hpackField{}, errHpack
+	}
+	if index <= uint64(len(hpackStaticTable)) {
+		return hpackStaticTable[index-1], nil
+	}
+	index -= uint64(len(hpackStaticTable)) + 1
+	if index >= uint64(len(d.dynamic)) {
+		return hpackField{}, errHpack
+	}
+	return d.dynamic[index], nil
+}
+
+// a literal field whose name is indexed with an n bit prefix, or follows
+func (d *hpackDecoder) readLiteral(block []byte, n uint) (hpackField, []byte, error) {
+	var f hpackField
+	index, block, err := readHpackInt(block, n)
+	if err != nil {
+		return f, nil, err
+	}
+	if index > 0 {
+		named, err := d.lookup(index)
+		if err != nil {
+			return f, nil, err
+		}
+		f.name = named.name
+	} else if f.name, block, err = readHpackString(block, d.maxListSize); err != nil {
+		return f, nil, err
+	}
+	f.value, block, err = readHpackString(block, d.maxListSize)
+	return f, block, err
+}
+
+func (d *hpackDecoder) add(f hpackField) {
+	d.dynamic = append([]hpackField{f}, d.dynamic...)
+	d.size += f.size()
+	d.evict() // a field larger than the table just empties it
+}
+
+func (d *hpackDecoder) evict() {
+	for d.size > d.maxSize && len(d.dynamic) > 0 {
+		d.size -= d.dynamic[len(d.dynamic)-1].size()
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+	}
+}
+
+// an integer with an n bit prefix (RFC 7541 5.1)
+func readHpackInt(block []byte, n uint) (uint64, []byte, error) {
+	max := uint64(1)<<n - 1
+	value := uint64(block[0]) & max
+	block = block[1:]
+	if value < max {
+		return value, block, nil
+	}
+	for shift := uint(0); len(block) > 0; shift += 7 {
+		if shift > 28 { // nothing we accept is anywhere near this big
+			return 0, nil, errHpack
+		}
+		b := block[0]
+		block = block[1:]
+		value += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, block, nil
+		}
+	}
+	return 0, nil, errHpack
+}
+
+// a string literal, huffman encoded or not (RFC 7541 5.2)
+func readHpackString(block []byte, maxLen int) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, errHpack
+	}
+	huffman := block[0]&0x80 != 0
+	length, block, err := readHpackInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(block)) || length > uint64(maxLen) {
+		return "", nil, errHpack
+	}
+	raw := block[:length]
+	block = block[length:]
+	if !huffman {
+		return string(raw), block, nil
+	}
+	decoded, err := huffmanDecode(nil, raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(decoded), block, nil
+}
+
+func appendHpackInt(dst []byte, first byte, n uint, value uint64) []byte {
+	max := uint64(1)<<n - 1
+	if value < max {
+		return append(dst, first|byte(value))
+	}
+	dst = append(dst, first|byte(max))
+	for value -= max; value >= 0x80; value >>= 7 {
+		dst = append(dst, byte(value)|0x80)
+	}
+	return append(dst, byte(value))
+}
+
+// a string literal, huffman encoded when that's shorter
+func appendHpackString(dst []byte, s string) []byte {
+	if n := huffmanEncodedLen(s); n < len(s) {
+		dst = appendHpackInt(dst, 0x80, 7, uint64(n))
+		return huffmanEncode(dst, s)
+	}
+	dst = appendHpackInt(dst, 0, 7, uint64(len(s)))
+	return append(dst, s...)
+}
+
+/*
+Encodes a response field. We never add to the dynamic table, so there's no
+encoder state to keep in step with the client
+	1. a field in the static table is sent as its index
+	2. otherwise a literal, with the name indexed if the static table has it
+*/
+func appendHpackField(dst []byte, name string, value string) []byte {
+	if index, ok := hpackStaticFields[hpackField{name, value}]; ok {
+		return appendHpackInt(dst, 0x80, 7, uint64(index))
+	}
+	if index, ok := hpackStaticNames[name]; ok {
+		dst = appendHpackInt(dst, 0, 4, uint64(index))
+	} else {
+		dst = append(dst, 0)
+		dst = appendHpackString(dst, name)
+	}
+	return appendHpackString(dst, value)
+}
@@ -0,0 +1,150 @@
+package tritonhttp
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func unhexBlock(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// RFC 7541 C.3 and C.4, three requests on one connection, without and with
+// huffman coding. The later ones only decode right if the table is kept.
+func TestHpackDecodeRequests(t *testing.T) {
+	requests := [][]hpackField{
+		{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"}},
+		{{":method", "GET"}, {":scheme", "http"}, {":path", "/"}, {":authority", "www.example.com"},
+			{"cache-control", "no-cache"}},
+		{{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"}, {":authority", "www.example.com"},
+			{"custom-key", "custom-value"}},
+	}
+	examples := map[string][]string{
+		"C.3": {
+			"8286 8441 0f77 7777 2e65 7861 6d70 6c65 2e63 6f6d",
+			"8286 84be 5808 6e6f 2d63 6163 6865",
+			"8287 85bf 400a 6375 7374 6f6d 2d6b 6579 0c63 7573 746f 6d2d 7661 6c75 65",
+		},
+		"C.4": {
+			"8286 8441 8cf1 e3c2 e5f2 3a6b a0ab 90f4 ff",
+			"8286 84be 5886 a8eb 1064 9cbf",
+			"8287 85bf 4088 25a8 49e9 5ba9 7d7f 8925 a849 e95b b8e8 b4bf",
+		},
+	}
+	for name, blocks := range examples {
+		d := newHpackDecoder(DefaultMaxHeaderSize)
+		for i, block := range blocks {
+			fields, err := d.decode(unhexBlock(t, block))
+			if err != nil {
+				t.Fatalf("%s request %d: %v", name, i+1, err)
+			}
+			if len(fields) != len(requests[i]) {
+				t.Fatalf("%s request %d: got %v", name, i+1, fields)
+			}
+			for j, f := range fields {
+				if f != requests[i][j] {
+					t.Errorf("%s request %d field %d: got %v, want %v", name, i+1, j, f, requests[i][j])
+				}
+			}
+		}
+		if d.size != 164 { // what C.3.3 and C.4.3 end with
+			t.Errorf("%s: table size %d", name, d.size)
+		}
+	}
+}
+
+func TestHpackDecodeErrors(t *testing.T) {
+	blocks := map[string]string{
+		"index 0":                 "80",
+		"index past the table":    "be",
+		"truncated integer":       "ff",
+		"string past the block":   "0085 6162",
+		"table size after fields": "82 3f e1 1f",
+		"table size too large":    "3f e2 1f",
+		"huffman EOS padding":     "0081 ff 00",
+	}
+	for name, block := range blocks {
+		if _, err := newHpackDecoder(DefaultMaxHeaderSize).decode(unhexBlock(t, block)); err == nil {
+			t.Errorf("%s: decoded", name)
+		}
+	}
+
+	d := newHpackDecoder(64)
+	if _, err := d.decode(unhexBlock(t, "400a 6375 7374 6f6d 2d6b 6579 0d63 7573 746f 6d2d 6865 6164 6572 82")); err != errHeaderListTooLarge {
+		t.Errorf("oversized list: %v", err)
+	}
+	if len(d.dynamic) != 1 { // still added, the client assumes it was
+		t.Errorf("table has %d entries", len(d.dynamic))
+	}
+}
+
+// RFC 7541 C.1
+func TestHpackInt(t *testing.T) {
+	if got := appendHpackInt(nil, 0, 5, 10); hex.EncodeToString(got) != "0a" {
+		t.Errorf("10: %x", got)
+	}
+	if got := appendHpackInt(nil, 0, 5, 1337); hex.EncodeToString(got) != "1f9a0a" {
+		t.Errorf("1337: %x", got)
+	}
+	value, rest, err := readHpackInt([]byte{0x1f, 0x9a, 0x0a, 0x42}, 5)
+	if value != 1337 || len(rest) != 1 || err != nil {
+		t.Errorf("got %d %x %v", value, rest, err)
+	}
+}
+
+func TestHpackEncodeRoundTrip(t *testing.T) {
+	fields := []hpackField{
+		{":status", "200"}, {":status", "302"}, {"content-type", "text/html"},
+		{"x-custom", "a value with Spaces & symbols \x7f"}, {"set-cookie", ""},
+		{"location", strings.Repeat("/long", 100)},
+	}
+	var block []byte
+	for _, f := range fields {
+		block = appendHpackField(block, f.name, f.value)
+	}
+	got, err := newHpackDecoder(DefaultMaxHeaderSize).decode(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range fields {
+		if got[i] != fields[i] {
+			t.Errorf("field %d: got %v, want %v", i, got[i], fields[i])
+		}
+	}
+	if block[0] != 0x88 { // ":status: 200" is static entry 8
+		t.Errorf("status 200 encoded as %x", block[0])
+	}
+}
+
+func TestHuffman(t *testing.T) {
+	// RFC 7541 C.4.1
+	if got := huffmanEncode(nil, "www.example.com"); hex.EncodeToString(got) != "f1e3c2e5f23a6ba0ab90f4ff" {
+		t.Errorf("got %x", got)
+	}
+	for _, s := range []string{"", "a", "no-cache", "\x00\xff binary \x80", strings.Repeat("zq", 50)} {
+		decoded, err := huffmanDecode(nil, huffmanEncode(nil, s))
+		if string(decoded) != s || err != nil {
+			t.Errorf("%q came back as %q, %v", s, decoded, err)
+		}
+	}
+}
+
+func FuzzHpackDecode(f *testing.F) {
+	f.Add([]byte{0x82, 0x86, 0x84, 0x41, 0x0f, 'w', 'w', 'w'})
+	f.Add([]byte{0x40, 0x81, 0xff, 0x81, 0x00})
+	f.Add([]byte{0x3f, 0xe1, 0x1f, 0xbe})
+	f.Fuzz(func(t *testing.T, block []byte) {
+		d := newHpackDecoder(DefaultMaxHeaderSize)
+		d.decode(block)
+		d.decode(block) // against whatever the first left in the table
+		if d.size > d.maxSize {
+			t.Fatalf("table is %d bytes, max %d", d.size, d.maxSize)
+		}
+	})
+}
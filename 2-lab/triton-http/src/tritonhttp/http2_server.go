@@ -0,0 +1,937 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// what we advertise to HTTP/2 clients
+const (
+	h2MaxStreams	= 100     // concurrent streams per connection
+	h2RecvWindow	= 1024*KB // request body a client may send ahead, per stream and per connection
+)
+
+var errStreamClosed = errors.New("HTTP/2 stream closed")
+var errMalformedRequest = errors.New("Malformed HTTP/2 request")
+
+// request headers that only mean something to HTTP/1 connections (RFC 9113 8.2.2)
+var h2ConnectionHeaders = map[string]bool{
+	"connection": true, "keep-alive": true, "proxy-connection": true,
+	"transfer-encoding": true, "upgrade": true,
+}
+
+/*
+An HTTP/2 connection. The connection's goroutine reads frames, each request
+is answered by the handlers on a goroutine of its own, much like a
+connection per request would be with HTTP/1. Frames go out whole through
+writeMu so the streams' responses interleave frame by frame.
+*/
+type h2Conn struct {
+	hs	*HttpServer
+	conn	net.Conn
+	r	io.Reader // conn, after anything read off it before we knew it was HTTP/2
+	dec	*hpackDecoder
+	wg	sync.WaitGroup // running handlers
+
+	writeMu	sync.Mutex
+	bw	*bufio.Writer
+
+	// read loop only
+	recvWindow	int64
+	headerBlock	[]byte // a HEADERS frame waiting for its CONTINUATIONs
+	headerStream	uint32
+	headerEnd	bool // whether the HEADERS frame ended the stream
+
+	// guarded by mu, cond wakes up writers waiting for send window
+	mu		sync.Mutex
+	cond		*sync.Cond
+	streams		map[uint32]*h2Stream // the open ones
+	sendWindow	int64
+	initialWindow	int64 // the client's SETTINGS_INITIAL_WINDOW_SIZE
+	maxFrameSize	int   // the client's SETTINGS_MAX_FRAME_SIZE
+	lastStreamID	uint32
+	served		int // streams accepted, for MaxRequestsPerConn
+	goingAway	bool
+	closed		bool
+}
+
+/*
+A request and its response. Until the handler starts only the read loop
+touches the request, the flags are guarded by the connection's mu.
+*/
+type h2Stream struct {
+	sc		*h2Conn
+	id		uint32
+	request		HttpRequestHeader
+	contentLength	int64 // -1 if the client didn't say
+	recvWindow	int64
+	start		time.Time
+	reused		bool // not the first request on the connection
+
+	sendWindow	int64
+	remoteDone	bool // the client sent END_STREAM
+	localDone	bool // we did
+	dispatched	bool // the handler is running, or has run
+	discarding	bool // the body is too large, it's dropped as it arrives
+	maxBody		int64 // see bodyLimit
+	reset		bool
+}
+
+/*
+Speaks HTTP/2 on conn until either side is done with it. buffered holds
+whatever was read off the connection already, starting with the client
+preface. For an h2c upgrade, upgrade is the request that asked for it, it
+becomes stream 1, and settings are those from its HTTP2-Settings header.
+*/
+func (hs *HttpServer) serveHTTP2(conn net.Conn, buffered []byte, upgrade *HttpRequestHeader, settings []byte) {
+	sc := &h2Conn{
+		hs: hs,
+		conn: conn,
+		r: conn,
+		dec: newHpackDecoder(hs.maxHeaderSize()),
+		bw: bufio.NewWriterSize(conn, 32*KB),
+		recvWindow: h2RecvWindow,
+		streams: map[uint32]*h2Stream{},
+		sendWindow: h2DefaultWindow,
+		initialWindow: h2DefaultWindow,
+		maxFrameSize: h2DefaultFrameSize,
+	}
+	sc.cond = sync.NewCond(&sc.mu)
+	if len(buffered) > 0 {
+		sc.r = io.MultiReader(bytes.NewReader(buffered), conn)
+	}
+	defer sc.close()
+	hs.debugLog("Serving HTTP/2")
+
+	if tlsConn, ok := conn.(*tls.Conn); ok && tlsConn.ConnectionState().Version < tls.VersionTLS12 {
+		sc.goAway(h2InadequateSecurity)
+		return
+	}
+
+	// our half of the preface, it needn't wait for the client's
+	sc.writeSettings()
+	if upgrade != nil {
+		parsed, err := parseSettings(settings)
+		if err == nil {
+			err = sc.applySettings(parsed)
+		}
+		if err != nil {
+			sc.goAway(h2ProtocolError)
+			return
+		}
+		sc.upgradeStream(upgrade)
+	}
+
+	sc.setReadDeadline()
+	preface := make([]byte, len(http2Preface))
+	if _, err := io.ReadFull(sc.r, preface); err != nil || string(preface) != http2Preface {
+		sc.goAway(h2ProtocolError)
+		return
+	}
+
+	buf := make([]byte, h2DefaultFrameSize)
+	for first := true; ; first = false {
+		sc.setReadDeadline()
+		var f h2Frame
+		var err error
+		f, buf, err = readFrame(sc.r, buf, h2DefaultFrameSize)
+		if err == nil && first && f.typ != frameSettings {
+			err = h2ConnError(h2ProtocolError)
+		}
+		if err == nil {
+			err = sc.handleFrame(f)
+		}
+
+		if ce, ok := err.(h2ConnError); ok {
+			hs.debugLog("HTTP/2 connection error:", err)
+			sc.goAway(uint32(ce))
+			return
+		} else if ne, ok := err.(net.Error); ok && ne.Timeout() && !sc.done() {
+			sc.goAway(h2NoError) // idle for too long
+			return
+		} else if err != nil || sc.done() {
+			return
+		}
+	}
+}
+
+// whether we're going away and the last stream has closed
+func (sc *h2Conn) done() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.goingAway && len(sc.streams) == 0
+}
+
+/*
+Sets the read deadline for the next frame, every frame that arrives
+starts it over
+	1. ReadTimeout while an open stream waits on the client, for the rest
+	   of its request or for send window
+	2. none while the open streams only wait on their handlers, the
+	   handlers' writes have their own deadline
+	3. now once we're going away and the last stream is closed
+	4. otherwise IdleTimeout
+The caller must not hold mu.
+*/
+func (sc *h2Conn) setReadDeadline() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.setReadDeadlineLocked()
+}
+
+func (sc *h2Conn) setReadDeadlineLocked() {
+	if sc.waitingOnClientLocked() {
+		sc.conn.SetReadDeadline(deadlineAfter(sc.hs.ReadTimeout))
+	} else if len(sc.streams) > 0 {
+		sc.conn.SetReadDeadline(time.Time{})
+	} else if sc.goingAway {
+		sc.conn.SetReadDeadline(time.Now())
+	} else {
+		sc.conn.SetReadDeadline(deadlineAfter(sc.hs.IdleTimeout))
+	}
+}
+
+// whether an open stream can't go on until the client sends something,
+// the caller holds mu
+func (sc *h2Conn) waitingOnClientLocked() bool {
+	for _, st := range sc.streams {
+		if st.reset {
+			continue
+		}
+		if !st.remoteDone || !st.localDone && (st.sendWindow <= 0 || sc.sendWindow <= 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// stops the handlers' writes and waits for them to return
+func (sc *h2Conn) close() {
+	sc.mu.Lock()
+	sc.closed = true
+	sc.cond.Broadcast()
+	sc.mu.Unlock()
+	sc.conn.Close()
+	sc.wg.Wait()
+}
+
+func (sc *h2Conn) handleFrame(f h2Frame) error {
+	// a header block can't be interrupted by any other frame
+	if sc.headerStream != 0 && (f.typ != frameContinuation || f.streamID != sc.headerStream) {
+		return h2ConnError(h2ProtocolError)
+	}
+
+	switch f.typ {
+	case frameData:
+		return sc.handleData(f)
+	case frameHeaders:
+		if f.streamID == 0 {
+			return h2ConnError(h2ProtocolError)
+		}
+		p, err := framePayload(f)
+		if err != nil {
+			return err
+		}
+		sc.headerBlock = append(sc.headerBlock[:0], p...)
+		sc.headerEnd = f.has(flagEndStream)
+		if !f.has(flagEndHeaders) {
+			sc.headerStream = f.streamID
+			return nil
+		}
+		return sc.handleHeaderBlock(f.streamID)
+	case frameContinuation:
+		if sc.headerStream == 0 {
+			return h2ConnError(h2ProtocolError)
+		}
+		sc.headerBlock = append(sc.headerBlock, f.payload...)
+		if len(sc.headerBlock) > sc.hs.maxHeaderSize() {
+			return h2ConnError(h2EnhanceYourCalm)
+		}
+		if !f.has(flagEndHeaders) {
+			return nil
+		}
+		sc.headerStream = 0
+		return sc.handleHeaderBlock(f.streamID)
+	case framePriority: // we don't prioritise, but it still has to be well-formed
+		if f.streamID == 0 {
+			return h2ConnError(h2ProtocolError)
+		}
+		if len(f.payload) != 5 {
+			sc.writeRSTStream(f.streamID, h2FrameSizeError)
+		}
+	case frameRSTStream:
+		return sc.handleRSTStream(f)
+	case frameSettings:
+		return sc.handleSettings(f)
+	case framePushPromise: // only servers push
+		return h2ConnError(h2ProtocolError)
+	case framePing:
+		if f.streamID != 0 {
+			return h2ConnError(h2ProtocolError)
+		}
+		if len(f.payload) != 8 {
+			return h2ConnError(h2FrameSizeError)
+		}
+		if !f.has(flagAck) {
+			sc.writeFrame(framePing, flagAck, 0, f.payload)
+		}
+	case frameGoAway: // the client is leaving, finish what it already asked for
+		if f.streamID != 0 {
+			return h2ConnError(h2ProtocolError)
+		}
+		sc.mu.Lock()
+		sc.goingAway = true
+		sc.mu.Unlock()
+	case frameWindowUpdate:
+		return sc.handleWindowUpdate(f)
+	}
+	// unknown frame types are ignored
+	return nil
+}
+
+/*
+Starts a stream, or ends one with trailers, once its header block is
+complete. The block is decoded even for a stream we refuse, so the
+decoder's table stays in step with the client's.
+*/
+func (sc *h2Conn) handleHeaderBlock(id uint32) error {
+	fields, err := sc.dec.decode(sc.headerBlock)
+	if err != nil && err != errHeaderListTooLarge {
+		return h2ConnError(h2CompressionError)
+	}
+
+	sc.mu.Lock()
+	if id <= sc.lastStreamID { // trailers, which we don't use
+		st := sc.streams[id]
+		sc.mu.Unlock()
+		if st == nil {
+			return nil // a stream we reset, the client hadn't heard yet
+		}
+		if !sc.headerEnd || st.remoteDone {
+			sc.resetStream(st, h2ProtocolError)
+			return nil
+		}
+		sc.endOfRequest(st)
+		return nil
+	}
+	if id%2 == 0 { // client streams are odd
+		sc.mu.Unlock()
+		return h2ConnError(h2ProtocolError)
+	}
+	sc.lastStreamID = id
+	if sc.goingAway {
+		sc.mu.Unlock()
+		return nil
+	}
+	if len(sc.streams) >= h2MaxStreams {
+		sc.mu.Unlock()
+		sc.writeRSTStream(id, h2RefusedStream)
+		return nil
+	}
+	sc.served++
+	st := sc.newStreamLocked(id)
+	last := sc.hs.MaxRequestsPerConn > 0 && sc.served >= sc.hs.MaxRequestsPerConn
+	sc.mu.Unlock()
+
+	if last {
+		sc.goAway(h2NoError)
+	}
+
+	status := 0
+	if err == errHeaderListTooLarge {
+		status = 431
+		st.request = HttpRequestHeader{requestLine: "-", proto: "HTTP/2.0", headers: map[string]string{}}
+	} else {
+		st.request, err = makeHTTP2Request(fields)
+		if err == errMalformedRequest {
+			sc.resetStream(st, h2ProtocolError)
+			return nil
+		} else if err == errPathTraversal {
+			status = 403
+		} else if err != nil {
+			status = 400
+		}
+	}
+
+	st.contentLength, st.maxBody = -1, sc.hs.MaxBodySize
+	if status == 0 {
+		st.maxBody = sc.hs.bodyLimit(sc.conn.RemoteAddr(), &st.request)
+	}
+	if cl, ok := st.request.headers["Content-Length"]; ok && status == 0 {
+		length, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || length < 0 {
+			sc.resetStream(st, h2ProtocolError)
+			return nil
+		}
+		st.contentLength = length
+		if length > st.maxBody {
+			status = 413
+		}
+	}
+
+	if status != 0 {
+		st.discarding = true
+		sc.dispatch(st, status)
+	}
+	if sc.headerEnd {
+		sc.endOfRequest(st)
+	}
+	return nil
+}
+
+// the caller holds mu
+func (sc *h2Conn) newStreamLocked(id uint32) *h2Stream {
+	st := &h2Stream{sc: sc, id: id, start: time.Now(), reused: sc.served > 1,
+		recvWindow: h2RecvWindow, sendWindow: sc.initialWindow}
+	sc.streams[id] = st
+	if len(sc.streams) == 1 { // Shutdown waits for us from here
+		sc.hs.setConnActive(sc.conn, true)
+	}
+	return st
+}
+
+// the request of an h2c upgrade is stream 1, and already complete
+func (sc *h2Conn) upgradeStream(upgrade *HttpRequestHeader) {
+	request := *upgrade
+	request.proto = "HTTP/2.0"
+	request.headers = map[string]string{}
+	for key, value := range upgrade.headers {
+		if key != "Connection" && key != "Upgrade" && key != "Http2-Settings" {
+			request.headers[key] = value
+		}
+	}
+
+	sc.mu.Lock()
+	sc.lastStreamID = 1
+	sc.served++
+	st := sc.newStreamLocked(1)
+	sc.mu.Unlock()
+	st.request = request
+	sc.endOfRequest(st)
+}
+
+/*
+Builds the request from a decoded header block (RFC 9113 8.3.1)
+	1. errMalformedRequest for anything the protocol forbids, the stream
+	   is reset
+	2. the path errors makeReqHeader would give, they get a response
+*/
+func makeHTTP2Request(fields []hpackField) (HttpRequestHeader, error) {
+	pseudo := map[string]string{}
+	headers := map[string]string{}
+	for _, f := range fields {
+		if strings.HasPrefix(f.name, ":") {
+			if len(headers) > 0 || pseudo[f.name] != "" {
+				return HttpRequestHeader{}, errMalformedRequest
+			}
+			switch f.name {
+			case ":method", ":scheme", ":authority", ":path":
+				pseudo[f.name] = f.value
+			default:
+				return HttpRequestHeader{}, errMalformedRequest
+			}
+			continue
+		}
+
+		if !isToken(f.name) || strings.ToLower(f.name) != f.name || h2ConnectionHeaders[f.name] ||
+			f.name == "te" && f.value != "trailers" {
+			return HttpRequestHeader{}, errMalformedRequest
+		}
+		name := textproto.CanonicalMIMEHeaderKey(f.name)
+		if existing, ok := headers[name]; ok {
+			if name == "Host" || name == "Content-Length" {
+				return HttpRequestHeader{}, errMalformedRequest
+			}
+			f.value = joinHeaderValues(name, existing, f.value)
+		}
+		headers[name] = f.value
+	}
+
+	method, target := pseudo[":method"], pseudo[":path"]
+	if method == "" || pseudo[":scheme"] == "" || !strings.HasPrefix(target, "/") {
+		return HttpRequestHeader{}, errMalformedRequest
+	}
+	if _, ok := headers["Host"]; !ok && pseudo[":authority"] != "" {
+		headers["Host"] = pseudo[":authority"]
+	}
+
+	reqHeader := HttpRequestHeader{
+		requestLine: method + " " + target + " HTTP/2.0",
+		verb: method,
+		proto: "HTTP/2.0",
+		headers: headers,
+	}
+	if !isToken(method) {
+		return reqHeader, errMalformedRequest
+	}
+	return reqHeader, reqHeader.setTarget(target)
+}
+
+func (sc *h2Conn) handleData(f h2Frame) error {
+	if f.streamID == 0 {
+		return h2ConnError(h2ProtocolError)
+	}
+	sc.mu.Lock()
+	st := sc.streams[f.streamID]
+	idle := f.streamID > sc.lastStreamID
+	sc.mu.Unlock()
+	if idle {
+		return h2ConnError(h2ProtocolError)
+	}
+
+	// the whole frame counts against the windows, padding included
+	n := int64(len(f.payload))
+	if sc.recvWindow -= n; sc.recvWindow < 0 {
+		return h2ConnError(h2FlowControlError)
+	}
+	if n > 0 {
+		sc.writeWindowUpdate(0, n)
+		sc.recvWindow += n
+	}
+	if st == nil {
+		return nil // reset, the client hadn't heard yet
+	}
+	if st.remoteDone {
+		sc.resetStream(st, h2StreamClosed)
+		return nil
+	}
+	if st.recvWindow -= n; st.recvWindow < 0 {
+		sc.resetStream(st, h2FlowControlError)
+		return nil
+	}
+
+	p, err := framePayload(f)
+	if err != nil {
+		return err
+	}
+	if !st.discarding {
+		if int64(len(st.request.body)+len(p)) > st.maxBody {
+			st.discarding, st.request.body = true, nil
+			sc.dispatch(st, 413)
+		} else {
+			st.request.body = append(st.request.body, p...)
+		}
+	}
+
+	if f.has(flagEndStream) {
+		sc.endOfRequest(st)
+	} else if n > 0 && !st.discarding {
+		sc.writeWindowUpdate(st.id, n)
+		st.recvWindow += n
+	}
+	return nil
+}
+
+// the client is done sending, the request can be answered
+func (sc *h2Conn) endOfRequest(st *h2Stream) {
+	if !st.discarding && st.contentLength >= 0 && st.contentLength != int64(len(st.request.body)) {
+		sc.resetStream(st, h2ProtocolError)
+		return
+	}
+
+	sc.mu.Lock()
+	st.remoteDone = true
+	dispatched := st.dispatched
+	sc.closeStreamIfDoneLocked(st)
+	sc.mu.Unlock()
+	if !dispatched {
+		sc.dispatch(st, 0)
+	}
+}
+
+// runs the handler for st, or answers with status if it's not 0
+func (sc *h2Conn) dispatch(st *h2Stream, status int) {
+	sc.mu.Lock()
+	st.dispatched = true
+	sc.mu.Unlock()
+
+	sc.wg.Add(1)
+	go func() {
+		defer sc.wg.Done()
+		hs := sc.hs
+		w := newResponseWriter(hs, sc.conn, &st.request)
+		w.stream = st
+		hs.debugLog("Request Parsed:\n", st.request)
+		if status != 0 {
+			handleErrorResponse(w, status)
+			w.finish()
+			hs.logAccess(w, &st.request, st.start)
+			hs.metrics.observe(w, &st.request, st.start, st.reused)
+		} else {
+			hs.serveRequest(w, &st.request, st.start, st.reused)
+		}
+
+		// a client still sending a body we didn't want is told to stop
+		sc.mu.Lock()
+		unfinished := !st.remoteDone && !st.reset
+		sc.mu.Unlock()
+		if unfinished {
+			sc.resetStream(st, h2NoError)
+		}
+		if hs.shuttingDown() {
+			sc.goAway(h2NoError)
+		}
+	}()
+}
+
+// forgets a stream once both sides are done with it, the caller holds mu
+func (sc *h2Conn) closeStreamIfDoneLocked(st *h2Stream) {
+	if _, ok := sc.streams[st.id]; !ok || !(st.reset || st.remoteDone && st.localDone) {
+		return
+	}
+	delete(sc.streams, st.id)
+	if len(sc.streams) == 0 {
+		sc.hs.setConnActive(sc.conn, false)
+		sc.setReadDeadlineLocked()
+	}
+}
+
+// ends a stream with RST_STREAM, the handler's writes start failing
+func (sc *h2Conn) resetStream(st *h2Stream, code uint32) {
+	sc.mu.Lock()
+	if st.reset {
+		sc.mu.Unlock()
+		return
+	}
+	st.reset = true
+	sc.cond.Broadcast()
+	sc.closeStreamIfDoneLocked(st)
+	sc.mu.Unlock()
+	sc.writeRSTStream(st.id, code)
+}
+
+func (sc *h2Conn) handleRSTStream(f h2Frame) error {
+	if len(f.payload) != 4 {
+		return h2ConnError(h2FrameSizeError)
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if f.streamID == 0 || f.streamID > sc.lastStreamID {
+		return h2ConnError(h2ProtocolError)
+	}
+	if st, ok := sc.streams[f.streamID]; ok {
+		st.reset = true
+		sc.cond.Broadcast()
+		sc.closeStreamIfDoneLocked(st)
+	}
+	return nil
+}
+
+func (sc *h2Conn) handleSettings(f h2Frame) error {
+	if f.streamID != 0 {
+		return h2ConnError(h2ProtocolError)
+	}
+	if f.has(flagAck) {
+		if len(f.payload) != 0 {
+			return h2ConnError(h2FrameSizeError)
+		}
+		return nil
+	}
+	settings, err := parseSettings(f.payload)
+	if err == nil {
+		err = sc.applySettings(settings)
+	}
+	if err != nil {
+		return err
+	}
+	return sc.writeFrame(frameSettings, flagAck, 0, nil)
+}
+
+/*
+Applies the client's settings. A new initial window size changes the send
+window of every open stream by the difference (RFC 9113 6.9.2). We never
+add to the HPACK table so its size doesn't matter to us.
+*/
+func (sc *h2Conn) applySettings(settings []h2Setting) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range settings {
+		switch s.id {
+		case settingEnablePush:
+			if s.value > 1 {
+				return h2ConnError(h2ProtocolError)
+			}
+		case settingInitialWindowSize:
+			if s.value > h2MaxWindow {
+				return h2ConnError(h2FlowControlError)
+			}
+			delta := int64(s.value) - sc.initialWindow
+			for _, st := range sc.streams {
+				if st.sendWindow += delta; st.sendWindow > h2MaxWindow {
+					return h2ConnError(h2FlowControlError)
+				}
+			}
+			sc.initialWindow = int64(s.value)
+			sc.cond.Broadcast()
+		case settingMaxFrameSize:
+			if s.value < h2DefaultFrameSize || s.value > h2MaxFrameSize {
+				return h2ConnError(h2ProtocolError)
+			}
+			sc.maxFrameSize = int(s.value)
+		}
+	}
+	return nil
+}
+
+func (sc *h2Conn) handleWindowUpdate(f h2Frame) error {
+	if len(f.payload) != 4 {
+		return h2ConnError(h2FrameSizeError)
+	}
+	increment := int64(binary.BigEndian.Uint32(f.payload) & (1<<31 - 1))
+
+	sc.mu.Lock()
+	if f.streamID == 0 {
+		defer sc.mu.Unlock()
+		if increment == 0 {
+			return h2ConnError(h2ProtocolError)
+		}
+		if sc.sendWindow += increment; sc.sendWindow > h2MaxWindow {
+			return h2ConnError(h2FlowControlError)
+		}
+		sc.cond.Broadcast()
+		return nil
+	}
+
+	if f.streamID > sc.lastStreamID {
+		sc.mu.Unlock()
+		return h2ConnError(h2ProtocolError)
+	}
+	st, ok := sc.streams[f.streamID]
+	if !ok {
+		sc.mu.Unlock()
+		return nil
+	}
+	st.sendWindow += increment
+	sc.cond.Broadcast()
+	overflow := st.sendWindow > h2MaxWindow
+	sc.mu.Unlock()
+
+	if increment == 0 {
+		sc.resetStream(st, h2ProtocolError)
+	} else if overflow {
+		sc.resetStream(st, h2FlowControlError)
+	}
+	return nil
+}
+
+/*
+Takes up to n bytes of send window for st, waiting until both the stream
+and the connection have some. Gives up with an error if the stream is
+reset, the connection closes or WriteTimeout passes.
+*/
+func (sc *h2Conn) reserveWindow(st *h2Stream, n int) (int, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	var deadline time.Time
+	for st.sendWindow <= 0 || sc.sendWindow <= 0 || st.reset || sc.closed {
+		if st.reset || sc.closed {
+			return 0, errStreamClosed
+		}
+		if sc.hs.WriteTimeout > 0 {
+			if deadline.IsZero() {
+				deadline = time.Now().Add(sc.hs.WriteTimeout)
+				timer := time.AfterFunc(sc.hs.WriteTimeout, func() {
+					sc.mu.Lock()
+					sc.cond.Broadcast()
+					sc.mu.Unlock()
+				})
+				defer timer.Stop()
+			} else if time.Now().After(deadline) {
+				return 0, os.ErrDeadlineExceeded
+			}
+		}
+		sc.setReadDeadlineLocked() // the client has ReadTimeout to open the window
+		sc.cond.Wait()
+	}
+	n = min(n, int(min(st.sendWindow, sc.sendWindow)), sc.maxFrameSize)
+	st.sendWindow -= int64(n)
+	sc.sendWindow -= int64(n)
+	return n, nil
+}
+
+// sends our SETTINGS, and opens the connection window as wide as the streams'
+func (sc *h2Conn) writeSettings() {
+	var p []byte
+	for _, s := range []h2Setting{
+		{settingMaxConcurrentStreams, h2MaxStreams},
+		{settingInitialWindowSize, h2RecvWindow},
+		{settingMaxHeaderListSize, uint32(sc.hs.maxHeaderSize())},
+	} {
+		p = binary.BigEndian.AppendUint16(p, s.id)
+		p = binary.BigEndian.AppendUint32(p, s.value)
+	}
+	sc.writeFrame(frameSettings, 0, 0, p)
+	sc.writeWindowUpdate(0, h2RecvWindow-h2DefaultWindow)
+}
+
+func (sc *h2Conn) writeWindowUpdate(streamID uint32, increment int64) {
+	sc.writeFrame(frameWindowUpdate, 0, streamID, binary.BigEndian.AppendUint32(nil, uint32(increment)))
+}
+
+func (sc *h2Conn) writeRSTStream(streamID uint32, code uint32) {
+	sc.writeFrame(frameRSTStream, 0, streamID, binary.BigEndian.AppendUint32(nil, code))
+}
+
+// tells the client we won't take streams after the last one it opened
+func (sc *h2Conn) goAway(code uint32) {
+	sc.mu.Lock()
+	if sc.goingAway && code == h2NoError {
+		sc.mu.Unlock()
+		return
+	}
+	sc.goingAway = true
+	last := sc.lastStreamID
+	sc.setReadDeadlineLocked() // wakes the read loop if there's nothing left
+	sc.mu.Unlock()
+
+	p := binary.BigEndian.AppendUint32(nil, last)
+	sc.writeFrame(frameGoAway, 0, 0, binary.BigEndian.AppendUint32(p, code))
+}
+
+func (sc *h2Conn) writeFrame(typ uint8, flags uint8, streamID uint32, payload []byte) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	return sc.writeFrameLocked(typ, flags, streamID, payload, true)
+}
+
+// the caller holds writeMu. a failed write leaves the connection unusable,
+// it's closed so the read loop notices
+func (sc *h2Conn) writeFrameLocked(typ uint8, flags uint8, streamID uint32, payload []byte, flush bool) error {
+	if sc.hs.WriteTimeout > 0 {
+		sc.conn.SetWriteDeadline(time.Now().Add(sc.hs.WriteTimeout))
+	}
+	var header [h2FrameHeaderLen]byte
+	sc.bw.Write(appendFrameHeader(header[:0], len(payload), typ, flags, streamID))
+	sc.bw.Write(payload)
+	var err error
+	if flush {
+		err = sc.bw.Flush()
+	}
+	if err != nil {
+		sc.conn.Close()
+	}
+	return err
+}
+
+// sends a header block, split into HEADERS and CONTINUATION frames that
+// nothing else may come between
+func (sc *h2Conn) writeHeaders(st *h2Stream, block []byte, endStream bool) error {
+	sc.writeMu.Lock()
+	defer sc.writeMu.Unlock()
+	sc.mu.Lock()
+	maxFrameSize, reset := sc.maxFrameSize, st.reset || sc.closed
+	sc.mu.Unlock()
+	if reset {
+		return errStreamClosed
+	}
+
+	typ, flags := uint8(frameHeaders), uint8(0)
+	if endStream {
+		flags |= flagEndStream
+	}
+	for {
+		chunk := block
+		if len(chunk) > maxFrameSize {
+			chunk = block[:maxFrameSize]
+		}
+		block = block[len(chunk):]
+		if len(block) == 0 {
+			flags |= flagEndHeaders
+		}
+		if err := sc.writeFrameLocked(typ, flags, st.id, chunk, len(block) == 0); err != nil {
+			return err
+		}
+		if len(block) == 0 {
+			return nil
+		}
+		typ, flags = frameContinuation, 0
+	}
+}
+
+// a stream's response, for ResponseWriter
+
+func (st *h2Stream) writeHeader(header HttpResponseHeader, endStream bool) error {
+	block := appendHpackField(nil, ":status", strconv.Itoa(header.StatusCode))
+	for key, value := range header.Headers {
+		name := strings.ToLower(key)
+		if h2ConnectionHeaders[name] {
+			continue
+		}
+		for _, v := range strings.Split(value, "\n") {
+			block = appendHpackField(block, name, v)
+		}
+	}
+	err := st.sc.writeHeaders(st, block, endStream)
+	if err == nil && endStream {
+		st.finished()
+	}
+	return err
+}
+
+func (st *h2Stream) write(data []byte) error {
+	for len(data) > 0 {
+		n, err := st.sc.reserveWindow(st, len(data))
+		if err != nil {
+			return err
+		}
+		if err := st.sc.writeFrame(frameData, 0, st.id, data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// ends the response with an empty DATA frame, unless the headers did
+func (st *h2Stream) end() error {
+	st.sc.mu.Lock()
+	done := st.localDone || st.reset
+	st.sc.mu.Unlock()
+	if done {
+		return nil
+	}
+	err := st.sc.writeFrame(frameData, flagEndStream, st.id, nil)
+	st.finished()
+	return err
+}
+
+func (st *h2Stream) abort() {
+	st.sc.resetStream(st, h2InternalError)
+}
+
+func (st *h2Stream) finished() {
+	st.sc.mu.Lock()
+	defer st.sc.mu.Unlock()
+	st.localDone = true
+	st.sc.closeStreamIfDoneLocked(st)
+}
+
+// the decoded HTTP2-Settings of a plaintext HTTP/1.1 request asking to be
+// upgraded to h2c (RFC 7540 3.2), false if it isn't one
+func h2cUpgradeSettings(conn net.Conn, reqHeader *HttpRequestHeader) ([]byte, bool) {
+	if _, secure := conn.(*tls.Conn); secure || reqHeader.proto != "HTTP/1.1" ||
+		!reqHeader.hasToken("Upgrade", "h2c") || !reqHeader.hasToken("Connection", "HTTP2-Settings") {
+		return nil, false
+	}
+	value, ok := reqHeader.headers["Http2-Settings"]
+	if !ok {
+		return nil, false
+	}
+	settings, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil || len(settings)%6 != 0 {
+		return nil, false
+	}
+	return settings, true
+}
@@ -0,0 +1,437 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a bare HTTP/2 client, for the parts of the protocol net/http won't let
+// us get at
+type h2TestClient struct {
+	t	*testing.T
+	conn	net.Conn
+	buf	[]byte
+	dec	*hpackDecoder
+}
+
+// connects with prior knowledge, sending settings as the client's SETTINGS
+func dialH2(t *testing.T, addr string, settings ...h2Setting) *h2TestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &h2TestClient{t: t, conn: conn, dec: newHpackDecoder(DefaultMaxHeaderSize)}
+	conn.Write([]byte(http2Preface))
+	c.writeSettings(settings...)
+	return c
+}
+
+func (c *h2TestClient) writeSettings(settings ...h2Setting) {
+	var p []byte
+	for _, s := range settings {
+		p = binary.BigEndian.AppendUint16(p, s.id)
+		p = binary.BigEndian.AppendUint32(p, s.value)
+	}
+	c.writeFrame(frameSettings, 0, 0, p)
+}
+
+func (c *h2TestClient) writeFrame(typ uint8, flags uint8, streamID uint32, payload []byte) {
+	c.t.Helper()
+	frame := appendFrameHeader(nil, len(payload), typ, flags, streamID)
+	if _, err := c.conn.Write(append(frame, payload...)); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// sends a request's HEADERS, fields after the path are name, value pairs
+func (c *h2TestClient) request(streamID uint32, method string, path string, endStream bool, fields ...string) {
+	block := appendHpackField(nil, ":method", method)
+	block = appendHpackField(block, ":scheme", "http")
+	block = appendHpackField(block, ":authority", "127.0.0.1")
+	block = appendHpackField(block, ":path", path)
+	for i := 0; i+1 < len(fields); i += 2 {
+		block = appendHpackField(block, fields[i], fields[i+1])
+	}
+	flags := uint8(flagEndHeaders)
+	if endStream {
+		flags |= flagEndStream
+	}
+	c.writeFrame(frameHeaders, flags, streamID, block)
+}
+
+// the next frame, skipping the server's SETTINGS and WINDOW_UPDATEs
+func (c *h2TestClient) readFrame() h2Frame {
+	c.t.Helper()
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		f, buf, err := readFrame(c.conn, c.buf, h2MaxFrameSize)
+		c.buf = buf
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if f.typ != frameSettings && f.typ != frameWindowUpdate {
+			f.payload = append([]byte(nil), f.payload...)
+			return f
+		}
+	}
+}
+
+// reads frames until streamID's response is complete
+func (c *h2TestClient) response(streamID uint32) (string, map[string]string, string) {
+	c.t.Helper()
+	status, headers := "", map[string]string{}
+	var body []byte
+	for {
+		f := c.readFrame()
+		if f.streamID != streamID {
+			c.t.Fatalf("unexpected frame %d on stream %d", f.typ, f.streamID)
+		}
+		switch f.typ {
+		case frameHeaders:
+			fields, err := c.dec.decode(f.payload)
+			if err != nil {
+				c.t.Fatal(err)
+			}
+			for _, field := range fields {
+				if field.name == ":status" {
+					status = field.value
+				} else {
+					headers[field.name] = field.value
+				}
+			}
+		case frameData:
+			body = append(body, f.payload...)
+		default:
+			c.t.Fatalf("unexpected frame %d", f.typ)
+		}
+		if f.has(flagEndStream) {
+			return status, headers, string(body)
+		}
+	}
+}
+
+// the error code of the GOAWAY or RST_STREAM that should come next
+func (c *h2TestClient) expectError(typ uint8) uint32 {
+	c.t.Helper()
+	f := c.readFrame()
+	if f.typ != typ {
+		c.t.Fatalf("got frame %d, want %d", f.typ, typ)
+	}
+	return binary.BigEndian.Uint32(f.payload[len(f.payload)-4:])
+}
+
+// a connection whose first bytes were read through r
+type bufferedConn struct {
+	r	*bufio.Reader
+	net.Conn
+}
+
+func (bc bufferedConn) Read(p []byte) (int, error) {
+	return bc.r.Read(p)
+}
+
+func newH2cClient() *http.Client {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Client{Transport: &http.Transport{Protocols: protocols}}
+}
+
+func TestHTTP2OverTLS(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		hs := newTestServer(t)
+		hs.DisableHTTP2 = disabled
+		hs.CertFile, hs.KeyFile = writeTestCert(t)
+		tlsConfig, err := hs.tlsConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := serveTest(t, hs, tlsConfig)
+
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+		}}
+		resp, err := client.Get("https://" + addr + "/index.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		want, _ := os.ReadFile(filepath.Join(hs.DocRoot, "index.html"))
+		wantProto := "HTTP/2.0"
+		if disabled {
+			wantProto = "HTTP/1.1"
+		}
+		if resp.Proto != wantProto || resp.StatusCode != 200 || string(body) != string(want) {
+			t.Errorf("disabled %v: got %s %d with %d bytes", disabled, resp.Proto, resp.StatusCode, len(body))
+		}
+	}
+}
+
+// many requests at once on one connection, large files included so the
+// flow control windows fill up
+func TestHTTP2Multiplexing(t *testing.T) {
+	hs := newTestServer(t)
+	hs.Mux.HandleFunc("/echo", func(w *ResponseWriter, requestHeader *HttpRequestHeader) {
+		w.Write([]byte(requestHeader.Proto() + " " + string(requestHeader.Body())))
+	}, "POST")
+	addr := serveTest(t, hs, nil)
+	client := newH2cClient()
+
+	files := []string{"index.html", "kitten.jpg", "UCSD_Seal.png", "subdir1/index.html"}
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			resp, err := client.Get("http://" + addr + "/" + name)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			want, _ := os.ReadFile(filepath.Join(hs.DocRoot, name))
+			if err != nil || resp.Proto != "HTTP/2.0" || !bytes.Equal(body, want) {
+				t.Errorf("%s: got %s %d with %d bytes, %v", name, resp.Proto, resp.StatusCode, len(body), err)
+			}
+		}(files[i%len(files)])
+	}
+	wg.Wait()
+
+	resp, err := client.Post("http://"+addr+"/echo", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "HTTP/2.0 hello" {
+		t.Errorf("echo got %q", body)
+	}
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if n := len(hs.conns); n != 1 {
+		t.Errorf("%d connections for all of it", n)
+	}
+}
+
+func TestHTTP2Upgrade(t *testing.T) {
+	hs := newTestServer(t)
+	addr := serveTest(t, hs, nil)
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("GET /index.html HTTP/1.1\r\nHost: 127.0.0.1\r\n" +
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n"))
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == CRLF {
+			break
+		}
+		if strings.HasPrefix(line, "HTTP/") && line != "HTTP/1.1 101 Switching Protocols\r\n" {
+			t.Fatalf("got %q", line)
+		}
+	}
+
+	c := &h2TestClient{t: t, conn: bufferedConn{r, conn}, dec: newHpackDecoder(DefaultMaxHeaderSize)}
+	c.conn.Write([]byte(http2Preface))
+	c.writeSettings()
+	status, headers, body := c.response(1)
+	want, _ := os.ReadFile(filepath.Join(hs.DocRoot, "index.html"))
+	if status != "200" || headers["content-length"] != "306" || body != string(want) {
+		t.Errorf("got %s %v %q", status, headers, body)
+	}
+
+	// and it carries on as HTTP/2
+	c.request(3, "GET", "/missing", true)
+	if status, _, _ := c.response(3); status != "404" {
+		t.Errorf("second request got %s", status)
+	}
+}
+
+func TestHTTP2FlowControl(t *testing.T) {
+	hs := newTestServer(t)
+	addr := serveTest(t, hs, nil)
+	c := dialH2(t, addr, h2Setting{settingInitialWindowSize, 100})
+
+	c.request(1, "GET", "/index.html", true)
+	if f := c.readFrame(); f.typ != frameHeaders {
+		t.Fatalf("got frame %d", f.typ)
+	}
+	if f := c.readFrame(); f.typ != frameData || len(f.payload) != 100 || f.has(flagEndStream) {
+		t.Fatalf("got frame %d with %d bytes", f.typ, len(f.payload))
+	}
+
+	// nothing more until the window opens
+	c.conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := readFrame(c.conn, nil, h2MaxFrameSize); err == nil {
+		t.Fatal("server wrote past the window")
+	}
+	c.writeFrame(frameWindowUpdate, 0, 1, binary.BigEndian.AppendUint32(nil, 1000))
+	_, _, rest := c.response(1)
+	if len(rest) != 206 {
+		t.Errorf("got %d more bytes", len(rest))
+	}
+
+	// a PING in the meantime is answered
+	c.writeFrame(framePing, 0, 0, []byte("12345678"))
+	if f := c.readFrame(); f.typ != framePing || !f.has(flagAck) || string(f.payload) != "12345678" {
+		t.Errorf("got frame %d %q", f.typ, f.payload)
+	}
+}
+
+func TestHTTP2StreamErrors(t *testing.T) {
+	hs := newTestServer(t)
+	hs.MaxBodySize = 10
+	addr := serveTest(t, hs, nil)
+	c := dialH2(t, addr)
+
+	c.request(1, "GET", "/index.html", true, "Connection", "close")
+	if code := c.expectError(frameRSTStream); code != h2ProtocolError {
+		t.Errorf("uppercase connection header: code %d", code)
+	}
+	c.request(3, "GET", "/%2e%2e/secret", true)
+	if status, _, _ := c.response(3); status != "403" {
+		t.Errorf("traversal got %s", status)
+	}
+	c.request(5, "POST", "/index.html", false, "content-length", "100")
+	if status, _, _ := c.response(5); status != "413" {
+		t.Errorf("large body got %s", status)
+	}
+	if code := c.expectError(frameRSTStream); code != h2NoError {
+		t.Errorf("large body reset with %d", code)
+	}
+	c.request(7, "GET", "/index.html", true, "te", "gzip")
+	if code := c.expectError(frameRSTStream); code != h2ProtocolError {
+		t.Errorf("te: gzip got code %d", code)
+	}
+	c.request(9, "LOCK", "/index.html", true)
+	if status, headers, _ := c.response(9); status != "405" || headers["allow"] != "GET, HEAD" {
+		t.Errorf("LOCK got %s %v", status, headers)
+	}
+	c.request(11, "G(ET", "/index.html", true)
+	if code := c.expectError(frameRSTStream); code != h2ProtocolError {
+		t.Errorf("malformed method got code %d", code)
+	}
+}
+
+func TestHTTP2ConnectionErrors(t *testing.T) {
+	frames := map[string]h2Frame{
+		"DATA on stream 0":     {typ: frameData},
+		"even stream":          {typ: frameHeaders, flags: flagEndHeaders | flagEndStream, streamID: 2, payload: []byte{0x82}},
+		"push from the client": {typ: framePushPromise, streamID: 1, payload: make([]byte, 4)},
+		"bad PING":             {typ: framePing, payload: []byte{1}},
+		"broken header block":  {typ: frameHeaders, flags: flagEndHeaders, streamID: 1, payload: []byte{0x80}},
+		"window overflow":      {typ: frameWindowUpdate, payload: []byte{0x7f, 0xff, 0xff, 0xff}},
+		"CONTINUATION alone":   {typ: frameContinuation, flags: flagEndHeaders, streamID: 1},
+	}
+	hs := newTestServer(t)
+	addr := serveTest(t, hs, nil)
+	for name, f := range frames {
+		c := dialH2(t, addr)
+		c.writeFrame(f.typ, f.flags, f.streamID, f.payload)
+		if code := c.expectError(frameGoAway); code == h2NoError {
+			t.Errorf("%s: GOAWAY without an error", name)
+		}
+	}
+}
+
+func TestHTTP2GoAwayAfterMaxRequests(t *testing.T) {
+	hs := newTestServer(t)
+	hs.MaxRequestsPerConn = 2
+	addr := serveTest(t, hs, nil)
+	c := dialH2(t, addr)
+
+	c.request(1, "HEAD", "/index.html", true)
+	c.response(1)
+	c.request(3, "HEAD", "/index.html", true)
+	if code := c.expectError(frameGoAway); code != h2NoError {
+		t.Errorf("GOAWAY with code %d", code)
+	}
+	if status, headers, _ := c.response(3); status != "200" || headers["content-length"] != "306" {
+		t.Errorf("last request got %s %v", status, headers)
+	}
+
+	// the connection closes once the last stream is done
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(c.conn); err != nil {
+		t.Errorf("connection not closed: %v", err)
+	}
+}
+
+// a stream the client stops feeding doesn't hold the connection open
+func TestHTTP2StalledStream(t *testing.T) {
+	hs := newTestServer(t)
+	hs.ReadTimeout = 200 * time.Millisecond
+	hs.Mux.HandleFunc("/slow", func(w *ResponseWriter, r *HttpRequestHeader) {
+		time.Sleep(500 * time.Millisecond)
+		w.Headers()["Content-Length"] = "4"
+		w.WriteHeader(200)
+		w.Write([]byte("done"))
+	}, "GET")
+	addr := serveTest(t, hs, nil)
+
+	stalls := map[string]func(c *h2TestClient){
+		// the request body never comes
+		"body": func(c *h2TestClient) {
+			c.request(1, "POST", "/index.html", false, "content-length", "10")
+		},
+		// neither does the window for the rest of the response
+		"window": func(c *h2TestClient) {
+			c.request(1, "GET", "/index.html", true)
+			c.readFrame() // HEADERS
+			c.readFrame() // the first 100 bytes
+		},
+	}
+	for name, stall := range stalls {
+		c := dialH2(t, addr, h2Setting{settingInitialWindowSize, 100})
+		start := time.Now()
+		stall(c)
+		// PINGs don't keep the stream going for ever, they just reset the clock
+		for i := 0; i < 3; i++ {
+			time.Sleep(100 * time.Millisecond)
+			c.writeFrame(framePing, 0, 0, []byte("12345678"))
+			if f := c.readFrame(); f.typ != framePing {
+				t.Fatalf("%s: got frame %d", name, f.typ)
+			}
+		}
+		if code := c.expectError(frameGoAway); code != h2NoError {
+			t.Errorf("%s: GOAWAY with %d", name, code)
+		}
+		if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+			t.Errorf("%s: gave up after %v", name, elapsed)
+		}
+		c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := c.conn.Read(make([]byte, 1)); err == nil {
+			t.Errorf("%s: connection still open", name)
+		}
+	}
+
+	// a handler taking its time is no reason to give up on the client
+	c := dialH2(t, addr)
+	c.request(1, "GET", "/slow", true)
+	if status, _, body := c.response(1); status != "200" || body != "done" {
+		t.Errorf("slow handler: got %q %q", status, body)
+	}
+}
@@ -0,0 +1,104 @@
+package tritonhttp
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+// verbosity levels for HttpServer.LogLevel
+const (
+	LogInfo  = 0 // startup, shutdown and errors
+	LogDebug = 1 // also every connection, request and response header
+)
+
+// formats for HttpServer.AccessLogFormat
+const (
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+// CLF's timestamp, e.g. [10/Oct/2000:13:55:36 -0700]
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// one access log entry, the field names are the keys of the JSON format
+type accessLogEntry struct {
+	RemoteAddr	string	`json:"remote_addr"`
+	User		string	`json:"user"`
+	Time		string	`json:"time"`
+	Request		string	`json:"request"`
+	Status		int	`json:"status"`
+	BytesSent	int64	`json:"bytes_sent"`
+	Referer		string	`json:"referer"`
+	UserAgent	string	`json:"user_agent"`
+	LatencyMs	float64	`json:"latency_ms"`
+}
+
+func (hs *HttpServer) debugLog(v ...interface{}) {
+	if hs.LogLevel >= LogDebug {
+		log.Println(v...)
+	}
+}
+
+/*
+Writes one line for a finished response to the access log, either
+	1. Combined Log Format, with the latency in microseconds appended:
+	   host - user [time] "request line" status bytes "referer" "agent" usec
+	2. or the same fields as a JSON object
+requestHeader is nil when the request couldn't be parsed.
+*/
+func (hs *HttpServer) logAccess(w *ResponseWriter, requestHeader *HttpRequestHeader, start time.Time) {
+	if hs.AccessLog == nil {
+		return
+	}
+
+	entry := accessLogEntry{RemoteAddr: "-", User: "-", Request: "-",
+		Status: w.StatusCode(), BytesSent: w.BytesWritten(),
+		Time: start.Format(clfTimeFormat),
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+	if host, _, err := net.SplitHostPort(w.conn.RemoteAddr().String()); err == nil {
+		entry.RemoteAddr = host
+	}
+	if requestHeader != nil {
+		entry.Request = requestHeader.requestLine
+		entry.Referer = requestHeader.headers["Referer"]
+		entry.UserAgent = requestHeader.headers["User-Agent"]
+		if requestHeader.user != "" {
+			entry.User = requestHeader.user
+		}
+	}
+
+	var line []byte
+	if hs.AccessLogFormat == AccessLogJSON {
+		line, _ = json.Marshal(entry)
+	} else {
+		line = []byte(combinedLogLine(entry, time.Since(start)))
+	}
+	line = append(line, '\n')
+
+	hs.accessLogMu.Lock()
+	defer hs.accessLogMu.Unlock()
+	if _, err := hs.AccessLog.Write(line); err != nil {
+		log.Println("Error writing access log:", err)
+	}
+}
+
+func combinedLogLine(entry accessLogEntry, latency time.Duration) string {
+	bytesSent := "-" // CLF writes "-" rather than 0
+	if entry.BytesSent > 0 {
+		bytesSent = strconv.FormatInt(entry.BytesSent, 10)
+	}
+	return entry.RemoteAddr + " - " + entry.User + " [" + entry.Time + "] " +
+		strconv.Quote(entry.Request) + " " + strconv.Itoa(entry.Status) + " " +
+		bytesSent + " " + quoteOrDash(entry.Referer) + " " + quoteOrDash(entry.UserAgent) +
+		" " + strconv.FormatInt(latency.Microseconds(), 10)
+}
+
+func quoteOrDash(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return strconv.Quote(s)
+}
@@ -0,0 +1,54 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	for _, format := range []string{AccessLogCombined, AccessLogJSON} {
+		hs := newTestServer(t)
+		var accessLog bytes.Buffer
+		hs.AccessLog = &accessLog
+		hs.AccessLogFormat = format
+		addr := serveTest(t, hs, nil)
+
+		conn, err := net.Dial("tcp4", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roundTrip(t, conn, "GET /index.html HTTP/1.1\r\nHost: 127.0.0.1\r\n"+
+			"Referer: http://example.com/\r\nUser-Agent: test-agent\r\nConnection: close\r\n\r\n")
+		conn.Close()
+
+		// the entry is written just after the response goes out
+		line := ""
+		for i := 0; i < 100 && line == ""; i++ {
+			time.Sleep(10 * time.Millisecond)
+			hs.accessLogMu.Lock()
+			line = accessLog.String()
+			hs.accessLogMu.Unlock()
+		}
+		if format == AccessLogJSON {
+			var entry accessLogEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("bad JSON line %q: %v", line, err)
+			}
+			if entry.Request != "GET /index.html HTTP/1.1" || entry.Status != 200 ||
+				entry.BytesSent != 306 || entry.UserAgent != "test-agent" {
+				t.Fatalf("unexpected entry %+v", entry)
+			}
+			continue
+		}
+
+		combined := regexp.MustCompile(`^127\.0\.0\.1 - - \[[^\]]+\] "GET /index\.html HTTP/1\.1" ` +
+			`200 306 "http://example\.com/" "test-agent" \d+\n$`)
+		if !combined.MatchString(line) {
+			t.Fatalf("unexpected combined line %q", line)
+		}
+	}
+}
@@ -0,0 +1,467 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// how long a Digest nonce is good for, after that the client is told it's
+// stale and retries with a fresh one without asking the user again
+const digestNonceLifetime = 5 * time.Minute
+
+/*
+Restricts the urls under Prefix, matched like ServeMux prefixes, on the
+virtual host named VirtualHost or on every site if that's empty. In order
+	1. clients in Deny, or not in Allow when that's set, get a 403
+	2. if the rule has users, clients that don't authenticate as one of
+	   them get a 401 with a challenge for each scheme it has users for
+A rule with neither users nor IP lists lets everyone in. Basic auth sends
+the password in the clear, so it's best kept to HTTPS.
+*/
+type AuthRule struct {
+	Prefix		string
+	VirtualHost	string // a VirtualHost.Name, "" for every site
+	Realm		string
+	Allow		[]*net.IPNet
+	Deny		[]*net.IPNet
+
+	users		map[string]string // htpasswd hashes, for Basic
+	digestUsers	map[string]string // htdigest HA1s, for Digest
+	nonces		*digestNonces
+}
+
+/*
+The Digest nonces a rule hands out. Reload passes them on to the same rule
+in the next configuration, so the nonces clients hold stay good and their
+counts can't be replayed.
+*/
+type digestNonces struct {
+	secret	[]byte // signs them
+
+	mu		sync.Mutex
+	counts		map[string]uint64 // highest nc seen for each live nonce
+	nextSweep	time.Time         // when expired nonces are next dropped from counts
+}
+
+func NewAuthRule(prefix string, realm string) *AuthRule {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	return &AuthRule{Prefix: prefix, Realm: realm,
+		nonces: &digestNonces{secret: secret, counts: map[string]uint64{}}}
+}
+
+// which rule this is across reloads, e.g. "/private/" or "blog /private/"
+func (rule *AuthRule) key() string {
+	if rule.VirtualHost == "" {
+		return rule.Prefix
+	}
+	return rule.VirtualHost + " " + rule.Prefix
+}
+
+// checks a password against a hash whose scheme has been recognized
+type PasswordVerifier func(hash string, password string) bool
+
+var passwordHashesMu sync.RWMutex
+var passwordHashes = map[string]PasswordVerifier{
+	"{SHA}": verifySHA,
+	"$2a$": verifyBcrypt, "$2b$": verifyBcrypt, "$2y$": verifyBcrypt,
+}
+
+/*
+Teaches LoadHtpasswd a hash scheme, recognized by the prefix of the hash.
+"{SHA}" and bcrypt ("$2y$" and friends) are built in.
+*/
+func RegisterPasswordHash(prefix string, verify PasswordVerifier) {
+	passwordHashesMu.Lock()
+	defer passwordHashesMu.Unlock()
+	passwordHashes[prefix] = verify
+}
+
+// the verifier for hash's scheme, nil if we don't know it
+func passwordVerifier(hash string) PasswordVerifier {
+	passwordHashesMu.RLock()
+	defer passwordHashesMu.RUnlock()
+	for prefix, verify := range passwordHashes {
+		if strings.HasPrefix(hash, prefix) {
+			return verify
+		}
+	}
+	return nil
+}
+
+// htpasswd -s, the base64 SHA-1 of the password
+func verifySHA(hash string, password string) bool {
+	sum := sha1.Sum([]byte(password))
+	want := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(want)) == 1
+}
+
+// htpasswd -B
+func verifyBcrypt(hash string, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// the "name:rest" lines of an htpasswd or htdigest file, comments and blank
+// lines skipped
+func readCredentialFile(filename string) ([][2]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries [][2]string
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, rest, ok := strings.Cut(line, ":")
+		if !ok || name == "" {
+			return nil, errors.New(filename + ":" + strconv.Itoa(lineNo) + ": Malformed line")
+		}
+		entries = append(entries, [2]string{name, rest})
+	}
+	return entries, scanner.Err()
+}
+
+// adds the users of an htpasswd file for Basic auth. a hash in a scheme
+// nobody registered is an error, so it's caught at startup.
+func (rule *AuthRule) LoadHtpasswd(filename string) error {
+	entries, err := readCredentialFile(filename)
+	if err != nil {
+		return err
+	}
+	if rule.users == nil {
+		rule.users = map[string]string{}
+	}
+	for _, e := range entries {
+		if passwordVerifier(e[1]) == nil {
+			return errors.New(filename + ": Unsupported hash for " + e[0])
+		}
+		rule.users[e[0]] = e[1]
+	}
+	return nil
+}
+
+// adds the users of an htdigest file for Digest auth, only those in the
+// rule's realm since the realm is part of the hash
+func (rule *AuthRule) LoadHtdigest(filename string) error {
+	entries, err := readCredentialFile(filename)
+	if err != nil {
+		return err
+	}
+	if rule.digestUsers == nil {
+		rule.digestUsers = map[string]string{}
+	}
+	for _, e := range entries {
+		realm, ha1, ok := strings.Cut(e[1], ":")
+		if !ok || len(ha1) != 2*md5.Size {
+			return errors.New(filename + ": Malformed entry for " + e[0])
+		}
+		if realm == rule.Realm {
+			rule.digestUsers[e[0]] = strings.ToLower(ha1)
+		}
+	}
+	return nil
+}
+
+// a comma separated list of IPs and CIDR ranges, e.g. "10.0.0.0/8, ::1"
+func ParseIPList(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.New("Bad IP address " + entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Applies the AuthRule for the request's path, if any, answering with a 403 or
+401 itself. Returns whether the request may go on to the handlers.
+*/
+func (hs *HttpServer) authorize(w *ResponseWriter, requestHeader *HttpRequestHeader) bool {
+	if requestHeader.user != "" { // already checked before its body was read
+		return true
+	}
+	status, challenge := hs.authenticate(w.conn.RemoteAddr(), requestHeader)
+	if status == 0 {
+		return true
+	}
+	if challenge != "" {
+		w.Headers()["WWW-Authenticate"] = challenge
+	}
+	handleErrorResponse(w, status)
+	return false
+}
+
+/*
+Checks the request against the AuthRule for its path and sets its user if
+it logged in. Returns 0 if it may go on, otherwise the status to refuse it
+with and for a 401 the challenge.
+*/
+func (hs *HttpServer) authenticate(remoteAddr net.Addr, requestHeader *HttpRequestHeader) (int, string) {
+	rule := hs.authRule(hs.virtualHost(requestHeader).Name, requestHeader.url)
+	if rule == nil {
+		return 0, ""
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr.String())
+	if err != nil {
+		host = remoteAddr.String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || containsIP(rule.Deny, ip) || (len(rule.Allow) > 0 && !containsIP(rule.Allow, ip)) {
+		hs.debugLog("Client not allowed:", host)
+		return 403, ""
+	}
+	if rule.users == nil && rule.digestUsers == nil {
+		return 0, ""
+	}
+
+	scheme, credentials, _ := strings.Cut(requestHeader.Header("Authorization"), " ")
+	user, authType, stale := "", "", false
+	switch {
+	case strings.EqualFold(scheme, "Basic") && rule.users != nil:
+		user, authType = rule.checkBasic(credentials), "Basic"
+	case strings.EqualFold(scheme, "Digest") && rule.digestUsers != nil:
+		user, stale = rule.checkDigest(credentials, requestHeader)
+		authType = "Digest"
+	}
+	if user != "" {
+		requestHeader.user, requestHeader.authType = user, authType
+		return 0, ""
+	}
+	hs.debugLog("Unauthorized request for", requestHeader.url)
+	return 401, rule.challenge(stale)
+}
+
+// the rule for the longest prefix matching url on site, nil if none does.
+// one for just that site beats one for every site with the same prefix. the
+// path is cleaned first so "//private" can't slip past "/private", and a
+// "/private/" rule covers "/private" itself too.
+func (hs *HttpServer) authRule(site string, url string) *AuthRule {
+	url = path.Clean("/" + url)
+	var best *AuthRule
+	for _, rule := range hs.AuthRules {
+		if rule.VirtualHost != "" && rule.VirtualHost != site {
+			continue
+		}
+		prefix := strings.TrimSuffix(rule.Prefix, "/")
+		if !prefixMatch(prefix, url) {
+			continue
+		}
+		if best == nil || len(rule.Prefix) > len(best.Prefix) ||
+			len(rule.Prefix) == len(best.Prefix) && best.VirtualHost == "" {
+			best = rule
+		}
+	}
+	return best
+}
+
+// the WWW-Authenticate value, Digest first if we take both
+func (rule *AuthRule) challenge(stale bool) string {
+	var challenges []string
+	if rule.digestUsers != nil {
+		digest := "Digest realm=" + quoteAuthParam(rule.Realm) + `, qop="auth", algorithm=MD5, nonce="` + rule.newNonce(time.Now()) + `"`
+		if stale {
+			digest += ", stale=true"
+		}
+		challenges = append(challenges, digest)
+	}
+	if rule.users != nil {
+		challenges = append(challenges, "Basic realm="+quoteAuthParam(rule.Realm)+`, charset="UTF-8"`)
+	}
+	return strings.Join(challenges, ", ")
+}
+
+// the user the Basic credentials belong to, "" if they don't check out
+func (rule *AuthRule) checkBasic(credentials string) string {
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(credentials))
+	if err != nil {
+		return ""
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	hash, known := rule.users[user]
+	if !ok || !known {
+		return ""
+	}
+	if verify := passwordVerifier(hash); verify != nil && verify(hash, password) {
+		return user
+	}
+	return ""
+}
+
+// a nonce is when it was made and our signature of that, so we don't have
+// to remember the ones we've handed out
+func (rule *AuthRule) newNonce(now time.Time) string {
+	stamp := binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano()))
+	mac := hmac.New(sha256.New, rule.nonces.secret)
+	mac.Write(stamp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(stamp)[:8+16])
+}
+
+// when nonce was made, false if we didn't make it
+func (rule *AuthRule) nonceTime(nonce string) (time.Time, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(raw) != 8+16 {
+		return time.Time{}, false
+	}
+	mac := hmac.New(sha256.New, rule.nonces.secret)
+	mac.Write(raw[:8])
+	if !hmac.Equal(mac.Sum(nil)[:16], raw[8:]) {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(raw[:8]))), true
+}
+
+/*
+Checks a Digest response (RFC 7616 3.4) with qop=auth and MD5, the only
+ones htdigest files allow. Returns the user, or "" and whether the only
+problem was an expired nonce. A request count (nc) that doesn't go up is
+taken as a replay.
+*/
+func (rule *AuthRule) checkDigest(credentials string, requestHeader *HttpRequestHeader) (string, bool) {
+	params := parseAuthParams(credentials)
+	user, nonce, nc := params["username"], params["nonce"], params["nc"]
+	ha1, known := rule.digestUsers[user]
+	if !known || params["realm"] != rule.Realm || params["qop"] != "auth" ||
+		params["uri"] != requestURI(requestHeader) ||
+		(params["algorithm"] != "" && !strings.EqualFold(params["algorithm"], "MD5")) {
+		return "", false
+	}
+	count, err := strconv.ParseUint(nc, 16, 64)
+	if err != nil || len(nc) != 8 {
+		return "", false
+	}
+	issued, ok := rule.nonceTime(nonce)
+	if !ok {
+		return "", false
+	}
+
+	ha2 := md5Hex(requestHeader.verb + ":" + params["uri"])
+	want := md5Hex(ha1 + ":" + nonce + ":" + nc + ":" + params["cnonce"] + ":auth:" + ha2)
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(params["response"])), []byte(want)) != 1 {
+		return "", false
+	}
+	if time.Since(issued) > digestNonceLifetime {
+		return "", true
+	}
+	if !rule.useNonceCount(nonce, count, issued) {
+		return "", false
+	}
+	return user, false
+}
+
+// records count for nonce, false if it's been used already. once every
+// nonce lifetime the ones past it are forgotten.
+func (rule *AuthRule) useNonceCount(nonce string, count uint64, issued time.Time) bool {
+	nonces := rule.nonces
+	nonces.mu.Lock()
+	defer nonces.mu.Unlock()
+	if last, ok := nonces.counts[nonce]; ok && count <= last {
+		return false
+	}
+	nonces.counts[nonce] = count
+
+	now := time.Now()
+	if now.Before(nonces.nextSweep) {
+		return true
+	}
+	nonces.nextSweep = now.Add(digestNonceLifetime)
+	for n := range nonces.counts {
+		if t, _ := rule.nonceTime(n); now.Sub(t) > digestNonceLifetime {
+			delete(nonces.counts, n)
+		}
+	}
+	return true
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// the key=value pairs of a credentials string, values may be quoted
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+	for s = strings.TrimSpace(s); s != ""; {
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		rest = strings.TrimLeft(rest, " ")
+
+		var value strings.Builder
+		if strings.HasPrefix(rest, `"`) {
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				value.WriteByte(rest[i])
+			}
+			rest = rest[min(i+1, len(rest)):]
+		} else {
+			token, _, _ := strings.Cut(rest, ",")
+			value.WriteString(strings.TrimSpace(token))
+			rest = rest[len(token):]
+		}
+		params[key] = value.String()
+
+		_, s, _ = strings.Cut(rest, ",")
+		s = strings.TrimSpace(s)
+	}
+	return params
+}
+
+func quoteAuthParam(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,303 @@
+package tritonhttp
+
+import (
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// alice's password is "secret" in both files
+const (
+	testHtpasswd	= "# users\nalice:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n\nbob:{SHA}invalid\n"
+	testHtdigest	= "alice:Private:" + "c1d30b5cd84d5be1aaeb6c128ed15281" + "\nalice:Other:00000000000000000000000000000000\n"
+)
+
+// a server with /subdir1/ behind rule
+func newAuthServer(t *testing.T, rule *AuthRule) string {
+	hs := newTestServer(t)
+	hs.AuthRules = []*AuthRule{rule}
+	return serveTest(t, hs, nil)
+}
+
+func newTestAuthRule(t *testing.T, htpasswd bool, htdigest bool) *AuthRule {
+	t.Helper()
+	dir := t.TempDir()
+	rule := NewAuthRule("/subdir1/", "Private")
+	if htpasswd {
+		os.WriteFile(filepath.Join(dir, "htpasswd"), []byte(testHtpasswd), 0644)
+		if err := rule.LoadHtpasswd(filepath.Join(dir, "htpasswd")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if htdigest {
+		os.WriteFile(filepath.Join(dir, "htdigest"), []byte(testHtdigest), 0644)
+		if err := rule.LoadHtdigest(filepath.Join(dir, "htdigest")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rule
+}
+
+func authRequest(t *testing.T, addr string, path string, authorization string) (string, map[string]string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := "GET " + path + " HTTP/1.1" + CRLF + "Host: localhost" + CRLF + "Connection: close" + CRLF
+	if authorization != "" {
+		request += "Authorization: " + authorization + CRLF
+	}
+	status, headers, _ := roundTrip(t, conn, request+CRLF)
+	return status, headers
+}
+
+func basicCredentials(user string, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestBasicAuth(t *testing.T) {
+	addr := newAuthServer(t, newTestAuthRule(t, true, false))
+
+	cases := []struct {
+		path		string
+		authorization	string
+		status		string
+	}{
+		{"/index.html", "", "200"},
+		{"/subdir1/index.html", "", "401"},
+		{"/subdir1/", "", "401"},
+		{"/subdir1", "", "401"},
+		{"//subdir1/index.html", "", "401"},
+		{"/./subdir1/index.html", "", "401"},
+		{"/subdir1/index.html", basicCredentials("alice", "wrong"), "401"},
+		{"/subdir1/index.html", basicCredentials("bob", "secret"), "401"},
+		{"/subdir1/index.html", basicCredentials("mallory", "secret"), "401"},
+		{"/subdir1/index.html", "Basic !!!", "401"},
+		{"/subdir1/index.html", basicCredentials("alice", "secret"), "200"},
+		{"/subdir1/index.html", "basic " + base64.StdEncoding.EncodeToString([]byte("alice:secret")), "200"},
+	}
+	for _, tc := range cases {
+		status, headers := authRequest(t, addr, tc.path, tc.authorization)
+		if !strings.Contains(status, " "+tc.status+" ") {
+			t.Errorf("%s with %q: got %q, want %s", tc.path, tc.authorization, status, tc.status)
+		}
+		if tc.status == "401" && headers["WWW-Authenticate"] != `Basic realm="Private", charset="UTF-8"` {
+			t.Errorf("%s: challenge %q", tc.path, headers["WWW-Authenticate"])
+		}
+	}
+}
+
+// answers a Digest challenge the way a browser would
+func digestCredentials(challenge string, user string, password string, method string, uri string, nc string) string {
+	params := parseAuthParams(strings.TrimPrefix(challenge, "Digest "))
+	ha1 := md5Hex(user + ":" + params["realm"] + ":" + password)
+	ha2 := md5Hex(method + ":" + uri)
+	response := md5Hex(ha1 + ":" + params["nonce"] + ":" + nc + ":0a4f113b:auth:" + ha2)
+	return `Digest username="` + user + `", realm="` + params["realm"] + `", nonce="` + params["nonce"] +
+		`", uri="` + uri + `", qop=auth, nc=` + nc + `, cnonce="0a4f113b", response="` + response + `", algorithm=MD5`
+}
+
+func TestDigestAuth(t *testing.T) {
+	if md5Hex("alice:Private:secret") != "c1d30b5cd84d5be1aaeb6c128ed15281" {
+		t.Fatal("testHtdigest is out of date")
+	}
+	rule := newTestAuthRule(t, true, true)
+	addr := newAuthServer(t, rule)
+
+	status, headers := authRequest(t, addr, "/subdir1/index.html", "")
+	challenge := headers["WWW-Authenticate"]
+	if !strings.Contains(status, " 401 ") || !strings.HasPrefix(challenge, `Digest realm="Private", qop="auth"`) ||
+		!strings.Contains(challenge, `, Basic realm="Private"`) {
+		t.Fatalf("got %q with %q", status, challenge)
+	}
+
+	uri := "/subdir1/index.html?x=1"
+	good := digestCredentials(challenge, "alice", "secret", "GET", uri, "00000001")
+	if status, _ := authRequest(t, addr, uri, good); !strings.Contains(status, " 200 ") {
+		t.Errorf("got %q", status)
+	}
+	if status, _ := authRequest(t, addr, uri, good); !strings.Contains(status, " 401 ") {
+		t.Errorf("replayed nc: got %q", status)
+	}
+	next := digestCredentials(challenge, "alice", "secret", "GET", uri, "00000002")
+	if status, _ := authRequest(t, addr, uri, next); !strings.Contains(status, " 200 ") {
+		t.Errorf("next nc: got %q", status)
+	}
+
+	bad := map[string]string{
+		"wrong password": digestCredentials(challenge, "alice", "guess", "GET", uri, "00000003"),
+		"other uri": digestCredentials(challenge, "alice", "secret", "GET", "/subdir1/", "00000003"),
+		"forged nonce": digestCredentials(`Digest realm="Private", nonce="AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"`,
+			"alice", "secret", "GET", uri, "00000003"),
+	}
+	for name, authorization := range bad {
+		if status, headers := authRequest(t, addr, uri, authorization); !strings.Contains(status, " 401 ") ||
+			strings.Contains(headers["WWW-Authenticate"], "stale") {
+			t.Errorf("%s: got %q %q", name, status, headers["WWW-Authenticate"])
+		}
+	}
+
+	old := `Digest realm="Private", nonce="` + rule.newNonce(time.Now().Add(-digestNonceLifetime-time.Second)) + `"`
+	status, headers = authRequest(t, addr, uri, digestCredentials(old, "alice", "secret", "GET", uri, "00000001"))
+	if !strings.Contains(status, " 401 ") || !strings.Contains(headers["WWW-Authenticate"], "stale=true") {
+		t.Errorf("stale nonce: got %q %q", status, headers["WWW-Authenticate"])
+	}
+}
+
+func TestAuthIPLists(t *testing.T) {
+	loopback, _ := ParseIPList("127.0.0.1")
+	others, _ := ParseIPList("10.0.0.0/8, ::1")
+
+	rule := newTestAuthRule(t, true, false)
+	rule.Deny = loopback
+	addr := newAuthServer(t, rule)
+	if status, _ := authRequest(t, addr, "/subdir1/", basicCredentials("alice", "secret")); !strings.Contains(status, " 403 ") {
+		t.Errorf("denied: got %q", status)
+	}
+
+	rule = NewAuthRule("/subdir1/", "Private")
+	rule.Allow = others
+	addr = newAuthServer(t, rule)
+	if status, _ := authRequest(t, addr, "/subdir1/", ""); !strings.Contains(status, " 403 ") {
+		t.Errorf("not allowed: got %q", status)
+	}
+	rule.Allow = append(others, loopback...)
+	if status, _ := authRequest(t, addr, "/subdir1/", ""); !strings.Contains(status, " 200 ") {
+		t.Errorf("allowed without users: got %q", status)
+	}
+
+	if _, err := ParseIPList("10.0.0.0/33"); err == nil {
+		t.Error("parsed a bad range")
+	}
+	if _, err := ParseIPList("localhost"); err == nil {
+		t.Error("parsed a host name")
+	}
+}
+
+func TestPasswordHashRegistry(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "htpasswd")
+	os.WriteFile(filename, []byte("carol:$test$secret\n"), 0644)
+	if err := NewAuthRule("/", "r").LoadHtpasswd(filename); err == nil {
+		t.Fatal("loaded a hash nobody registered")
+	}
+
+	RegisterPasswordHash("$test$", func(hash string, password string) bool {
+		return hash == "$test$"+password
+	})
+	t.Cleanup(func() {
+		passwordHashesMu.Lock()
+		delete(passwordHashes, "$test$")
+		passwordHashesMu.Unlock()
+	})
+	rule := NewAuthRule("/", "r")
+	if err := rule.LoadHtpasswd(filename); err != nil {
+		t.Fatal(err)
+	}
+	if rule.checkBasic(base64.StdEncoding.EncodeToString([]byte("carol:secret"))) != "carol" {
+		t.Error("registered hash not used")
+	}
+}
+
+func TestBcryptHtpasswd(t *testing.T) {
+	// htpasswd -B writes $2y$, Go's bcrypt $2a$
+	filename := filepath.Join(t.TempDir(), "htpasswd")
+	os.WriteFile(filename, []byte("dave:$2y$04$MuKLHZvrPC3//nZ0/KmzHuDYT2DxGbqUVvt2BhaxmrRoCb4EUtMJ2\n"+
+		"erin:$2a$04$MuKLHZvrPC3//nZ0/KmzHuDYT2DxGbqUVvt2BhaxmrRoCb4EUtMJ2\n"), 0644)
+	rule := NewAuthRule("/subdir1/", "Private")
+	if err := rule.LoadHtpasswd(filename); err != nil {
+		t.Fatal(err)
+	}
+	addr := newAuthServer(t, rule)
+	for credentials, want := range map[string]string{
+		basicCredentials("dave", "secret"):	" 200 ",
+		basicCredentials("erin", "secret"):	" 200 ",
+		basicCredentials("dave", "wrong"):	" 401 ",
+	} {
+		if status, _ := authRequest(t, addr, "/subdir1/", credentials); !strings.Contains(status, want) {
+			t.Errorf("%s: got %q, want %s", credentials, status, want)
+		}
+	}
+}
+
+func TestAuthRuleVirtualHost(t *testing.T) {
+	hs := newTestServer(t)
+	blog, err := NewVirtualHost("blog", []string{"blog.example.com"}, hs.DocRoot, "../mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.VirtualHosts = []*VirtualHost{blog}
+	everywhere := newTestAuthRule(t, true, false)
+	blogOnly := newTestAuthRule(t, true, false)
+	blogOnly.VirtualHost, blogOnly.Realm = "blog", "Blog"
+	blogIndex := newTestAuthRule(t, true, false)
+	blogIndex.Prefix, blogIndex.VirtualHost, blogIndex.Realm = "/index.html", "blog", "Blog"
+	hs.AuthRules = []*AuthRule{blogOnly, everywhere, blogIndex}
+	addr := serveTest(t, hs, nil)
+
+	cases := []struct {
+		host	string
+		path	string
+		realm	string // "" if it isn't protected
+	}{
+		{"localhost", "/index.html", ""},
+		{"localhost", "/subdir1/", "Private"},
+		{"blog.example.com", "/index.html", "Blog"},
+		{"blog.example.com", "/subdir1/", "Blog"}, // the site's own rule wins
+	}
+	for _, tc := range cases {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, headers, _ := roundTrip(t, conn, "GET "+tc.path+" HTTP/1.1"+CRLF+"Host: "+tc.host+CRLF+
+			"Connection: close"+CRLF+CRLF)
+		conn.Close()
+		realm := ""
+		if strings.Contains(status, " 401 ") {
+			realm = parseAuthParams(strings.TrimPrefix(headers["WWW-Authenticate"], "Basic "))["realm"]
+		}
+		if realm != tc.realm || realm == "" && !strings.Contains(status, " 200 ") {
+			t.Errorf("%s%s: got %q in realm %q, want realm %q", tc.host, tc.path, status, realm, tc.realm)
+		}
+	}
+}
+
+func TestNonceCountSweep(t *testing.T) {
+	rule := NewAuthRule("/", "r")
+	old := rule.newNonce(time.Now().Add(-2 * digestNonceLifetime))
+	rule.nonces.counts[old] = 1
+	for i := 0; i < 3; i++ {
+		if !rule.useNonceCount(rule.newNonce(time.Now()), 1, time.Now()) {
+			t.Fatal("a fresh nonce was taken as a replay")
+		}
+	}
+	if _, ok := rule.nonces.counts[old]; ok || len(rule.nonces.counts) != 3 {
+		t.Errorf("%d nonces remembered", len(rule.nonces.counts))
+	}
+
+	// the next sweep is a lifetime away, until then expired ones stay
+	rule.nonces.counts[old] = 1
+	rule.useNonceCount(rule.newNonce(time.Now()), 1, time.Now())
+	if _, ok := rule.nonces.counts[old]; !ok {
+		t.Error("swept again straight away")
+	}
+	if rule.useNonceCount(old, 1, time.Now()) {
+		t.Error("accepted a replayed nc")
+	}
+}
+
+func TestParseAuthParams(t *testing.T) {
+	params := parseAuthParams(`username="a \"quoted\", name", qop=auth, nc=00000001 ,uri="/a,b"`)
+	want := map[string]string{"username": `a "quoted", name`, "qop": "auth", "nc": "00000001", "uri": "/a,b"}
+	for key, value := range want {
+		if params[key] != value {
+			t.Errorf("%s: got %q, want %q", key, params[key], value)
+		}
+	}
+}
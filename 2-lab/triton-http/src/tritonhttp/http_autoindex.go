@@ -0,0 +1,106 @@
+package tritonhttp
+
+import (
+	"encoding/json"
+	"html"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// one row of a directory listing, also the shape of the JSON listing
+type dirEntry struct {
+	Name		string	`json:"name"`
+	IsDir		bool	`json:"is_dir"`
+	Size		int64	`json:"size"`
+	Modified	string	`json:"modified"`
+}
+
+/*
+Renders the contents of dir without its dotfiles, sorted with
+sub-directories first. Clients asking for application/json get a JSON
+array, everyone else an HTML table. Names come from the filesystem so
+they're escaped both as url path segments in links and as HTML text.
+*/
+func (hs *HttpServer) handleDirectoryListing(w *ResponseWriter, requestHeader *HttpRequestHeader, dir string) {
+	entries, err := readDirEntries(dir)
+	if err != nil {
+		log.Println(err)
+		handleErrorResponse(w, fileErrorStatus(err))
+		return
+	}
+
+	var body []byte
+	if strings.Contains(requestHeader.headers["Accept"], "application/json") {
+		body, _ = json.Marshal(entries)
+		w.Headers()["Content-Type"] = "application/json"
+	} else {
+		body = []byte(directoryListingHTML(requestHeader.url, entries))
+		w.Headers()["Content-Type"] = "text/html"
+	}
+
+	w.Headers()["Vary"] = "Accept" // caches mustn't hand the HTML to a JSON client
+	w.Headers()["Content-Length"] = strconv.Itoa(len(body))
+	w.WriteHeader(200)
+	w.Write(body)
+}
+
+func readDirEntries(dir string) ([]dirEntry, error) {
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []dirEntry{}
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), ".") { // like PROPFIND, e.g. .htpasswd or DAV's .upload-* temps
+			continue
+		}
+		info, err := f.Info()
+		if err != nil { // removed while we were listing
+			continue
+		}
+		entry := dirEntry{Name: f.Name(), IsDir: info.IsDir(),
+			Modified: info.ModTime().UTC().Format(HttpTimeFormat)}
+		if !entry.IsDir {
+			entry.Size = info.Size()
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+func directoryListingHTML(urlPath string, entries []dirEntry) string {
+	var b strings.Builder
+	title := "Index of " + html.EscapeString(urlPath)
+
+	b.WriteString("<html>\n<head>\n<title>" + title + "</title>\n</head>\n<body>\n")
+	b.WriteString("<h1>" + title + "</h1>\n<table>\n")
+	b.WriteString("<tr><th>Name</th><th>Size</th><th>Last modified</th></tr>\n")
+	if urlPath != "/" {
+		b.WriteString("<tr><td><a href=\"../\">../</a></td><td></td><td></td></tr>\n")
+	}
+
+	for _, e := range entries {
+		name, href, size := e.Name, url.PathEscape(e.Name), strconv.FormatInt(e.Size, 10)
+		if e.IsDir {
+			name, href, size = name+"/", href+"/", "-"
+		}
+		b.WriteString("<tr><td><a href=\"" + html.EscapeString(href) + "\">" +
+			html.EscapeString(name) + "</a></td><td>" + size + "</td><td>" +
+			e.Modified + "</td></tr>\n")
+	}
+
+	b.WriteString("</table>\n</body>\n</html>\n")
+	return b.String()
+}
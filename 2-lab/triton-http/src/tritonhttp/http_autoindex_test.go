@@ -0,0 +1,106 @@
+package tritonhttp
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const awkwardName = `a<b&c"d%e f.txt`
+
+// a doc root with an awkwardly named file and directory and a couple of
+// dotfiles, no index.html
+func newListingServer(t *testing.T, autoIndex bool) string {
+	t.Helper()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, awkwardName), []byte("hello"), 0644)
+	os.Mkdir(filepath.Join(dir, "sub dir"), 0755)
+	os.WriteFile(filepath.Join(dir, ".htpasswd"), []byte("alice:x"), 0644)
+	os.WriteFile(filepath.Join(dir, "sub dir", ".upload-123"), []byte("half"), 0644)
+	hs, err := NewHttpdServer("", dir, "../mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.AutoIndex = autoIndex
+	return serveTest(t, hs, nil)
+}
+
+func getListing(t *testing.T, addr string, path string, accept string) (string, map[string]string, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := "GET " + path + " HTTP/1.1" + CRLF + "Host: localhost" + CRLF + "Connection: close" + CRLF
+	if accept != "" {
+		request += "Accept: " + accept + CRLF
+	}
+	return roundTrip(t, conn, request+CRLF)
+}
+
+func TestDirectoryListingHTML(t *testing.T) {
+	addr := newListingServer(t, true)
+	status, headers, body := getListing(t, addr, "/", "text/html")
+	if status != "HTTP/1.1 200 OK" || headers["Content-Type"] != "text/html" || headers["Vary"] != "Accept" {
+		t.Fatalf("got %q %v", status, headers)
+	}
+	want := []string{
+		`<a href="a%3Cb&amp;c%22d%25e%20f.txt">a&lt;b&amp;c&#34;d%e f.txt</a>`,
+		`<a href="sub%20dir/">sub dir/</a>`,
+	}
+	for _, line := range want {
+		if !strings.Contains(body, line) {
+			t.Errorf("%q missing from\n%s", line, body)
+		}
+	}
+	if strings.Index(body, "sub dir/") > strings.Index(body, "a&lt;b") {
+		t.Error("directories aren't listed first")
+	}
+	if strings.Contains(body, "../") {
+		t.Error("the root links to its parent")
+	}
+	if strings.Contains(body, ".htpasswd") {
+		t.Error("dotfiles are listed")
+	}
+
+	_, _, body = getListing(t, addr, "/sub%20dir/", "")
+	if !strings.Contains(body, "<title>Index of /sub dir/</title>") || !strings.Contains(body, `href="../"`) ||
+		strings.Contains(body, ".upload-") {
+		t.Errorf("got %s", body)
+	}
+
+	// without the trailing slash relative links would break
+	status, headers, _ = getListing(t, addr, "/sub%20dir", "")
+	if status != "HTTP/1.1 301 Moved Permanently" || headers["Location"] != "/sub%20dir/" {
+		t.Errorf("got %q to %q", status, headers["Location"])
+	}
+}
+
+func TestDirectoryListingJSON(t *testing.T) {
+	addr := newListingServer(t, true)
+	status, headers, body := getListing(t, addr, "/", "application/json, */*;q=0.1")
+	if status != "HTTP/1.1 200 OK" || headers["Content-Type"] != "application/json" || headers["Vary"] != "Accept" {
+		t.Fatalf("got %q %v", status, headers)
+	}
+	var entries []dirEntry
+	if err := json.Unmarshal([]byte(body), &entries); err != nil {
+		t.Fatalf("%v in %s", err, body)
+	}
+	if len(entries) != 2 || entries[0].Name != "sub dir" || !entries[0].IsDir || entries[0].Size != 0 ||
+		entries[1].Name != awkwardName || entries[1].IsDir || entries[1].Size != 5 || entries[1].Modified == "" {
+		t.Errorf("got %+v", entries)
+	}
+}
+
+func TestDirectoryListingOff(t *testing.T) {
+	addr := newListingServer(t, false)
+	for _, path := range []string{"/", "/sub%20dir/"} {
+		if status, _, body := getListing(t, addr, path, ""); status != "HTTP/1.1 404 Not Found" || strings.Contains(body, "sub dir") {
+			t.Errorf("%s: got %q %q", path, status, body)
+		}
+	}
+}
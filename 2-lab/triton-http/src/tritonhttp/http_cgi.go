@@ -0,0 +1,260 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+CGIHandler runs the scripts in Dir for urls under Prefix (RFC 3875). For
+/cgi-bin/report.py/2021/april?full=1 it runs Dir/report.py with
+	PATH_INFO=/2021/april and QUERY_STRING=full=1
+the request body on stdin and every request header as HTTP_<NAME>. The
+script prints its headers, a blank line and the body on stdout; a script
+still running after Timeout is killed.
+*/
+type CGIHandler struct {
+	Prefix	string // url prefix, e.g. "/cgi-bin/"
+	Dir	string // absolute path of the script directory
+	Timeout	time.Duration
+}
+
+func NewCGIHandler(prefix string, dir string, timeout time.Duration) (*CGIHandler, error) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(absDir); err != nil || !info.IsDir() {
+		return nil, errors.New("CGI directory doesn't exist: " + absDir)
+	}
+	return &CGIHandler{Prefix: prefix, Dir: absDir, Timeout: timeout}, nil
+}
+
+func (h *CGIHandler) ServeHTTP(w *ResponseWriter, requestHeader *HttpRequestHeader) {
+	script, scriptName, pathInfo := h.findScript(requestHeader.url)
+	if script == "" {
+		handleErrorResponse(w, 404)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Dir = filepath.Dir(script)
+	cmd.Env = h.environment(w, requestHeader, scriptName, pathInfo)
+	cmd.Stdin = bytes.NewReader(requestHeader.body)
+	cmd.Stderr = &cgiStderr{script: script}
+	cmd.WaitDelay = time.Second // don't wait forever on children holding stdout
+
+	stdout, err := cmd.StdoutPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		log.Println("CGI: can't run", script+":", err)
+		handleErrorResponse(w, 500)
+		return
+	}
+	defer cmd.Wait()
+
+	reader := bufio.NewReader(stdout)
+	resHeader, err := parseCGIHeader(reader)
+	if err != nil {
+		log.Println("CGI:", script, "sent a bad header:", err)
+		cmd.Process.Kill()
+		if ctx.Err() != nil {
+			handleErrorResponse(w, 504)
+		} else {
+			handleErrorResponse(w, 500)
+		}
+		return
+	}
+
+	for key, value := range resHeader.Headers {
+		w.Headers()[key] = value
+	}
+	w.reason = strings.TrimPrefix(resHeader.Status, strconv.Itoa(resHeader.StatusCode)+" ")
+	w.WriteHeader(resHeader.StatusCode)
+	if _, err := io.Copy(w, reader); err != nil || ctx.Err() != nil {
+		// the status line is out, cutting the connection is the only way
+		// left to tell the client the body is incomplete
+		log.Println("CGI:", script, "didn't finish:", err, ctx.Err())
+		w.abort()
+	}
+}
+
+// splits the url into the script to run and the extra path after it. the
+// first path segment that names a regular file in Dir is the script.
+func (h *CGIHandler) findScript(url string) (script string, scriptName string, pathInfo string) {
+	rest := strings.TrimPrefix(url, strings.TrimSuffix(h.Prefix, "/"))
+	segments := strings.Split(strings.TrimPrefix(rest, "/"), "/")
+
+	path := h.Dir
+	for i, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", "", ""
+		}
+		path = filepath.Join(path, segment)
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", "", ""
+		}
+		if info.Mode().IsRegular() {
+			if info.Mode().Perm()&0111 == 0 { // not executable
+				return "", "", ""
+			}
+			scriptName = strings.TrimSuffix(h.Prefix, "/") + "/" + strings.Join(segments[:i+1], "/")
+			if i+1 < len(segments) {
+				pathInfo = "/" + strings.Join(segments[i+1:], "/")
+			}
+			return path, scriptName, pathInfo
+		}
+	}
+	return "", "", ""
+}
+
+// the meta-variables of RFC 3875 4.1
+func (h *CGIHandler) environment(w *ResponseWriter, requestHeader *HttpRequestHeader, scriptName string, pathInfo string) []string {
+	host, port := requestHeader.headers["Host"], w.server.ServerPort
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	remoteAddr, remotePort, _ := net.SplitHostPort(w.conn.RemoteAddr().String())
+
+	env := []string{
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"SERVER_SOFTWARE=TritonHTTP",
+		"SERVER_PROTOCOL=" + requestHeader.proto,
+		"SERVER_NAME=" + host,
+		"SERVER_PORT=" + port,
+		"REQUEST_METHOD=" + requestHeader.verb,
+		"REQUEST_URI=" + requestURI(requestHeader),
+		"SCRIPT_NAME=" + scriptName,
+		"PATH_INFO=" + pathInfo,
+		"QUERY_STRING=" + requestHeader.rawQuery,
+		"REMOTE_ADDR=" + remoteAddr,
+		"REMOTE_PORT=" + remotePort,
+		"PATH=" + os.Getenv("PATH"),
+	}
+	if pathInfo != "" {
+		site := w.server.virtualHost(requestHeader)
+		env = append(env, "PATH_TRANSLATED="+filepath.Join(site.DocRoot, pathInfo))
+	}
+	if _, ok := w.conn.(*tls.Conn); ok {
+		env = append(env, "HTTPS=on")
+	}
+	if requestHeader.user != "" {
+		env = append(env, "REMOTE_USER="+requestHeader.user, "AUTH_TYPE="+requestHeader.authType)
+	}
+	if requestHeader.body != nil {
+		env = append(env, "CONTENT_LENGTH="+strconv.Itoa(len(requestHeader.body)))
+	}
+	if contentType, ok := requestHeader.headers["Content-Type"]; ok {
+		env = append(env, "CONTENT_TYPE="+contentType)
+	}
+
+	for key, value := range requestHeader.headers {
+		switch key {
+		case "Content-Length", "Content-Type": // already passed above
+			continue
+		case "Proxy": // "httpoxy", scripts would take it for HTTP_PROXY
+			continue
+		case "Authorization": // the password, once we've checked it
+			if requestHeader.user != "" {
+				continue
+			}
+		}
+		name := "HTTP_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		env = append(env, name+"="+value)
+	}
+	return env
+}
+
+// the request target as the client sent it, path and query
+func requestURI(requestHeader *HttpRequestHeader) string {
+	if requestHeader.rawQuery == "" {
+		return requestHeader.rawPath
+	}
+	return requestHeader.rawPath + "?" + requestHeader.rawQuery
+}
+
+/*
+Reads the script's header block (RFC 3875 6.3), ended by an empty line.
+Lines may end in LF or CRLF. The status comes from
+	1. the Status header, e.g. "Status: 404 Not Found", its reason phrase
+	   is kept, one is made up if it has none
+	2. otherwise a Location header makes it a 302 redirect
+	3. otherwise it's a 200
+*/
+func parseCGIHeader(reader *bufio.Reader) (HttpResponseHeader, error) {
+	resHeader := HttpResponseHeader{Proto: "HTTP/1.1", StatusCode: 200, Headers: map[string]string{}}
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return resHeader, err
+		}
+		line = strings.TrimRight(line, CRLF)
+		if line == "" {
+			break
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return resHeader, errors.New("Bad header line: " + line)
+		}
+		key, value := textproto.CanonicalMIMEHeaderKey(line[:i]), strings.TrimSpace(line[i+1:])
+		if existing, ok := resHeader.Headers[key]; ok {
+			value = existing + "\n" + value // repeated header, e.g. Set-Cookie
+		}
+		resHeader.Headers[key] = value
+	}
+
+	reason := ""
+	if status, ok := resHeader.Headers["Status"]; ok {
+		delete(resHeader.Headers, "Status")
+		fields := strings.SplitN(status, " ", 2)
+		code, err := strconv.Atoi(fields[0])
+		if err != nil || code < 100 || code > 999 {
+			return resHeader, errors.New("Bad Status header: " + status)
+		}
+		resHeader.StatusCode = code
+		if len(fields) == 2 {
+			reason = strings.TrimSpace(fields[1])
+		}
+	} else if _, ok := resHeader.Headers["Location"]; ok {
+		resHeader.StatusCode = 302
+	}
+	if reason == "" {
+		reason = statusReason(resHeader.StatusCode)
+	}
+	resHeader.Status = strconv.Itoa(resHeader.StatusCode) + " " + reason
+
+	// framing is ours to decide
+	delete(resHeader.Headers, "Transfer-Encoding")
+	delete(resHeader.Headers, "Connection")
+	return resHeader, nil
+}
+
+// passes whatever the script writes to stderr on to our log
+type cgiStderr struct {
+	script	string
+}
+
+func (e *cgiStderr) Write(p []byte) (int, error) {
+	log.Printf("CGI %s: %s", e.script, strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
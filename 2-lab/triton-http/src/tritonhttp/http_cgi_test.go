@@ -0,0 +1,79 @@
+package tritonhttp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writes an executable shell script into dir
+func writeTestScript(t *testing.T, dir string, name string, script string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCGI(t *testing.T) {
+	dir := t.TempDir()
+	writeTestScript(t, dir, "env.sh", `body=$(cat)
+printf 'Content-Type: text/plain\r\nX-Script: env\r\n\r\n'
+echo "$REQUEST_METHOD|$QUERY_STRING|$SCRIPT_NAME|$PATH_INFO|$HTTP_X_TOKEN|$CONTENT_LENGTH|$body"
+`)
+	writeTestScript(t, dir, "missing.sh", `printf 'Status: 404 Not Found\n\nnope'`)
+	writeTestScript(t, dir, "teapot.sh", `printf 'Status: 418 Short And Stout\n\ntea'`)
+	writeTestScript(t, dir, "unknown.sh", `printf 'Status: 299\n\nok'`)
+	writeTestScript(t, dir, "proto.sh", `printf 'Content-Type: text/plain\n\n%s' "$SERVER_PROTOCOL"`)
+	writeTestScript(t, dir, "slow.sh", `sleep 5`)
+	os.WriteFile(filepath.Join(dir, "data.txt"), []byte("not a script"), 0644)
+
+	cgi, err := NewCGIHandler("/cgi-bin/", dir, 500*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := newTestServer(t)
+	hs.Mux.Handle("/cgi-bin/", cgi)
+	addr := serveTest(t, hs, nil)
+
+	tests := []struct {
+		request string
+		status  string
+		body    string
+	}{
+		{"POST /cgi-bin/env.sh/extra/path?a=1&b=2 HTTP/1.1\r\nHost: 127.0.0.1\r\nX-Token: t0k\r\n" +
+			"Content-Length: 5\r\nConnection: close\r\n\r\nhello",
+			"HTTP/1.1 200 OK", "POST|a=1&b=2|/cgi-bin/env.sh|/extra/path|t0k|5|hello\n"},
+		{"GET /cgi-bin/missing.sh HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n\r\n",
+			"HTTP/1.1 404 Not Found", "nope"},
+		{"GET /cgi-bin/teapot.sh HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n\r\n",
+			"HTTP/1.1 418 Short And Stout", "tea"},
+		{"GET /cgi-bin/unknown.sh HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n\r\n",
+			"HTTP/1.1 299 Success", "ok"},
+		{"GET /cgi-bin/proto.sh HTTP/1.0\r\n\r\n",
+			"HTTP/1.1 200 OK", "HTTP/1.0"},
+		{"GET /cgi-bin/data.txt HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n\r\n",
+			"HTTP/1.1 404 Not Found", "Not Found"},
+		{"GET /cgi-bin/../cgi-bin/env.sh HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n\r\n",
+			"HTTP/1.1 403 Forbidden", "Forbidden"},
+		{"GET /cgi-bin/slow.sh HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n\r\n",
+			"HTTP/1.1 504 Gateway Timeout", "Gateway Timeout"},
+	}
+	for _, test := range tests {
+		conn, err := net.Dial("tcp4", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, headers, body := roundTrip(t, conn, test.request)
+		conn.Close()
+		if headers["Transfer-Encoding"] == "chunked" {
+			body = dechunk(body)
+		}
+		if status != test.status || body != test.body {
+			t.Errorf("%s: got %q %q, want %q %q", strings.Fields(test.request)[1],
+				status, body, test.status, test.body)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package tritonhttp
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	changesQueueLen		= 64 // messages a client may fall behind before it's dropped
+	changesPingInterval	= 30 * time.Second
+)
+
+// one message on the change feed, Host is the virtual host's name for
+// files under its doc root
+type docRootChange struct {
+	Host	string	`json:"host,omitempty"`
+	Path	string	`json:"path"`
+}
+
+/*
+Serves the change feed, Start mounts it at ChangesPath. Every client gets a
+JSON text message like {"path":"/subdir1/index.html"} for each file created,
+modified, moved or deleted under its virtual host's doc root, except:
+ 1. dotfiles and files in dot directories, like DAV's .upload-* temps
+ 2. files under an AuthRule other than the one the client passed to get
+    the feed
+Clients that can't keep up are closed with 1013 (try again later), they've
+missed changes.
+*/
+func (hs *HttpServer) ChangesHandler() Handler {
+	h := NewWebSocketHandler(hs.serveChanges)
+	h.PingInterval = changesPingInterval
+	return h
+}
+
+func (hs *HttpServer) serveChanges(ws *WebSocket, requestHeader *HttpRequestHeader) {
+	changes := hs.subscribeChanges()
+	defer hs.unsubscribeChanges(changes)
+
+	// the client isn't expected to say anything, but its pongs and close
+	// still have to be read
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case path, ok := <-changes:
+			if !ok {
+				ws.Close(WebSocketCloseTryAgainLater, "Too far behind")
+			} else if message := hs.current().changeFor(requestHeader, path); message == nil {
+				continue
+			} else if ws.WriteMessage(WebSocketText, message) == nil {
+				continue
+			}
+			<-done
+			return
+		}
+	}
+}
+
+// a new client for the change feed, starting the doc root watcher if it
+// isn't running yet
+func (hs *HttpServer) subscribeChanges() chan string {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	hs.watchDocRootsLocked()
+	if hs.changeSubs == nil {
+		hs.changeSubs = map[chan string]bool{}
+	}
+	changes := make(chan string, changesQueueLen)
+	hs.changeSubs[changes] = true
+	return changes
+}
+
+func (hs *HttpServer) unsubscribeChanges(changes chan string) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.changeSubs[changes] {
+		delete(hs.changeSubs, changes)
+		close(changes)
+	}
+}
+
+// tells every change feed client about path. the watcher mustn't wait on
+// a slow client, so one whose queue is full is dropped instead.
+func (hs *HttpServer) broadcastChange(path string) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	for changes := range hs.changeSubs {
+		select {
+		case changes <- path:
+		default:
+			delete(hs.changeSubs, changes)
+			close(changes)
+		}
+	}
+}
+
+// the message telling the client that sent requestHeader about path, nil
+// if it isn't one of its files or it may not see it
+func (hs *HttpServer) changeFor(requestHeader *HttpRequestHeader, path string) []byte {
+	site := hs.virtualHost(requestHeader)
+	rel, ok := relativeURLPath(site.DocRoot, path)
+	if !ok || strings.Contains(rel, "/.") {
+		return nil
+	}
+	if rule := hs.authRule(site.Name, rel); rule != nil {
+		passed := hs.authRule(site.Name, requestHeader.url)
+		if passed == nil || passed.key() != rule.key() {
+			return nil
+		}
+	}
+	message, err := json.Marshal(docRootChange{Host: site.Name, Path: rel})
+	if err != nil {
+		return nil
+	}
+	return message
+}
+
+func relativeURLPath(root string, path string) (string, bool) {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	if rel == "." {
+		return "/", true
+	}
+	return "/" + filepath.ToSlash(rel), true
+}
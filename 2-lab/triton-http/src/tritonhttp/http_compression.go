@@ -0,0 +1,127 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// content codings we can produce, in order of preference
+var compressionEncodings = []string{"gzip", "deflate"}
+
+// files up to this size are compressed into memory first so the response
+// can carry a Content-Length, larger ones are streamed with chunked encoding
+const maxBufferedCompression = 256*KB
+
+// MIME types that are worth compressing, images and archives are already
+// compressed and only get bigger
+func compressible(contentType string) bool {
+	contentType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	if strings.HasPrefix(contentType, "text/") {
+		return true
+	}
+	switch contentType {
+	case "application/json", "application/javascript", "application/x-javascript",
+		"application/xml", "image/svg+xml":
+		return true
+	}
+	return strings.HasSuffix(contentType, "+json") || strings.HasSuffix(contentType, "+xml")
+}
+
+/*
+Picks the coding to use from an Accept-Encoding header such as
+"gzip;q=0.8, deflate, *;q=0" (RFC 7231 5.3.4). The coding with the highest
+q-value wins, ties go to our preferred order. "" means send it as is, which
+is also the answer for a missing header.
+*/
+func negotiateEncoding(acceptEncoding string) string {
+	if strings.TrimSpace(acceptEncoding) == "" {
+		return ""
+	}
+
+	qvalues := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		qvalues[coding] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, coding := range compressionEncodings {
+		q, ok := qvalues[coding]
+		if !ok {
+			q, ok = qvalues["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	return best
+}
+
+// "abc" becomes "abc-gzip"
+func encodedETag(etag string, encoding string) string {
+	if etag == "" {
+		return ""
+	}
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+func newCompressor(w io.Writer, encoding string) io.WriteCloser {
+	if encoding == "deflate" { // HTTP's "deflate" is the zlib format
+		return zlib.NewWriter(w)
+	}
+	return gzip.NewWriter(w)
+}
+
+func (hs *HttpServer) sendCompressed(w *ResponseWriter, file *cachedFile, encoding string) {
+	f, err := file.open()
+	if err != nil {
+		log.Println(err)
+		handleErrorResponse(w, fileErrorStatus(err))
+		return
+	}
+	defer file.release(f)
+
+	if file.size <= maxBufferedCompression {
+		var buf bytes.Buffer
+		cw := newCompressor(&buf, encoding)
+		if _, err := io.Copy(cw, f); err != nil {
+			log.Println("Error compressing file:", err)
+			handleErrorResponse(w, 500) // drops Content-Encoding and Vary
+			return
+		}
+		cw.Close()
+		w.Headers()["Content-Length"] = strconv.Itoa(buf.Len())
+		w.WriteHeader(200)
+		w.Write(buf.Bytes())
+		return
+	}
+
+	// no Content-Length, so the writer falls back to chunked encoding
+	w.WriteHeader(200)
+	cw := newCompressor(w, encoding)
+	if _, err := io.Copy(cw, f); err != nil {
+		// closing cw would end the body as if it were complete
+		log.Println("Error sending compressed file:", err)
+		w.abort()
+		return
+	}
+	cw.Close()
+}
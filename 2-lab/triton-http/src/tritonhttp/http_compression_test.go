@@ -0,0 +1,157 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]string{
+		"":				"",
+		"gzip":				"gzip",
+		"GZIP":				"gzip",
+		"deflate":			"deflate",
+		"gzip, deflate":		"gzip",
+		"deflate, gzip":		"gzip",
+		"gzip;q=0.5, deflate;q=0.8":	"deflate",
+		"gzip; q=0.5 , deflate":	"deflate",
+		"gzip;q=0":			"",
+		"gzip;q=0, deflate":		"deflate",
+		"*":				"gzip",
+		"*;q=0":			"",
+		"*;q=0.1, gzip;q=0":		"deflate",
+		"identity":			"",
+		"identity, gzip;q=0.2":		"gzip",
+		"br":				"",
+		"gzip;q=bogus":			"gzip",
+	}
+	for header, want := range cases {
+		if got := negotiateEncoding(header); got != want {
+			t.Errorf("%q: got %q, want %q", header, got, want)
+		}
+	}
+}
+
+// a doc root with page.html and, if gz is set, a page.html.gz holding gz
+func newCompressionServer(t *testing.T, gz string) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "page.html"), []byte(strings.Repeat("<p>plain</p>", 100)), 0644)
+	if gz != "" {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(gz))
+		zw.Close()
+		os.WriteFile(filepath.Join(dir, "page.html.gz"), buf.Bytes(), 0644)
+	}
+	hs, err := NewHttpdServer("", dir, "../mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, serveTest(t, hs, nil)
+}
+
+func getEncoded(t *testing.T, addr string, path string, acceptEncoding string) (string, map[string]string, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return roundTrip(t, conn, "GET "+path+" HTTP/1.1"+CRLF+"Host: localhost"+CRLF+
+		"Accept-Encoding: "+acceptEncoding+CRLF+"Connection: close"+CRLF+CRLF)
+}
+
+func TestCompressOnTheFly(t *testing.T) {
+	_, addr := newCompressionServer(t, "")
+	plain := strings.Repeat("<p>plain</p>", 100)
+
+	_, identity, body := getEncoded(t, addr, "/page.html", "identity")
+	if body != plain || identity["Content-Encoding"] != "" || identity["Vary"] != "Accept-Encoding" {
+		t.Fatalf("identity: got %v", identity)
+	}
+
+	for encoding, open := range map[string]func(io.Reader) (io.Reader, error){
+		"gzip":		func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		"deflate":	func(r io.Reader) (io.Reader, error) { return zlib.NewReader(r) },
+	} {
+		status, headers, body := getEncoded(t, addr, "/page.html", encoding)
+		if status != "HTTP/1.1 200 OK" || headers["Content-Encoding"] != encoding ||
+			headers["Content-Type"] != "text/html" || headers["ETag"] != encodedETag(identity["ETag"], encoding) {
+			t.Errorf("%s: got %q %v", encoding, status, headers)
+			continue
+		}
+		r, err := open(strings.NewReader(body))
+		if err != nil {
+			t.Errorf("%s: %v", encoding, err)
+			continue
+		}
+		if decoded, err := io.ReadAll(r); err != nil || string(decoded) != plain {
+			t.Errorf("%s: decoded %d bytes, %v", encoding, len(decoded), err)
+		}
+	}
+
+	// images aren't worth it
+	_, headers, _ := getEncoded(t, addr, "/missing.png", "gzip")
+	if headers["Content-Encoding"] != "" {
+		t.Errorf("compressed a 404 for an image: %v", headers)
+	}
+}
+
+func TestPrecompressedSibling(t *testing.T) {
+	dir, addr := newCompressionServer(t, "from the gz file")
+	gzInfo, _ := os.Stat(filepath.Join(dir, "page.html.gz"))
+
+	_, plain, _ := getEncoded(t, addr, "/page.html", "identity")
+	status, headers, body := getEncoded(t, addr, "/page.html", "gzip")
+	if status != "HTTP/1.1 200 OK" || headers["Content-Encoding"] != "gzip" || headers["Content-Type"] != "text/html" {
+		t.Fatalf("got %q %v", status, headers)
+	}
+	if headers["ETag"] != statETag(gzInfo) || headers["ETag"] == plain["ETag"] {
+		t.Errorf("sibling sent with ETag %q, plain file has %q", headers["ETag"], plain["ETag"])
+	}
+	zr, err := gzip.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded, _ := io.ReadAll(zr); string(decoded) != "from the gz file" {
+		t.Errorf("got %q", decoded)
+	}
+
+	// deflate clients get the original compressed on the fly
+	if _, headers, _ := getEncoded(t, addr, "/page.html", "deflate"); headers["Content-Encoding"] != "deflate" {
+		t.Errorf("deflate: got %v", headers)
+	}
+}
+
+func TestCompressionReadError(t *testing.T) {
+	hs := newTestServer(t)
+	for _, size := range []int64{10, maxBufferedCompression + 1} {
+		client, server := net.Pipe()
+		go func() {
+			defer server.Close()
+			w := newResponseWriter(hs, server, &HttpRequestHeader{verb: "GET", proto: "HTTP/1.1", headers: map[string]string{}})
+			w.Headers()["Content-Encoding"], w.Headers()["Vary"] = "gzip", "Accept-Encoding"
+			// reading a directory fails after it's opened
+			hs.sendCompressed(w, &cachedFile{path: t.TempDir(), size: size}, "gzip")
+			w.finish()
+		}()
+		response, _ := io.ReadAll(client)
+		client.Close()
+
+		if size <= maxBufferedCompression {
+			if !strings.HasPrefix(string(response), "HTTP/1.1 500 ") || strings.Contains(string(response), "Content-Encoding") {
+				t.Errorf("buffered: got %q", response)
+			}
+		} else if strings.HasSuffix(string(response), "0"+CRLF+CRLF) {
+			t.Errorf("streamed: got a complete body %q", response)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package tritonhttp
+
+import (
+	"strings"
+	"time"
+)
+
+// date formats a client may use in If-Modified-Since (RFC 7231 7.1.1.1)
+var httpTimeFormats = []string{
+	HttpTimeFormat,
+	"Monday, 02-Jan-06 15:04:05 GMT", // RFC 850
+	time.ANSIC,
+}
+
+func parseHttpTime(value string) (time.Time, error) {
+	var err error
+	for _, layout := range httpTimeFormats {
+		var t time.Time
+		if t, err = time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, err
+}
+
+/*
+Decides whether the client's cached copy is still fresh (RFC 7232 6)
+	1. If-None-Match takes precedence, it matches if any listed tag (or *)
+	   is weakly equal to the current ETag
+	2. otherwise If-Modified-Since matches if the file hasn't changed since
+	   that date, compared at second granularity as that's all the date holds
+*/
+func notModified(requestHeader *HttpRequestHeader, etag string, modTime time.Time) bool {
+	if inm, ok := requestHeader.headers["If-None-Match"]; ok {
+		return etagListMatch(inm, etag, false)
+	}
+
+	if ims, ok := requestHeader.headers["If-Modified-Since"]; ok && !modTime.IsZero() {
+		t, err := parseHttpTime(ims)
+		if err != nil { // an invalid date is ignored
+			return false
+		}
+		return !modTime.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// checks a comma separated list of entity tags against etag. the weak
+// comparison ignores the W/ prefix, the strong one never matches weak tags.
+func etagListMatch(list string, etag string, strong bool) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if strings.HasPrefix(tag, "W/") {
+			if strong {
+				continue
+			}
+			tag = tag[2:]
+		}
+		if tag == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,279 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// largest file kept in memory unless the config says otherwise
+const DefaultContentCacheMaxFile = 256*KB
+
+// a small file held in memory, with its gzip variant if it's compressible
+type cachedContent struct {
+	key		string // the request path it answers, see contentCache
+	path		string // the file it was read from
+	gzPath		string // the .gz file next to it, if that's where gzipped came from
+	targets		[]string // where symlinks in path or gzPath lead, see symlinkTargets
+	data		[]byte
+	gzipped		[]byte
+	etag		string
+	gzipETag	string
+	modTime		time.Time
+	elem		*list.Element
+}
+
+func (c *cachedContent) cost() int64 {
+	return int64(len(c.data) + len(c.gzipped))
+}
+
+// whether a change to path affects this entry
+func (c *cachedContent) dependsOn(path string) bool {
+	prefix := path + "/"
+	for _, p := range append([]string{c.key, c.path, c.gzPath}, c.targets...) {
+		if p != "" && (p == path || strings.HasPrefix(p, prefix)) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+An LRU cache of file contents within a byte budget. Entries are keyed by the
+absolute path a request maps to, with a trailing "/" for directories so a
+directory's index.html is found without touching the disk.
+
+Nothing is stat'ed on a hit, entries are dropped when the doc root watcher
+reports a change to the file (or its .gz sibling, or a directory above it,
+or wherever a symlink on the way led).
+A load that raced with such a change isn't kept, gen counts invalidations.
+*/
+type contentCache struct {
+	mu		sync.Mutex
+	budget		int64
+	maxFile		int64
+	used		int64
+	gen		uint64
+	entries		map[string]*cachedContent
+	lru		*list.List // most recently used first
+
+	hits	atomic.Int64
+	misses	atomic.Int64
+}
+
+func newContentCache(budget int64, maxFile int64) *contentCache {
+	return &contentCache{budget: budget, maxFile: maxFile,
+		entries: map[string]*cachedContent{}, lru: list.New()}
+}
+
+func (cc *contentCache) get(key string) *cachedContent {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	c, ok := cc.entries[key]
+	if ok {
+		cc.lru.MoveToFront(c.elem)
+	}
+	return c
+}
+
+// the invalidation generation, to pass to add after reading a file
+func (cc *contentCache) generation() uint64 {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.gen
+}
+
+// keeps c unless something was invalidated since gen, evicting the least
+// recently used entries to stay within the budget
+func (cc *contentCache) add(c *cachedContent, gen uint64) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if gen != cc.gen || c.cost() > cc.budget {
+		return
+	}
+	if old, ok := cc.entries[c.key]; ok {
+		cc.remove(old)
+	}
+	c.elem = cc.lru.PushFront(c)
+	cc.entries[c.key] = c
+	cc.used += c.cost()
+	for cc.used > cc.budget {
+		cc.remove(cc.lru.Back().Value.(*cachedContent))
+	}
+}
+
+// drops everything that depends on path, called by the watcher
+func (cc *contentCache) invalidate(path string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.gen++
+	for _, c := range cc.entries {
+		if c.dependsOn(path) {
+			cc.remove(c)
+		}
+	}
+}
+
+// the caller holds cc.mu
+func (cc *contentCache) remove(c *cachedContent) {
+	cc.lru.Remove(c.elem)
+	delete(cc.entries, c.key)
+	cc.used -= c.cost()
+}
+
+// reads file into memory under key. compressible files get a gzip variant,
+// taken from a .gz file next to it if there is one. nil if it's too big or
+// can't be read. gen is the generation from before file was stat'ed.
+func (cc *contentCache) load(key string, file *cachedFile, gz *cachedFile, targets []string, compress bool, gen uint64) *cachedContent {
+	if file.size > cc.maxFile {
+		return nil
+	}
+
+	data, err := readCachedFile(file)
+	if err != nil {
+		return nil
+	}
+	c := &cachedContent{key: key, path: file.path, targets: targets, data: data, etag: file.etag, modTime: file.modTime}
+
+	if compress && gz != nil && gz.size <= cc.maxFile {
+		if c.gzipped, err = readCachedFile(gz); err != nil {
+			return nil
+		}
+		c.gzPath, c.gzipETag = gz.path, gz.etag
+	} else if compress {
+		var buf bytes.Buffer
+		gw := gzip.NewWriter(&buf)
+		gw.Write(data)
+		gw.Close()
+		c.gzipped, c.gzipETag = buf.Bytes(), encodedETag(file.etag, "gzip")
+	}
+
+	cc.add(c, gen)
+	return c
+}
+
+// the whole file, as long as it's still the size we stat'ed
+func readCachedFile(file *cachedFile) ([]byte, error) {
+	f, err := file.open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.release(f)
+
+	data := make([]byte, file.size)
+	if _, err := io.ReadFull(f, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+/*
+Answers a request from memory, the same way handleResponse would from disk.
+Returns false, without having touched w, for what the cache can't answer
+	1. Range requests
+	2. an encoding we have no variant for
+*/
+func (hs *HttpServer) serveContent(w *ResponseWriter, requestHeader *HttpRequestHeader, c *cachedContent, contentType string) bool {
+	if _, hasRange := requestHeader.headers["Range"]; hasRange {
+		return false
+	}
+
+	body, etag, encoding := c.data, c.etag, ""
+	vary := compressible(contentType)
+	if vary {
+		encoding = negotiateEncoding(requestHeader.headers["Accept-Encoding"])
+		if encoding == "gzip" && c.gzipped != nil {
+			body, etag = c.gzipped, c.gzipETag
+		} else if encoding != "" {
+			return false
+		}
+	}
+
+	headers := w.Headers()
+	if vary {
+		headers["Vary"] = "Accept-Encoding"
+	}
+	if encoding != "" {
+		headers["Content-Encoding"] = encoding
+	}
+	headers["Content-Type"] = contentType
+	headers["Content-Length"] = strconv.Itoa(len(body))
+	headers["Last-Modified"] = c.modTime.UTC().Format(HttpTimeFormat)
+	headers["ETag"] = etag
+	headers["Accept-Ranges"] = "bytes"
+
+	if notModified(requestHeader, etag, c.modTime) {
+		hs.handleNotModified(w)
+	} else if requestHeader.verb == "HEAD" {
+		w.WriteHeader(200)
+	} else {
+		w.WriteHeader(200)
+		w.Write(body)
+	}
+	return true
+}
+
+/*
+The watcher names a changed file by where it is under the doc root, so an
+entry for a file reached through a symlink also has to be dropped when the
+link's target changes. Returns those targets, named under root the way the
+watcher would, for the files that aren't where their path says. False if
+one leads outside root, where no change would ever be seen.
+*/
+func (hs *HttpServer) symlinkTargets(root string, files ...*cachedFile) ([]string, bool) {
+	realRoot, err := hs.realRoot(root)
+	if err != nil {
+		return nil, false
+	}
+	var targets []string
+	for _, file := range files {
+		if file == nil {
+			continue
+		}
+		realPath, err := filepath.EvalSymlinks(file.path)
+		if err != nil {
+			return nil, false
+		}
+		rel, ok := relativeURLPath(realRoot, realPath)
+		if !ok {
+			return nil, false
+		}
+		if target := filepath.Join(root, filepath.FromSlash(rel)); target != file.path {
+			targets = append(targets, target)
+		}
+	}
+	return targets, true
+}
+
+// the in-memory cache, nil unless ContentCacheSize is set
+func (hs *HttpServer) contents() *contentCache {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.active.ContentCacheSize <= 0 || hs.inShutdown {
+		return nil
+	}
+	if hs.contentCache == nil {
+		hs.contentCache = newContentCache(hs.active.ContentCacheSize, hs.active.ContentCacheMaxFile)
+		hs.watchDocRootsLocked()
+	}
+	return hs.contentCache
+}
+
+// how many requests the in-memory cache has answered, and how many it
+// had to leave to the disk
+func (hs *HttpServer) ContentCacheStats() (hits int64, misses int64) {
+	hs.mu.Lock()
+	cc := hs.contentCache
+	hs.mu.Unlock()
+	if cc == nil {
+		return 0, 0
+	}
+	return cc.hits.Load(), cc.misses.Load()
+}
@@ -0,0 +1,174 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a server for dir with the content cache on
+func newContentCacheServer(t *testing.T, dir string) (*HttpServer, net.Conn) {
+	hs, err := NewHttpdServer("", dir, "../mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.ContentCacheSize = 1024*KB
+	hs.WatchPollInterval = 50 * time.Millisecond
+	addr := serveTest(t, hs, nil)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		hs.Shutdown(ctx) // stops the watcher
+	})
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return hs, conn
+}
+
+func TestContentCacheHitsAndInvalidation(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<p>first</p>"), 0644)
+	hs, conn := newContentCacheServer(t, dir)
+
+	request := "GET / HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"
+	for i := 0; i < 3; i++ {
+		if _, _, body := roundTrip(t, conn, request); body != "<p>first</p>" {
+			t.Fatalf("got %q", body)
+		}
+	}
+	if hits, misses := hs.ContentCacheStats(); hits != 2 || misses != 1 {
+		t.Fatalf("got %d hits and %d misses, want 2 and 1", hits, misses)
+	}
+
+	// the watcher drops the entry once the file changes
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("<p>second</p>"), 0644)
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		_, _, body := roundTrip(t, conn, request)
+		if body == "<p>second</p>" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still serving %q after the file changed", body)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestContentCacheSymlinkTarget(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "real.txt"), []byte("first"), 0644)
+	os.Mkdir(filepath.Join(dir, "real-dir"), 0755)
+	os.WriteFile(filepath.Join(dir, "real-dir", "a.txt"), []byte("first"), 0644)
+	os.Symlink("real.txt", filepath.Join(dir, "link.txt"))
+	os.Symlink("real-dir", filepath.Join(dir, "link-dir"))
+	hs, conn := newContentCacheServer(t, dir)
+
+	paths := []string{"/link.txt", "/link-dir/a.txt"}
+	for _, path := range paths {
+		for i := 0; i < 2; i++ {
+			if _, _, body := roundTrip(t, conn, "GET "+path+" HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"); body != "first" {
+				t.Fatalf("%s: got %q", path, body)
+			}
+		}
+	}
+	if hits, _ := hs.ContentCacheStats(); hits != 2 {
+		t.Fatalf("got %d hits, want 2", hits)
+	}
+
+	// the watcher only sees the targets change
+	os.WriteFile(filepath.Join(dir, "real.txt"), []byte("second"), 0644)
+	os.WriteFile(filepath.Join(dir, "real-dir", "a.txt"), []byte("second"), 0644)
+	deadline := time.Now().Add(3 * time.Second)
+	for _, path := range paths {
+		for {
+			_, _, body := roundTrip(t, conn, "GET "+path+" HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+			if body == "second" {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: still serving %q after its target changed", path, body)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+}
+
+func TestContentCacheGzipVariant(t *testing.T) {
+	dir := t.TempDir()
+	text := strings.Repeat("compress me ", 100)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte(text), 0644)
+	hs, conn := newContentCacheServer(t, dir)
+
+	request := "GET /a.txt HTTP/1.1\r\nHost: 127.0.0.1\r\nAccept-Encoding: gzip\r\n\r\n"
+	roundTrip(t, conn, request)
+	_, headers, body := roundTrip(t, conn, request)
+	if hits, _ := hs.ContentCacheStats(); hits != 1 {
+		t.Fatalf("second request was not a hit")
+	}
+	if headers["Content-Encoding"] != "gzip" || !strings.HasSuffix(headers["ETag"], `-gzip"`) {
+		t.Fatalf("got encoding %q and ETag %q", headers["Content-Encoding"], headers["ETag"])
+	}
+	gr, err := gzip.NewReader(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain, _ := io.ReadAll(gr); string(plain) != text {
+		t.Error("gzip variant doesn't decompress to the file")
+	}
+
+	// conditional requests are answered from the cache too
+	status, _, _ := roundTrip(t, conn, "GET /a.txt HTTP/1.1\r\nHost: 127.0.0.1\r\n"+
+		"Accept-Encoding: gzip\r\nIf-None-Match: "+headers["ETag"]+"\r\nConnection: close\r\n\r\n")
+	if status != "HTTP/1.1 304 Not Modified" {
+		t.Errorf("got %q, want 304", status)
+	}
+}
+
+func TestContentCacheBudget(t *testing.T) {
+	cc := newContentCache(10, 10)
+	for _, key := range []string{"/a", "/b", "/c"} {
+		cc.add(&cachedContent{key: key, path: key, data: bytes.Repeat([]byte("x"), 4)}, 0)
+		cc.get("/a") // keep /a recently used
+	}
+	if cc.get("/a") == nil || cc.get("/c") == nil || cc.get("/b") != nil {
+		t.Error("expected /b to be evicted")
+	}
+	if cc.used != 8 {
+		t.Errorf("used is %d, want 8", cc.used)
+	}
+
+	// a load that raced with an invalidation isn't kept
+	gen := cc.generation()
+	cc.invalidate("/a")
+	cc.add(&cachedContent{key: "/d", path: "/d", data: []byte("x")}, gen)
+	if cc.get("/a") != nil || cc.get("/d") != nil {
+		t.Error("stale entries kept after invalidation")
+	}
+}
+
+func TestContentCacheInvalidatesDirectories(t *testing.T) {
+	c := &cachedContent{key: "/root/dir/", path: "/root/dir/index.html"}
+	for path, want := range map[string]bool{
+		"/root/dir":            true,
+		"/root/dir/index.html": true,
+		"/root":                true,
+		"/root/dir2":           false,
+		"/root/dir/other":      false,
+	} {
+		if got := c.dependsOn(path); got != want {
+			t.Errorf("dependsOn(%q) = %v, want %v", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// the methods Writable adds to the file server, GET and HEAD stay with it
+var davMethods = []string{"PUT", "DELETE", "MKCOL", "PROPFIND", "OPTIONS"}
+
+// the properties PROPFIND reports (RFC 4918 15), in this order
+var davPropNames = []string{"displayname", "resourcetype", "getcontentlength",
+	"getcontenttype", "getetag", "getlastmodified"}
+
+/*
+PUTs to a writable server may be up to MaxUploadSize, but only from a user
+who's logged in, so nobody else can make us buffer that much. The check
+happens before the body is read, the request keeps the user it found.
+*/
+func (hs *HttpServer) bodyLimit(remoteAddr net.Addr, requestHeader *HttpRequestHeader) int64 {
+	if !hs.Writable || requestHeader.verb != "PUT" || hs.MaxUploadSize <= hs.MaxBodySize {
+		return hs.MaxBodySize
+	}
+	if status, _ := hs.authenticate(remoteAddr, requestHeader); status != 0 || requestHeader.user == "" {
+		return hs.MaxBodySize
+	}
+	return hs.MaxUploadSize
+}
+
+/*
+Serves the WebDAV side of the doc roots (RFC 4918 class 1, no locking),
+Start mounts it at "/" when Writable is set. PROPFIND and OPTIONS are
+open to whoever may GET the path, though listing a directory's children
+takes AutoIndex or a login. The methods that change something need a
+user an AuthRule has logged in. LOCK, PROPPATCH, COPY and MOVE aren't
+routed, the mux answers them with a 405.
+*/
+func (hs *HttpServer) DAVHandler() Handler {
+	return HandlerFunc(hs.handleDAV)
+}
+
+func (hs *HttpServer) handleDAV(w *ResponseWriter, requestHeader *HttpRequestHeader) {
+	if requestHeader.verb == "OPTIONS" {
+		headers := w.Headers()
+		headers["DAV"] = "1"
+		headers["MS-Author-Via"] = "DAV" // Windows won't write without it
+		headers["Allow"] = "OPTIONS, GET, HEAD, PUT, DELETE, MKCOL, PROPFIND"
+		headers["Content-Length"] = "0"
+		w.WriteHeader(200)
+		return
+	}
+
+	site := hs.virtualHost(requestHeader)
+	p, err := resolvePath(site.DocRoot, requestHeader.url)
+	if err == nil {
+		err = hs.checkSymlinks(site.DocRoot, p)
+	}
+	if err != nil {
+		hs.debugLog("Refusing path outside the doc root:", requestHeader.url)
+		handleErrorResponse(w, 403)
+		return
+	}
+	if requestHeader.verb == "PROPFIND" {
+		hs.handlePropfind(w, requestHeader, site, p)
+		return
+	}
+
+	// the doc root itself can't be replaced, removed or created
+	if requestHeader.user == "" || p == filepath.Clean(site.DocRoot) {
+		hs.debugLog("Refusing", requestHeader.verb, "of", requestHeader.url, "by", requestHeader.user)
+		handleErrorResponse(w, 403)
+		return
+	}
+
+	status := 500
+	switch requestHeader.verb {
+	case "PUT":
+		status = hs.handlePut(requestHeader, p)
+	case "DELETE":
+		status = hs.handleDelete(p)
+	case "MKCOL":
+		status = hs.handleMkcol(requestHeader, p)
+	}
+	if status >= 300 {
+		handleErrorResponse(w, status)
+		return
+	}
+
+	// don't wait for the watcher, a GET right after has to see the change
+	if contents := hs.contents(); contents != nil {
+		contents.invalidate(p)
+	}
+	hs.debugLog(requestHeader.user, requestHeader.verb, requestHeader.url)
+	w.Headers()["Content-Length"] = "0"
+	w.WriteHeader(status)
+}
+
+// 201 for a new file, 204 for one replaced
+func (hs *HttpServer) handlePut(requestHeader *HttpRequestHeader, p string) int {
+	if int64(len(requestHeader.body)) > hs.MaxUploadSize {
+		return 413
+	}
+	info, err := os.Stat(p)
+	existed := err == nil
+	if strings.HasSuffix(requestHeader.url, "/") || (existed && info.IsDir()) {
+		return 409 // a collection, not something we can write to
+	}
+	if err := writeFileAtomic(p, requestHeader.body); err != nil {
+		hs.debugLog("PUT failed:", err)
+		return davErrorStatus(err)
+	}
+	if existed {
+		return 204
+	}
+	return 201
+}
+
+/*
+Writes data to a temporary file next to p and renames it over p, so anyone
+reading p sees either the old file or the new one, never part of either.
+*/
+func writeFileAtomic(p string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// removes a file, or a directory and everything in it (RFC 4918 9.6.1)
+func (hs *HttpServer) handleDelete(p string) int {
+	if _, err := os.Lstat(p); err != nil {
+		return fileErrorStatus(err)
+	}
+	if err := os.RemoveAll(p); err != nil {
+		hs.debugLog("DELETE failed:", err)
+		return davErrorStatus(err)
+	}
+	return 204
+}
+
+// creates one directory, its parent has to exist already (RFC 4918 9.3.1)
+func (hs *HttpServer) handleMkcol(requestHeader *HttpRequestHeader, p string) int {
+	if len(requestHeader.body) > 0 {
+		return 415 // we don't know any MKCOL bodies
+	}
+	if err := os.Mkdir(p, 0755); err != nil {
+		if os.IsExist(err) {
+			return 405
+		}
+		hs.debugLog("MKCOL failed:", err)
+		return davErrorStatus(err)
+	}
+	return 201
+}
+
+// a missing (or not a directory) parent is a 409 Conflict for WebDAV
+func davErrorStatus(err error) int {
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+		return 409
+	}
+	return fileErrorStatus(err)
+}
+
+// the body of a PROPFIND, nil Prop means all properties
+type propfindRequest struct {
+	PropName	*struct{}	`xml:"DAV: propname"`
+	Prop		*struct {
+		Names []struct {
+			XMLName xml.Name
+		} `xml:",any"`
+	} `xml:"DAV: prop"`
+}
+
+/*
+Lists p, and its children for "Depth: 1", as a 207 multistatus. Depth
+infinity, which is also what a missing Depth means, is refused (RFC 4918
+9.1) since it could walk the whole doc root. A directory's children are
+only listed for clients that could see them with GET (AutoIndex) or that
+logged in, and never the dotfiles, which includes unfinished uploads.
+*/
+func (hs *HttpServer) handlePropfind(w *ResponseWriter, requestHeader *HttpRequestHeader, site *VirtualHost, p string) {
+	depth := requestHeader.Header("Depth")
+	if depth != "0" && depth != "1" {
+		body := xml.Header + `<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`
+		w.Headers()["Content-Type"] = "application/xml; charset=utf-8"
+		w.Headers()["Content-Length"] = strconv.Itoa(len(body))
+		w.WriteHeader(403)
+		w.Write([]byte(body))
+		return
+	}
+
+	var request propfindRequest
+	if len(bytes.TrimSpace(requestHeader.body)) > 0 {
+		if err := xml.Unmarshal(requestHeader.body, &request); err != nil {
+			handleErrorResponse(w, 400)
+			return
+		}
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		handleErrorResponse(w, fileErrorStatus(err))
+		return
+	}
+
+	listing := depth == "1" && info.IsDir()
+	if listing && !site.AutoIndex && requestHeader.user == "" {
+		hs.debugLog("Refusing anonymous PROPFIND listing of", requestHeader.url)
+		handleErrorResponse(w, 403)
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(xml.Header + `<D:multistatus xmlns:D="DAV:">` + "\n")
+	urlPath := path.Clean("/" + requestHeader.url)
+	writePropResponse(&b, &request, site, urlPath, p, info)
+	if listing {
+		children, err := os.ReadDir(p)
+		if err != nil {
+			handleErrorResponse(w, fileErrorStatus(err))
+			return
+		}
+		for _, child := range children {
+			if strings.HasPrefix(child.Name(), ".") {
+				continue
+			}
+			childInfo, err := child.Info()
+			if err != nil { // removed while we were listing
+				continue
+			}
+			writePropResponse(&b, &request, site, path.Join(urlPath, child.Name()),
+				filepath.Join(p, child.Name()), childInfo)
+		}
+	}
+	b.WriteString("</D:multistatus>\n")
+
+	w.Headers()["Content-Type"] = "application/xml; charset=utf-8"
+	w.Headers()["Content-Length"] = strconv.Itoa(b.Len())
+	w.WriteHeader(207)
+	w.Write([]byte(b.String()))
+}
+
+// one <D:response>, the properties we have in a 200 propstat and any others
+// the client asked for in a 404 one
+func writePropResponse(b *strings.Builder, request *propfindRequest, site *VirtualHost, urlPath string, p string, info os.FileInfo) {
+	props := map[string]string{
+		"displayname": xmlEscape(info.Name()),
+		"resourcetype": "",
+		"getlastmodified": info.ModTime().UTC().Format(HttpTimeFormat),
+	}
+	if info.IsDir() {
+		props["resourcetype"] = "<D:collection/>"
+		if urlPath != "/" {
+			urlPath += "/"
+		}
+	} else {
+		props["getcontentlength"] = strconv.FormatInt(info.Size(), 10)
+		props["getcontenttype"] = xmlEscape(site.contentType(p))
+		props["getetag"] = xmlEscape(statETag(info))
+	}
+
+	var found, missing strings.Builder
+	switch {
+	case request.Prop != nil:
+		for _, name := range request.Prop.Names {
+			if value, ok := props[name.XMLName.Local]; ok && name.XMLName.Space == "DAV:" {
+				found.WriteString("<D:" + name.XMLName.Local + ">" + value + "</D:" + name.XMLName.Local + ">")
+			} else if name.XMLName.Space == "" {
+				// a prefix can't be bound to no namespace, it has to go unprefixed
+				missing.WriteString("<" + name.XMLName.Local + ` xmlns=""/>`)
+			} else {
+				missing.WriteString("<R:" + name.XMLName.Local + ` xmlns:R="` + xmlEscape(name.XMLName.Space) + `"/>`)
+			}
+		}
+	default:
+		for _, name := range davPropNames {
+			value, ok := props[name]
+			if !ok {
+				continue
+			}
+			if request.PropName != nil {
+				value = ""
+			}
+			found.WriteString("<D:" + name + ">" + value + "</D:" + name + ">")
+		}
+	}
+
+	href := (&url.URL{Path: urlPath}).EscapedPath()
+	b.WriteString("<D:response><D:href>" + xmlEscape(href) + "</D:href>")
+	if found.Len() > 0 {
+		b.WriteString("<D:propstat><D:prop>" + found.String() + "</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>")
+	}
+	if missing.Len() > 0 {
+		b.WriteString("<D:propstat><D:prop>" + missing.String() + "</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>")
+	}
+	b.WriteString("</D:response>\n")
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
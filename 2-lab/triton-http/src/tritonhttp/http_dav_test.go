@@ -0,0 +1,296 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// a writable server on an empty doc root, alice may write anywhere
+func newDAVServer(t *testing.T) (*HttpServer, string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	hs, err := NewHttpdServer("", dir, "../mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.Writable = true
+	hs.Mux.Handle("/", hs.DAVHandler(), davMethods...)
+
+	rule := NewAuthRule("/", "Uploads")
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	os.WriteFile(htpasswd, []byte(testHtpasswd), 0644)
+	if err := rule.LoadHtpasswd(htpasswd); err != nil {
+		t.Fatal(err)
+	}
+	hs.AuthRules = []*AuthRule{rule}
+	return hs, dir, serveTest(t, hs, nil)
+}
+
+// sends method with body as alice, or anonymously if alice is false
+func davRequest(t *testing.T, addr string, method string, path string, alice bool, extra string, body string) (int, map[string]string, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := method + " " + path + " HTTP/1.1" + CRLF + "Host: localhost" + CRLF + "Connection: close" + CRLF +
+		"Content-Length: " + strconv.Itoa(len(body)) + CRLF + extra
+	if alice {
+		request += "Authorization: " + basicCredentials("alice", "secret") + CRLF
+	}
+	status, headers, responseBody := roundTrip(t, conn, request+CRLF+body)
+	code, _ := strconv.Atoi(strings.Fields(status)[1])
+	return code, headers, responseBody
+}
+
+func TestDAVWrites(t *testing.T) {
+	_, dir, addr := newDAVServer(t)
+
+	steps := []struct {
+		method	string
+		path	string
+		alice	bool
+		body	string
+		status	int
+	}{
+		{"PUT", "/a.txt", false, "hello", 401},
+		{"PUT", "/a.txt", true, "hello", 201},
+		{"GET", "/a.txt", false, "", 401},
+		{"GET", "/a.txt", true, "", 200},
+		{"PUT", "/a.txt", true, "replaced", 204},
+		{"PUT", "/missing/a.txt", true, "x", 409},
+		{"PUT", "/a.txt/b.txt", true, "x", 409},
+		{"MKCOL", "/docs", true, "", 201},
+		{"MKCOL", "/docs", true, "", 405},
+		{"MKCOL", "/missing/docs", true, "", 409},
+		{"MKCOL", "/body", true, "<x/>", 415},
+		{"PUT", "/docs", true, "x", 409},
+		{"PUT", "/docs/", true, "x", 409},
+		{"PUT", "/docs/b%20c.html", true, "<p>b</p>", 201},
+		{"GET", "/docs/b%20c.html", true, "", 200},
+		{"DELETE", "/", true, "", 403},
+		{"DELETE", "/nothing", true, "", 404},
+		{"DELETE", "/docs", true, "", 204},
+		{"GET", "/docs/b%20c.html", true, "", 404},
+		{"DELETE", "/a.txt", false, "", 401},
+	}
+	for _, step := range steps {
+		status, _, body := davRequest(t, addr, step.method, step.path, step.alice, "", step.body)
+		if status != step.status {
+			t.Fatalf("%s %s: got %d, want %d (%s)", step.method, step.path, status, step.status, body)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(data) != "replaced" {
+		t.Errorf("a.txt holds %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "docs")); !os.IsNotExist(err) {
+		t.Errorf("docs still there: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("left behind %v", entries)
+	}
+}
+
+func TestDAVNeedsUser(t *testing.T) {
+	hs, _, addr := newDAVServer(t)
+	hs.AuthRules = []*AuthRule{NewAuthRule("/", "Open")} // nobody logs in
+	if status, _, _ := davRequest(t, addr, "PUT", "/a.txt", false, "", "x"); status != 403 {
+		t.Errorf("anonymous PUT got %d", status)
+	}
+	if status, _, _ := davRequest(t, addr, "OPTIONS", "/", false, "", ""); status != 200 {
+		t.Errorf("OPTIONS got %d", status)
+	}
+}
+
+func TestDAVUploadSize(t *testing.T) {
+	hs, _, addr := newDAVServer(t)
+	hs.MaxBodySize, hs.MaxUploadSize = KB, 64*KB
+
+	big := strings.Repeat("x", 10*KB)
+	if status, _, _ := davRequest(t, addr, "PUT", "/big", false, "", big); status != 413 {
+		t.Errorf("anonymous upload past MaxBodySize got %d", status)
+	}
+	if status, _, _ := davRequest(t, addr, "POST", "/big", true, "", big); status != 413 {
+		t.Errorf("POST past MaxBodySize got %d", status)
+	}
+	if status, _, _ := davRequest(t, addr, "PUT", "/big", true, "", big); status != 201 {
+		t.Errorf("upload got %d", status)
+	}
+	if status, _, _ := davRequest(t, addr, "PUT", "/huge", true, "", strings.Repeat("x", 65*KB)); status != 413 {
+		t.Errorf("upload past MaxUploadSize got %d", status)
+	}
+
+	// over HTTP/2 the limit is picked when the headers arrive
+	request, _ := http.NewRequest("PUT", "http://"+addr+"/h2", bytes.NewReader([]byte(big)))
+	request.SetBasicAuth("alice", "secret")
+	response, err := newH2cClient().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != 201 || response.ProtoMajor != 2 {
+		t.Errorf("HTTP/2 upload got %s %d", response.Proto, response.StatusCode)
+	}
+}
+
+// just enough of a multistatus to check what came back
+type testMultistatus struct {
+	Responses []struct {
+		Href		string	`xml:"href"`
+		Propstats	[]struct {
+			Status		string	`xml:"status"`
+			Collection	*struct{} `xml:"prop>resourcetype>collection"`
+			Length		string	`xml:"prop>getcontentlength"`
+			Type		string	`xml:"prop>getcontenttype"`
+			Unknown		*struct{} `xml:"urn:x prop>color"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+func TestDAVPropfind(t *testing.T) {
+	_, dir, addr := newDAVServer(t)
+	os.Mkdir(filepath.Join(dir, "sub dir"), 0755)
+	os.WriteFile(filepath.Join(dir, "sub dir", "a&b.html"), []byte("hello"), 0644)
+
+	status, headers, body := davRequest(t, addr, "PROPFIND", "/sub%20dir", true, "Depth: 1"+CRLF, "")
+	if status != 207 || !strings.HasPrefix(headers["Content-Type"], "application/xml") {
+		t.Fatalf("got %d %v", status, headers)
+	}
+	var ms testMultistatus
+	if err := xml.Unmarshal([]byte(body), &ms); err != nil {
+		t.Fatalf("%v in %s", err, body)
+	}
+	if len(ms.Responses) != 2 || ms.Responses[0].Href != "/sub%20dir/" || ms.Responses[1].Href != "/sub%20dir/a&b.html" {
+		t.Fatalf("got %s", body)
+	}
+	if dirProps := ms.Responses[0].Propstats[0]; dirProps.Collection == nil || dirProps.Status != "HTTP/1.1 200 OK" {
+		t.Errorf("directory: %+v", dirProps)
+	}
+	if fileProps := ms.Responses[1].Propstats[0]; fileProps.Collection != nil || fileProps.Length != "5" ||
+		fileProps.Type != "text/html" {
+		t.Errorf("file: %+v", fileProps)
+	}
+
+	request := `<?xml version="1.0"?><propfind xmlns="DAV:" xmlns:x="urn:x"><prop><getcontentlength/><x:color/></prop></propfind>`
+	status, _, body = davRequest(t, addr, "PROPFIND", "/sub%20dir/a&b.html", true, "Depth: 0"+CRLF, request)
+	ms = testMultistatus{}
+	if err := xml.Unmarshal([]byte(body), &ms); status != 207 || err != nil || len(ms.Responses) != 1 {
+		t.Fatalf("got %d %v %s", status, err, body)
+	}
+	propstats := ms.Responses[0].Propstats
+	if len(propstats) != 2 || propstats[0].Length != "5" || propstats[1].Unknown == nil ||
+		propstats[1].Status != "HTTP/1.1 404 Not Found" {
+		t.Errorf("got %s", body)
+	}
+
+	request = `<?xml version="1.0"?><D:propfind xmlns:D="DAV:"><D:prop><plain xmlns=""/></D:prop></D:propfind>`
+	status, _, body = davRequest(t, addr, "PROPFIND", "/sub%20dir/a&b.html", true, "Depth: 0"+CRLF, request)
+	if status != 207 || !strings.Contains(body, `<D:prop><plain xmlns=""/></D:prop>`) {
+		t.Errorf("no namespace: got %d %s", status, body)
+	}
+
+	for _, depth := range []string{"", "Depth: infinity" + CRLF} {
+		if status, _, body := davRequest(t, addr, "PROPFIND", "/", true, depth, ""); status != 403 ||
+			!strings.Contains(body, "propfind-finite-depth") {
+			t.Errorf("%q: got %d %s", depth, status, body)
+		}
+	}
+	if status, _, _ := davRequest(t, addr, "PROPFIND", "/", true, "Depth: 0"+CRLF, "<propfind"); status != 400 {
+		t.Errorf("bad XML got %d", status)
+	}
+	if status, _, _ := davRequest(t, addr, "PROPFIND", "/nothing", true, "Depth: 0"+CRLF, ""); status != 404 {
+		t.Errorf("missing got %d", status)
+	}
+}
+
+func TestDAVPropfindListing(t *testing.T) {
+	for _, autoIndex := range []bool{false, true} {
+		dir := t.TempDir()
+		os.Mkdir(filepath.Join(dir, "private"), 0755)
+		for _, sub := range []string{"", "private"} {
+			os.WriteFile(filepath.Join(dir, sub, "a.txt"), []byte("a"), 0644)
+			os.WriteFile(filepath.Join(dir, sub, ".htpasswd"), []byte("x"), 0644)
+			os.WriteFile(filepath.Join(dir, sub, ".upload-123"), []byte("half"), 0644)
+		}
+		hs, err := NewHttpdServer("", dir, "../mime.types")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs.Writable, hs.AutoIndex = true, autoIndex
+		hs.Mux.Handle("/", hs.DAVHandler(), davMethods...)
+		// only /private/ needs a login, so PROPFIND / can be anonymous
+		rule := NewAuthRule("/private/", "Uploads")
+		htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+		os.WriteFile(htpasswd, []byte(testHtpasswd), 0644)
+		rule.LoadHtpasswd(htpasswd)
+		hs.AuthRules = []*AuthRule{rule}
+		addr := serveTest(t, hs, nil)
+
+		status, _, _ := davRequest(t, addr, "PROPFIND", "/", false, "Depth: 1"+CRLF, "")
+		if want := map[bool]int{false: 403, true: 207}[autoIndex]; status != want {
+			t.Errorf("autoindex %v, anonymous: got %d, want %d", autoIndex, status, want)
+		}
+		if status, _, _ := davRequest(t, addr, "PROPFIND", "/", false, "Depth: 0"+CRLF, ""); status != 207 {
+			t.Errorf("autoindex %v, anonymous depth 0: got %d", autoIndex, status)
+		}
+		if status, _, _ := davRequest(t, addr, "PROPFIND", "/a.txt", false, "Depth: 1"+CRLF, ""); status != 207 {
+			t.Errorf("autoindex %v, anonymous on a file: got %d", autoIndex, status)
+		}
+
+		// whoever may list gets neither dotfiles nor unfinished uploads
+		for path, alice := range map[string]bool{"/private/": true, "/": false} {
+			if !alice && !autoIndex {
+				continue
+			}
+			status, _, body := davRequest(t, addr, "PROPFIND", path, alice, "Depth: 1"+CRLF, "")
+			var ms testMultistatus
+			if err := xml.Unmarshal([]byte(body), &ms); status != 207 || err != nil {
+				t.Fatalf("autoindex %v, %s: got %d %v", autoIndex, path, status, err)
+			}
+			var hrefs []string
+			for _, response := range ms.Responses {
+				hrefs = append(hrefs, response.Href)
+			}
+			want := path + " " + path + "a.txt"
+			if path == "/" {
+				want += " /private/"
+			}
+			if strings.Join(hrefs, " ") != want {
+				t.Errorf("autoindex %v, %s: listed %q", autoIndex, path, hrefs)
+			}
+		}
+	}
+}
+
+func TestDAVUnsupportedMethods(t *testing.T) {
+	_, dir, addr := newDAVServer(t)
+	os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644)
+
+	// we're class 1 without locking or PROPPATCH, Finder and Windows
+	// carry on read-only when those get a 405
+	if _, headers, _ := davRequest(t, addr, "OPTIONS", "/a.txt", true, "", ""); headers["DAV"] != "1" {
+		t.Errorf("OPTIONS got DAV %q", headers["DAV"])
+	}
+	bodies := map[string]string{
+		"LOCK":		`<?xml version="1.0"?><D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`,
+		"UNLOCK":	"",
+		"PROPPATCH":	`<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:"><D:set><D:prop><Z:Win32LastModifiedTime xmlns:Z="urn:schemas-microsoft-com:">x</Z:Win32LastModifiedTime></D:prop></D:set></D:propertyupdate>`,
+		"COPY":		"",
+		"MOVE":		"",
+	}
+	for method, body := range bodies {
+		code, headers, _ := davRequest(t, addr, method, "/a.txt", true, "Content-Type: application/xml"+CRLF, body)
+		if code != 405 || !strings.Contains(headers["Allow"], "PROPFIND") || strings.Contains(headers["Allow"], method) {
+			t.Errorf("%s: got %d, Allow %q", method, code, headers["Allow"])
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"os"
+	"strconv"
+)
+
+// what an error page template gets to show, e.g. {{.StatusCode}} {{.Status}}
+type ErrorPageData struct {
+	StatusCode	int
+	Status		string // the reason phrase, e.g. "Not Found"
+	Method		string // "" if the request couldn't be parsed
+	URL		string
+}
+
+// parses the html/template at path as the page for statusCode responses
+func (hs *HttpServer) LoadErrorPage(statusCode int, path string) error {
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		return err
+	}
+	if hs.ErrorPages == nil {
+		hs.ErrorPages = map[int]*template.Template{}
+	}
+	hs.ErrorPages[statusCode] = tmpl
+	return nil
+}
+
+// the configured page for statusCode, nil if there's none or it fails
+func (w *ResponseWriter) errorPage(statusCode int) []byte {
+	if w.server == nil {
+		return nil
+	}
+	tmpl, ok := w.server.ErrorPages[statusCode]
+	if !ok {
+		return nil
+	}
+
+	data := ErrorPageData{StatusCode: statusCode, Status: StatusText(statusCode)}
+	if w.request != nil {
+		data.Method, data.URL = w.request.verb, requestURI(w.request)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		log.Println("Error page for", statusCode, "failed:", err)
+		return nil
+	}
+	return buf.Bytes()
+}
+
+/*
+Maps a failure to stat or open a file to a status
+	1. 404 if it doesn't exist
+	2. 403 if we aren't allowed to read it
+	3. 500 for anything else, e.g. running out of file descriptors
+*/
+func fileErrorStatus(err error) int {
+	if os.IsNotExist(err) {
+		return 404
+	}
+	if os.IsPermission(err) {
+		return 403
+	}
+	return 500
+}
+
+/*
+Sends an error response. The body is the server's page for the status if
+one is configured, otherwise the reason phrase in plain text.
+*/
+func handleErrorResponse(w *ResponseWriter, statusCode int) {
+	body, contentType := w.errorPage(statusCode), "text/html; charset=utf-8"
+	if body == nil {
+		body, contentType = []byte(StatusText(statusCode)), "text/plain"
+	}
+
+	// drop whatever describes the content we were going to send instead
+	headers := w.Headers()
+	for _, key := range []string{"Content-Encoding", "Content-Range", "ETag", "Last-Modified", "Accept-Ranges", "Vary"} {
+		delete(headers, key)
+	}
+	headers["Content-Type"] = contentType
+	headers["Content-Length"] = strconv.Itoa(len(body))
+	w.WriteHeader(statusCode)
+	w.Write(body)
+}
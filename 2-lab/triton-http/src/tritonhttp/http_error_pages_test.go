@@ -0,0 +1,117 @@
+package tritonhttp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestErrorPageTemplate(t *testing.T) {
+	hs := newTestServer(t)
+	page := filepath.Join(t.TempDir(), "404.html")
+	os.WriteFile(page, []byte("<h1>{{.StatusCode}} {{.Status}}</h1><p>{{.Method}} {{.URL}}</p>"), 0644)
+	if err := hs.LoadErrorPage(404, page); err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTest(t, hs, nil)
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	status, headers, body := roundTrip(t, conn, "GET /missing<b>?q=1 HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+	if status != "HTTP/1.1 404 Not Found" || headers["Content-Type"] != "text/html; charset=utf-8" {
+		t.Fatalf("got %q with Content-Type %q", status, headers["Content-Type"])
+	}
+	if want := "<h1>404 Not Found</h1><p>GET /missing&lt;b&gt;?q=1</p>"; body != want {
+		t.Errorf("got %q, want %q", body, want)
+	}
+
+	// statuses without a page keep the plain text body
+	_, headers, body = roundTrip(t, conn, "DELETE /index.html HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+	if headers["Content-Type"] != "text/plain" || body != "Method Not Allowed" {
+		t.Errorf("got %q %q for the 405", headers["Content-Type"], body)
+	}
+}
+
+func TestLoadErrorPageBadTemplate(t *testing.T) {
+	hs := newTestServer(t)
+	page := filepath.Join(t.TempDir(), "500.html")
+	os.WriteFile(page, []byte("{{.Broken"), 0644)
+	if err := hs.LoadErrorPage(500, page); err == nil {
+		t.Error("a broken template was accepted")
+	}
+	if err := hs.LoadErrorPage(500, page+".missing"); err == nil {
+		t.Error("a missing template was accepted")
+	}
+}
+
+func TestForbidden(t *testing.T) {
+	hs := newTestServer(t)
+	addr := serveTest(t, hs, nil)
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	status, _, _ := roundTrip(t, conn, "GET /../src/main/main.go HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+	if status != "HTTP/1.1 403 Forbidden" {
+		t.Errorf("path escape got %q, want 403", status)
+	}
+}
+
+func TestUnreadableFile(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read anything")
+	}
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0000)
+	hs, err := NewHttpdServer("", dir, "../mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTest(t, hs, nil)
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if status, _, _ := roundTrip(t, conn, "GET /secret.txt HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"); status != "HTTP/1.1 403 Forbidden" {
+		t.Errorf("got %q, want 403", status)
+	}
+}
+
+func TestFileErrorStatus(t *testing.T) {
+	_, notExist := os.Stat("/no/such/file")
+	tests := map[error]int{
+		notExist:                   404,
+		os.ErrPermission:           403,
+		errors.New("out of files"): 500,
+	}
+	for err, want := range tests {
+		if got := fileErrorStatus(err); got != want {
+			t.Errorf("fileErrorStatus(%v) = %d, want %d", err, got, want)
+		}
+	}
+}
+
+func TestStatusText(t *testing.T) {
+	for code, want := range map[int]string{403: "Forbidden", 503: "Service Unavailable", 299: ""} {
+		if got := StatusText(code); got != want {
+			t.Errorf("StatusText(%d) = %q, want %q", code, got, want)
+		}
+	}
+	for code := range statusText {
+		if code < 100 || code > 599 || strings.TrimSpace(statusText[code]) == "" {
+			t.Errorf("bad entry for %d", code)
+		}
+	}
+}
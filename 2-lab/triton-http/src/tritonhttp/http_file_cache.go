@@ -0,0 +1,169 @@
+package tritonhttp
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// files kept open unless the config says otherwise
+const DefaultFileCacheSize = 256
+
+// open handles kept per file, concurrent requests for the same file each
+// need their own since sendfile moves the file offset
+const maxIdleHandles = 4
+
+/*
+A file under the doc root, as seen by a single stat. The cache hands out
+open handles for it so a busy file isn't re-opened for every request.
+	1. open() returns an idle handle or opens a new one
+	2. release() rewinds it and keeps it for the next request, or closes
+	   it if the file changed or fell out of the cache meanwhile
+*/
+type cachedFile struct {
+	path	string
+	size	int64
+	modTime	time.Time
+	etag	string
+	isDir	bool
+	info	os.FileInfo // for os.SameFile, a file renamed over this one has its own
+
+	mu	sync.Mutex
+	idle	[]*os.File
+	evicted	bool // no longer in the cache, handles get closed on release
+	elem	*list.Element
+}
+
+// the Last-Modified value for the file
+func (cf *cachedFile) lastModified() string {
+	return cf.modTime.UTC().Format(HttpTimeFormat)
+}
+
+func (cf *cachedFile) open() (*os.File, error) {
+	cf.mu.Lock()
+	if n := len(cf.idle); n > 0 {
+		f := cf.idle[n-1]
+		cf.idle = cf.idle[:n-1]
+		cf.mu.Unlock()
+		return f, nil
+	}
+	cf.mu.Unlock()
+	return os.Open(cf.path)
+}
+
+func (cf *cachedFile) release(f *os.File) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	if cf.evicted || len(cf.idle) >= maxIdleHandles {
+		f.Close()
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return
+	}
+	cf.idle = append(cf.idle, f)
+}
+
+// closes the idle handles, the ones in use are closed on release
+func (cf *cachedFile) evict() {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	cf.evicted = true
+	for _, f := range cf.idle {
+		f.Close()
+	}
+	cf.idle = nil
+}
+
+/*
+A bounded LRU cache of file metadata and open handles, keyed by path.
+Every lookup still stats the path once, an entry whose mtime, size or
+inode has changed since is thrown away and rebuilt. With a size of 0 nothing is kept.
+*/
+type fileCache struct {
+	mu	sync.Mutex
+	max	int
+	entries	map[string]*cachedFile
+	lru	*list.List // most recently used first
+}
+
+func newFileCache(max int) *fileCache {
+	return &fileCache{max: max, entries: map[string]*cachedFile{}, lru: list.New()}
+}
+
+// stats path, the error is the one from os.Stat
+func (fc *fileCache) get(path string) (*cachedFile, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	if cf, ok := fc.entries[path]; ok {
+		if cf.modTime.Equal(fileInfo.ModTime()) && cf.size == fileInfo.Size() && os.SameFile(cf.info, fileInfo) {
+			fc.lru.MoveToFront(cf.elem)
+			return cf, nil
+		}
+		fc.remove(cf)
+	}
+
+	cf := &cachedFile{path: path, size: fileInfo.Size(), modTime: fileInfo.ModTime(),
+		etag: statETag(fileInfo), isDir: fileInfo.IsDir(), info: fileInfo}
+	if fc.max <= 0 {
+		cf.evicted = true
+		return cf, nil
+	}
+	cf.elem = fc.lru.PushFront(cf)
+	fc.entries[path] = cf
+	for fc.lru.Len() > fc.max {
+		fc.remove(fc.lru.Back().Value.(*cachedFile))
+	}
+	return cf, nil
+}
+
+// the caller holds fc.mu
+func (fc *fileCache) remove(cf *cachedFile) {
+	fc.lru.Remove(cf.elem)
+	delete(fc.entries, cf.path)
+	cf.evict()
+}
+
+// closes every idle handle, for a cache that's being replaced
+func (fc *fileCache) clear() {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	for fc.lru.Len() > 0 {
+		fc.remove(fc.lru.Back().Value.(*cachedFile))
+	}
+}
+
+// number of files in the cache
+func (fc *fileCache) len() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.lru.Len()
+}
+
+// strong validator built from size, mtime and inode, so a file replaced by
+// another of the same size within the same second still gets a new tag
+func statETag(fileInfo os.FileInfo) string {
+	return `"` + strconv.FormatInt(fileInfo.Size(), 16) + "-" +
+		strconv.FormatInt(fileInfo.ModTime().UnixNano(), 16) + "-" +
+		strconv.FormatUint(fileInode(fileInfo), 16) + `"`
+}
+
+// the server's file cache, created on first use with FileCacheSize entries
+func (hs *HttpServer) files() *fileCache {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.fileCache == nil {
+		hs.fileCache = newFileCache(hs.active.FileCacheSize)
+	}
+	return hs.fileCache
+}
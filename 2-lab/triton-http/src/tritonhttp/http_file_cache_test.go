@@ -0,0 +1,260 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileCacheInvalidatesOnModTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	os.WriteFile(path, []byte("old"), 0644)
+
+	fc := newFileCache(4)
+	first, err := fc.get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := fc.get(path); again != first {
+		t.Fatal("unchanged file got a new cache entry")
+	}
+
+	os.WriteFile(path, []byte("new"), 0644)
+	later := first.modTime.Add(time.Second)
+	os.Chtimes(path, later, later)
+	second, err := fc.get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first || second.etag == first.etag || !first.evicted {
+		t.Fatal("changed file was served from the stale entry")
+	}
+
+	f, err := second.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.release(f)
+	if data, _ := io.ReadAll(f); string(data) != "new" {
+		t.Errorf("read %q, want new", data)
+	}
+}
+
+func TestFileCacheInvalidatesOnRename(t *testing.T) {
+	dir := t.TempDir()
+	path, next := filepath.Join(dir, "a.txt"), filepath.Join(dir, "a.txt.new")
+	os.WriteFile(path, []byte("old"), 0644)
+
+	fc := newFileCache(4)
+	first, err := fc.get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, _ := first.open()
+	first.release(f) // keeps the handle on the old inode
+
+	// same size and mtime, only the inode tells them apart
+	os.WriteFile(next, []byte("new"), 0644)
+	os.Chtimes(next, first.modTime, first.modTime)
+	if err := os.Rename(next, path); err != nil {
+		t.Fatal(err)
+	}
+	second, err := fc.get(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second == first || !first.evicted {
+		t.Fatal("replaced file was served from the stale entry")
+	}
+	f, err = second.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.release(f)
+	if data, _ := io.ReadAll(f); string(data) != "new" {
+		t.Errorf("read %q, want new", data)
+	}
+}
+
+func TestFileCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	paths := make([]string, 3)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, strconv.Itoa(i))
+		os.WriteFile(paths[i], []byte("x"), 0644)
+	}
+
+	fc := newFileCache(2)
+	a, _ := fc.get(paths[0])
+	fc.get(paths[1])
+	fc.get(paths[0]) // a is now the most recently used
+	fc.get(paths[2])
+
+	if fc.len() != 2 {
+		t.Fatalf("cache holds %d files, want 2", fc.len())
+	}
+	if a.evicted {
+		t.Error("the most recently used file was evicted")
+	}
+	if _, ok := fc.entries[paths[1]]; ok {
+		t.Error("the least recently used file is still cached")
+	}
+}
+
+func TestFileCacheReusesHandles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.txt")
+	os.WriteFile(path, []byte("hello"), 0644)
+
+	fc := newFileCache(4)
+	cf, _ := fc.get(path)
+	f, err := cf.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(f)
+	cf.release(f)
+
+	// the same handle comes back, rewound
+	g, _ := cf.open()
+	if g != f {
+		t.Fatal("released handle was not reused")
+	}
+	if data, _ := io.ReadAll(g); string(data) != "hello" {
+		t.Errorf("read %q from the reused handle, want hello", data)
+	}
+
+	// a second concurrent user gets its own
+	h, _ := cf.open()
+	if h == g {
+		t.Fatal("handle in use was handed out twice")
+	}
+	cf.release(g)
+	cf.release(h)
+}
+
+// a doc root holding a single file of size bytes
+func newLargeFileServer(t testing.TB, size int) (*HttpServer, []byte) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	if err := os.WriteFile(filepath.Join(dir, "large.bin"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	hs, err := NewHttpdServer("", dir, "../mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hs, data
+}
+
+func TestSendFileConcurrentRanges(t *testing.T) {
+	hs, data := newLargeFileServer(t, 1024*KB)
+	addr := serveTest(t, hs, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(start int) {
+			defer wg.Done()
+			conn, err := net.Dial("tcp4", addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			for j := 0; j < 4; j++ {
+				request := fmt.Sprintf("GET /large.bin HTTP/1.1\r\nHost: 127.0.0.1\r\nRange: bytes=%d-%d\r\n\r\n",
+					start, start+99999)
+				status, _, body := roundTrip(t, conn, request)
+				if status != "HTTP/1.1 206 Partial Content" || body != string(data[start:start+100000]) {
+					t.Errorf("range at %d: got %q and %d bytes", start, status, len(body))
+				}
+				_, _, body = roundTrip(t, conn, "GET /large.bin HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+				if body != string(data) {
+					t.Errorf("full file: got %d bytes, want %d", len(body), len(data))
+				}
+			}
+		}(i * 100000)
+	}
+	wg.Wait()
+}
+
+// the file server as it was before the cache, stat per header and an 8KB
+// copy loop, for comparison
+func bufferedFileHandler(path string) HandlerFunc {
+	return func(w *ResponseWriter, r *HttpRequestHeader) {
+		fileInfo, _ := os.Stat(path)
+		w.Headers()["Content-Length"] = strconv.FormatInt(fileInfo.Size(), 10)
+		os.Stat(path) // Last-Modified
+		os.Stat(path) // ETag
+		f, err := os.Open(path)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		w.WriteHeader(200)
+		buffer := make([]byte, 8*KB)
+		for {
+			num, err := f.Read(buffer)
+			if err == io.EOF {
+				break
+			}
+			w.Write(buffer[:num])
+		}
+	}
+}
+
+func benchmarkFileServer(b *testing.B, url string, buffered bool) {
+	hs, data := newLargeFileServer(b, 4096*KB)
+	if buffered {
+		hs.Mux.Handle("/buffered", bufferedFileHandler(filepath.Join(hs.DocRoot, "large.bin")))
+	}
+	sock, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sock.Close()
+	go hs.Serve(sock)
+
+	conn, err := net.Dial("tcp4", sock.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	request := []byte("GET " + url + " HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+	header := make([]byte, 512)
+	body := make([]byte, len(data))
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn.Write(request)
+		// the header is well under 512 bytes, read up to the blank line
+		n := 0
+		for !bytes.Contains(header[:n], []byte(EoR)) {
+			m, err := conn.Read(header[n : n+1])
+			if err != nil {
+				b.Fatal(err)
+			}
+			n += m
+		}
+		if _, err := io.ReadFull(conn, body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSendFile(b *testing.B) {
+	benchmarkFileServer(b, "/large.bin", false)
+}
+
+func BenchmarkBufferedCopy(b *testing.B) {
+	benchmarkFileServer(b, "/buffered", true)
+}
@@ -0,0 +1,208 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// upper bounds of the latency histogram buckets, in seconds
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	method	string
+	code	int
+}
+
+type histogram struct {
+	counts	[]int64 // per bucket, not cumulative
+	sum	float64
+	count	int64
+}
+
+/*
+Counters for the metrics endpoint, updated as each response is finished.
+The connection gauge isn't kept here, it's read off the server's
+connection set when the metrics are scraped.
+*/
+type serverMetrics struct {
+	mu		sync.Mutex
+	requests	map[requestKey]int64
+	latency		map[string]*histogram // by method
+	bytesSent	int64
+	connections	int64 // accepted
+	reused		int64 // requests that weren't the first on their connection
+	badRequests	int64
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{requests: map[requestKey]int64{}, latency: map[string]*histogram{}}
+}
+
+// counts a finished response. requestHeader is nil if the request couldn't
+// be parsed, reused is whether an earlier request came on the same connection
+func (m *serverMetrics) observe(w *ResponseWriter, requestHeader *HttpRequestHeader, start time.Time, reused bool) {
+	if m == nil {
+		return
+	}
+	method := "-"
+	if requestHeader != nil {
+		method = requestHeader.verb
+	}
+	seconds := time.Since(start).Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{method, w.StatusCode()}]++
+	m.bytesSent += w.BytesWritten()
+	if reused {
+		m.reused++
+	}
+
+	h, ok := m.latency[method]
+	if !ok {
+		h = &histogram{counts: make([]int64, len(latencyBuckets))}
+		m.latency[method] = h
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func (m *serverMetrics) connectionAccepted() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.connections++
+	m.mu.Unlock()
+}
+
+func (m *serverMetrics) badRequest() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.badRequests++
+	m.mu.Unlock()
+}
+
+// formats a float the way Prometheus expects
+func promFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeMetricHeader(b *strings.Builder, name string, kind string, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+/*
+Renders everything in the Prometheus text exposition format (version
+0.0.4), labelled series are sorted so the output is stable.
+*/
+func (hs *HttpServer) renderMetrics() string {
+	m := hs.metrics
+	if m == nil { // a server not made by NewHttpdServer
+		m = newServerMetrics()
+	}
+	var b strings.Builder
+
+	hs.mu.Lock()
+	open := len(hs.conns)
+	hs.mu.Unlock()
+	hits, misses := hs.ContentCacheStats()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeMetricHeader(&b, "tritonhttp_requests_total", "counter", "Requests answered, by method and status code.")
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+	for _, key := range keys {
+		fmt.Fprintf(&b, "tritonhttp_requests_total{method=%q,code=\"%d\"} %d\n", key.method, key.code, m.requests[key])
+	}
+
+	writeMetricHeader(&b, "tritonhttp_request_duration_seconds", "histogram", "Time from reading a request to finishing its response.")
+	methods := make([]string, 0, len(m.latency))
+	for method := range m.latency {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		h := m.latency[method]
+		cumulative := int64(0)
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "tritonhttp_request_duration_seconds_bucket{method=%q,le=%q} %d\n", method, promFloat(bound), cumulative)
+		}
+		fmt.Fprintf(&b, "tritonhttp_request_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", method, h.count)
+		fmt.Fprintf(&b, "tritonhttp_request_duration_seconds_sum{method=%q} %s\n", method, promFloat(h.sum))
+		fmt.Fprintf(&b, "tritonhttp_request_duration_seconds_count{method=%q} %d\n", method, h.count)
+	}
+
+	writeMetricHeader(&b, "tritonhttp_response_bytes_total", "counter", "Response body bytes sent.")
+	fmt.Fprintf(&b, "tritonhttp_response_bytes_total %d\n", m.bytesSent)
+	writeMetricHeader(&b, "tritonhttp_open_connections", "gauge", "Client connections currently open.")
+	fmt.Fprintf(&b, "tritonhttp_open_connections %d\n", open)
+	writeMetricHeader(&b, "tritonhttp_connections_total", "counter", "Client connections accepted.")
+	fmt.Fprintf(&b, "tritonhttp_connections_total %d\n", m.connections)
+	writeMetricHeader(&b, "tritonhttp_keepalive_requests_total", "counter", "Requests served on a connection that had already served one.")
+	fmt.Fprintf(&b, "tritonhttp_keepalive_requests_total %d\n", m.reused)
+	writeMetricHeader(&b, "tritonhttp_bad_requests_total", "counter", "Requests rejected as malformed with a 400.")
+	fmt.Fprintf(&b, "tritonhttp_bad_requests_total %d\n", m.badRequests)
+	writeMetricHeader(&b, "tritonhttp_content_cache_hits_total", "counter", "Requests answered from the in-memory content cache.")
+	fmt.Fprintf(&b, "tritonhttp_content_cache_hits_total %d\n", hits)
+	writeMetricHeader(&b, "tritonhttp_content_cache_misses_total", "counter", "Requests the in-memory content cache couldn't answer.")
+	fmt.Fprintf(&b, "tritonhttp_content_cache_misses_total %d\n", misses)
+	return b.String()
+}
+
+// serves the metrics, Start mounts it at MetricsPath
+func (hs *HttpServer) MetricsHandler() Handler {
+	return HandlerFunc(func(w *ResponseWriter, requestHeader *HttpRequestHeader) {
+		body := hs.renderMetrics()
+		w.Headers()["Content-Type"] = "text/plain; version=0.0.4; charset=utf-8"
+		w.Headers()["Content-Length"] = strconv.Itoa(len(body))
+		w.WriteHeader(200)
+		w.Write([]byte(body))
+	})
+}
+
+// a bare server for the admin port, with the metrics at MetricsPath and
+// reloads at ReloadPath
+func newAdminServer(hs *HttpServer) *HttpServer {
+	admin := &HttpServer{
+		ServerPort: hs.MetricsPort,
+		MaxBodySize: DefaultMaxBodySize,
+		MaxHeaderSize: DefaultMaxHeaderSize,
+		IdleTimeout: DefaultIdleTimeout,
+		HeaderTimeout: DefaultHeaderTimeout,
+		ReadTimeout: DefaultReadTimeout,
+		LogLevel: hs.LogLevel,
+		Mux: NewServeMux(),
+	}
+	admin.serverState = &serverState{active: admin}
+	if hs.MetricsPath != "" {
+		admin.Mux.Handle(hs.MetricsPath, hs.MetricsHandler(), "GET")
+	}
+	if hs.ReloadPath != "" {
+		admin.Mux.Handle(hs.ReloadPath, hs.ReloadHandler(), "POST")
+	}
+	return admin
+}
@@ -0,0 +1,78 @@
+package tritonhttp
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	hs := newTestServer(t)
+	hs.Mux.Handle("/metrics", hs.MetricsHandler(), "GET")
+	addr := serveTest(t, hs, nil)
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "GET /index.html HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+	roundTrip(t, conn, "GET /index.html HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+	roundTrip(t, conn, "GET /missing HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+
+	bad, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bad.Close()
+	// the 400's latency runs from the request's first byte
+	bad.Write([]byte("G(ET / HTTP/1.1\r\n"))
+	time.Sleep(60 * time.Millisecond)
+	roundTrip(t, bad, "Host: 127.0.0.1\r\n\r\n")
+	badLatency := func() *histogram {
+		hs.metrics.mu.Lock()
+		defer hs.metrics.mu.Unlock()
+		if hs.metrics.requests[requestKey{"-", 400}] == 0 {
+			return nil
+		}
+		h := *hs.metrics.latency["-"]
+		return &h
+	}
+	// it's counted just after the response goes out
+	deadline := time.Now().Add(3 * time.Second)
+	for badLatency() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the 400 was never counted")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if h := badLatency(); h.sum < 0.05 {
+		t.Errorf("the 400 took %fs, want at least the 60ms the header took", h.sum)
+	}
+
+	_, headers, body := roundTrip(t, conn, "GET /metrics HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+	if !strings.HasPrefix(headers["Content-Type"], "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type is %q", headers["Content-Type"])
+	}
+
+	for _, want := range []string{
+		`tritonhttp_requests_total{method="GET",code="200"} 2`,
+		`tritonhttp_requests_total{method="GET",code="404"} 1`,
+		`tritonhttp_requests_total{method="-",code="400"} 1`,
+		`tritonhttp_request_duration_seconds_bucket{method="GET",le="+Inf"} 3`,
+		`tritonhttp_request_duration_seconds_count{method="GET"} 3`,
+		"tritonhttp_keepalive_requests_total 2",
+		"tritonhttp_bad_requests_total 1",
+		"tritonhttp_connections_total 2",
+		"tritonhttp_open_connections 1",
+		"# TYPE tritonhttp_request_duration_seconds histogram",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("metrics are missing %q", want)
+		}
+	}
+	if strings.Contains(body, "tritonhttp_response_bytes_total 0\n") {
+		t.Error("no response bytes counted")
+	}
+}
@@ -0,0 +1,166 @@
+package tritonhttp
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// policies for HttpServer.SymlinkPolicy, a link is never followed out of
+// the doc root whatever the policy
+const (
+	SymlinksFollow     = "follow" // follow links that stay inside the doc root
+	SymlinksOwnerMatch = "owner"  // and only if the link and target have the same owner
+	SymlinksDeny       = "deny"   // never follow a link
+)
+
+var errBadPath = errors.New("Malformed request path")
+var errPathTraversal = errors.New("Path traversal attempt")
+
+func isHex(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+/*
+Percent-decodes a request path (RFC 3986 2.1). Returns
+	1. errBadPath for a "%" that isn't followed by two hex digits, or a
+	   NUL byte, encoded or not
+	2. errPathTraversal for a ".." segment, encoded or not
+Unlike a query a path has no "+" for space, it's left as is.
+*/
+func decodePath(raw string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(raw); i++ {
+		c := raw[i]
+		if c == '%' {
+			if i+2 >= len(raw) || !isHex(raw[i+1]) || !isHex(raw[i+2]) {
+				return "", errBadPath
+			}
+			c = unhex(raw[i+1])<<4 | unhex(raw[i+2])
+			i += 2
+		}
+		if c == 0 {
+			return "", errBadPath
+		}
+		b.WriteByte(c)
+	}
+
+	decoded := b.String()
+	for _, segment := range strings.Split(decoded, "/") {
+		if segment == ".." {
+			return "", errPathTraversal
+		}
+	}
+	return decoded, nil
+}
+
+// whether p is dir or somewhere below it, both clean and absolute
+func withinDir(dir string, p string) bool {
+	return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, string(filepath.Separator))+string(filepath.Separator))
+}
+
+// maps a decoded url path to the file under root, errPathTraversal if it
+// would end up anywhere else
+func resolvePath(root string, urlPath string) (string, error) {
+	root = filepath.Clean(root)
+	p := filepath.Join(root, filepath.FromSlash(path.Clean("/"+urlPath)))
+	if !withinDir(root, p) {
+		return "", errPathTraversal
+	}
+	return p, nil
+}
+
+// root with its own symlinks resolved, looked up once per configuration
+func (hs *HttpServer) realRoot(root string) (string, error) {
+	if realRoot, ok := hs.realRoots.Load(root); ok {
+		return realRoot.(string), nil
+	}
+	realRoot, err := filepath.EvalSymlinks(filepath.Clean(root))
+	if err != nil {
+		return "", err
+	}
+	hs.realRoots.Store(root, realRoot)
+	return realRoot, nil
+}
+
+// applies hs.SymlinkPolicy to p under root, see checkSymlinks
+func (hs *HttpServer) checkSymlinks(root string, p string) error {
+	realRoot, err := hs.realRoot(root)
+	if err != nil {
+		return err
+	}
+	return checkSymlinks(root, realRoot, p, hs.SymlinkPolicy)
+}
+
+/*
+Applies the symlink policy to p below root, realRoot is root with its own
+links resolved. Returns errPathTraversal for a link the policy doesn't
+allow
+	1. follow only has to know where an existing p ends up, so it's
+	   resolved in one go
+	2. otherwise every component is looked at. one that doesn't exist
+	   ends the check, the caller finds out it's missing. a link out of
+	   the root before it still counts, so whether a file exists out
+	   there can't be told from the answer.
+*/
+func checkSymlinks(root string, realRoot string, p string, policy string) error {
+	if policy != SymlinksDeny && policy != SymlinksOwnerMatch {
+		if target, err := filepath.EvalSymlinks(p); err == nil {
+			if !withinDir(realRoot, target) {
+				return errPathTraversal
+			}
+			return nil
+		}
+	}
+
+	rel, err := filepath.Rel(filepath.Clean(root), p)
+	if err != nil || rel == "." {
+		return err
+	}
+	current := filepath.Clean(root)
+	for _, name := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, name)
+		info, err := os.Lstat(current)
+		if err != nil {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if policy == SymlinksDeny {
+			return errPathTraversal
+		}
+
+		target, err := filepath.EvalSymlinks(current)
+		if err != nil {
+			return nil // dangling, it's just missing
+		}
+		if !withinDir(realRoot, target) {
+			return errPathTraversal
+		}
+		if policy == SymlinksOwnerMatch {
+			targetInfo, err := os.Stat(current)
+			if err != nil {
+				return nil
+			}
+			linkOwner, ok1 := fileOwner(info)
+			targetOwner, ok2 := fileOwner(targetInfo)
+			if !ok1 || !ok2 || linkOwner != targetOwner {
+				return errPathTraversal
+			}
+		}
+	}
+	return nil
+}
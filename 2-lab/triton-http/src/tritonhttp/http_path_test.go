@@ -0,0 +1,291 @@
+package tritonhttp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecodePath(t *testing.T) {
+	tests := []struct {
+		raw	string
+		want	string
+		err	error
+	}{
+		{"/a%20b.txt", "/a b.txt", nil},
+		{"/%E2%9C%93", "/✓", nil},
+		{"/a+b", "/a+b", nil},
+		{"/a%2fb", "/a/b", nil},
+		{"/%", "", errBadPath},
+		{"/%4", "", errBadPath},
+		{"/%zz", "", errBadPath},
+		{"/a%00.html", "", errBadPath},
+		{"/a\x00", "", errBadPath},
+		{"/../etc/passwd", "", errPathTraversal},
+		{"/%2e%2e/etc/passwd", "", errPathTraversal},
+		{"/a/%2E%2E%2Fb", "", errPathTraversal},
+		{"/..", "", errPathTraversal},
+		{"/a..b/...", "/a..b/...", nil},
+	}
+	for _, test := range tests {
+		got, err := decodePath(test.raw)
+		if got != test.want || err != test.err {
+			t.Errorf("decodePath(%q) = %q, %v; want %q, %v", test.raw, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	tests := map[string]string{
+		"/":            "/srv/www",
+		"/a/b.html":    "/srv/www/a/b.html",
+		"//a/./b/":     "/srv/www/a/b",
+		"/a/../../etc": "/srv/www/etc", // cleaned as a url first
+	}
+	for urlPath, want := range tests {
+		if got, err := resolvePath("/srv/www/", urlPath); got != want || err != nil {
+			t.Errorf("resolvePath(%q) = %q, %v; want %q", urlPath, got, err, want)
+		}
+	}
+
+	// a sibling sharing the root's name as a prefix isn't inside it
+	if withinDir("/srv/www", "/srv/www-other/secret") {
+		t.Error("sibling directory counted as inside the root")
+	}
+	if !withinDir("/", "/etc") || !withinDir("/srv/www", "/srv/www") {
+		t.Error("withinDir rejected a path inside the root")
+	}
+}
+
+func TestQueryParams(t *testing.T) {
+	reqHeader, err := makeReqHeader("GET /search%20page?q=a+b&tag=x&tag=y%21 HTTP/1.1\r\nHost: a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqHeader.URL() != "/search page" || reqHeader.RawPath() != "/search%20page" {
+		t.Errorf("got path %q, raw %q", reqHeader.URL(), reqHeader.RawPath())
+	}
+	if reqHeader.QueryParam("q") != "a b" || reqHeader.QueryParam("missing") != "" {
+		t.Errorf("q is %q", reqHeader.QueryParam("q"))
+	}
+	if tags := reqHeader.Query()["tag"]; len(tags) != 2 || tags[1] != "y!" {
+		t.Errorf("tags are %q", tags)
+	}
+	if _, err := makeReqHeader("GET /%2e%2e/x HTTP/1.1\r\nHost: a"); err != errPathTraversal {
+		t.Errorf("encoded .. got %v", err)
+	}
+}
+
+// a doc root with a file, a link to it, and a link out of the root
+func newSymlinkRoot(t *testing.T) (string, string) {
+	base := t.TempDir()
+	root, outside := filepath.Join(base, "root"), filepath.Join(base, "root-other")
+	os.Mkdir(root, 0755)
+	os.Mkdir(outside, 0755)
+	os.WriteFile(filepath.Join(root, "real.txt"), []byte("real"), 0644)
+	os.WriteFile(filepath.Join(outside, "secret.txt"), []byte("secret"), 0644)
+	os.Symlink(filepath.Join(root, "real.txt"), filepath.Join(root, "link.txt"))
+	os.Symlink(outside, filepath.Join(root, "escape"))
+	return root, outside
+}
+
+func TestSymlinkPolicy(t *testing.T) {
+	root, _ := newSymlinkRoot(t)
+	hs := &HttpServer{}
+	tests := []struct {
+		policy	string
+		path	string
+		ok	bool
+	}{
+		{SymlinksFollow, "real.txt", true},
+		{SymlinksFollow, "link.txt", true},
+		{SymlinksFollow, "escape/secret.txt", false},
+		{SymlinksFollow, "missing/file", true}, // left to the 404
+		{SymlinksFollow, "escape/missing", false},
+		{SymlinksOwnerMatch, "link.txt", true},
+		{SymlinksOwnerMatch, "escape/secret.txt", false},
+		{SymlinksDeny, "real.txt", true},
+		{SymlinksDeny, "link.txt", false},
+	}
+	for _, test := range tests {
+		hs.SymlinkPolicy = test.policy
+		err := hs.checkSymlinks(root, filepath.Join(root, test.path))
+		if (err == nil) != test.ok {
+			t.Errorf("%s %s: got %v", test.policy, test.path, err)
+		}
+	}
+
+	// root can hand the link to someone else
+	if os.Geteuid() == 0 {
+		os.Lchown(filepath.Join(root, "link.txt"), 12345, 12345)
+		hs.SymlinkPolicy = SymlinksOwnerMatch
+		if err := hs.checkSymlinks(root, filepath.Join(root, "link.txt")); err == nil {
+			t.Error("followed a link owned by someone else")
+		}
+	}
+}
+
+func TestServeDecodedAndSymlinkedPaths(t *testing.T) {
+	root, _ := newSymlinkRoot(t)
+	os.WriteFile(filepath.Join(root, "a b.txt"), []byte("spaced"), 0644)
+	hs, err := NewHttpdServer("", root, "../mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTest(t, hs, nil)
+
+	tests := map[string]string{
+		"/a%20b.txt":           "HTTP/1.1 200 OK",
+		"/link.txt":            "HTTP/1.1 200 OK",
+		"/escape/secret.txt":   "HTTP/1.1 403 Forbidden",
+		"/%2e%2e/root-other/":  "HTTP/1.1 403 Forbidden",
+		"/..%2froot-other/":    "HTTP/1.1 403 Forbidden",
+		"/real.txt%00.html":    "HTTP/1.1 400 Bad Request",
+		"/../root-other/secret.txt": "HTTP/1.1 403 Forbidden",
+	}
+	for target, want := range tests {
+		conn, err := net.Dial("tcp4", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, _, body := roundTrip(t, conn, "GET "+target+" HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+		conn.Close()
+		if status != want || strings.Contains(body, "secret") {
+			t.Errorf("%s: got %q %q, want %q", target, status, body, want)
+		}
+	}
+}
+
+func TestDirectoryRedirectKeepsQuery(t *testing.T) {
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "sub dir"), 0755)
+	hs, err := NewHttpdServer("", root, "../mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTest(t, hs, nil)
+
+	tests := map[string]string{
+		"/sub%20dir":			"/sub%20dir/",
+		"/sub%20dir?":			"/sub%20dir/",
+		"/sub%20dir?page=2&q=a%20b":	"/sub%20dir/?page=2&q=a%20b",
+	}
+	for target, want := range tests {
+		conn, err := net.Dial("tcp4", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, headers, _ := roundTrip(t, conn, "GET "+target+" HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n")
+		conn.Close()
+		if status != "HTTP/1.1 301 Moved Permanently" || headers["Location"] != want {
+			t.Errorf("%s: got %q to %q, want %q", target, status, headers["Location"], want)
+		}
+	}
+}
+
+// a .gz sibling is a file like any other as far as the policy goes
+func TestPrecompressedSiblingSymlink(t *testing.T) {
+	root, outside := newSymlinkRoot(t)
+	os.WriteFile(filepath.Join(root, "page.html"), []byte("plain"), 0644)
+	os.WriteFile(filepath.Join(root, "page2.html"), []byte("plain"), 0644)
+	os.WriteFile(filepath.Join(root, "real.html.gz"), []byte("not really gzip"), 0644)
+	os.WriteFile(filepath.Join(outside, "secret.gz"), []byte("secret"), 0644)
+	os.Symlink(filepath.Join(outside, "secret.gz"), filepath.Join(root, "page.html.gz"))
+	os.Symlink(filepath.Join(root, "real.html.gz"), filepath.Join(root, "page2.html.gz"))
+
+	for _, policy := range []string{SymlinksFollow, SymlinksDeny} {
+		for _, cacheSize := range []int64{0, 1024*KB} {
+			hs, err := NewHttpdServer("", root, "../mime.types")
+			if err != nil {
+				t.Fatal(err)
+			}
+			hs.SymlinkPolicy, hs.ContentCacheSize = policy, cacheSize
+			addr := serveTest(t, hs, nil)
+
+			get := func(path string) (map[string]string, string) {
+				conn, err := net.Dial("tcp4", addr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				_, headers, body := roundTrip(t, conn, "GET "+path+" HTTP/1.1\r\nHost: a\r\n"+
+					"Accept-Encoding: gzip\r\nConnection: close\r\n\r\n")
+				return headers, body
+			}
+			for i := 0; i < 2; i++ { // the second one may come from the cache
+				if headers, body := get("/page.html"); strings.Contains(body, "secret") {
+					t.Errorf("%s, cache %d: sent the sibling outside the root %v", policy, cacheSize, headers)
+				}
+				// a link inside the root is up to the policy
+				_, body := get("/page2.html")
+				if sent := body == "not really gzip"; sent != (policy == SymlinksFollow) {
+					t.Errorf("%s, cache %d: got %q", policy, cacheSize, body)
+				}
+			}
+		}
+	}
+}
+
+// whatever the client sends, an accepted path resolves inside the root
+func FuzzPathTraversal(f *testing.F) {
+	for _, seed := range []string{"/index.html", "/../etc/passwd", "/%2e%2e/%2e%2e/etc/passwd",
+		"/a/..%2f..%2fb", "/%00", "/.%2e/", "//..//", "/a/b/../../../c", "/%c0%ae%c0%ae/",
+		"/../www-other/index.html", "/..%2fwww-other/index.html"} {
+		f.Add(seed)
+	}
+	// a real root with a sibling whose name starts like it, so a prefix
+	// check on the string alone isn't enough
+	base := f.TempDir()
+	root := filepath.Join(base, "www")
+	os.Mkdir(root, 0755)
+	os.Mkdir(filepath.Join(base, "www-other"), 0755)
+	os.WriteFile(filepath.Join(root, "index.html"), []byte("public"), 0644)
+	os.WriteFile(filepath.Join(base, "www-other", "index.html"), []byte("secret"), 0644)
+	os.WriteFile(filepath.Join(base, "index.html"), []byte("secret"), 0644)
+	f.Fuzz(func(t *testing.T, target string) {
+		if strings.ContainsAny(target, " \r\n") || !strings.HasPrefix(target, "/") {
+			return // not a single request-line token
+		}
+		reqHeader, err := makeReqHeader("GET " + target + " HTTP/1.1\r\nHost: a")
+		if err != nil {
+			return
+		}
+		if strings.Contains(reqHeader.URL(), "\x00") {
+			t.Fatalf("%q decoded to a path with a NUL", target)
+		}
+		for _, segment := range strings.Split(reqHeader.URL(), "/") {
+			if segment == ".." {
+				t.Fatalf("%q decoded to a path with ..", target)
+			}
+		}
+		p, err := resolvePath(root, reqHeader.URL())
+		if err != nil {
+			return
+		}
+		// checked without withinDir, which resolvePath relies on
+		rel, err := filepath.Rel(root, p)
+		if err != nil || filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			t.Fatalf("%q resolved to %q outside the root", target, p)
+		}
+		if data, err := os.ReadFile(p); err == nil && string(data) == "secret" {
+			t.Fatalf("%q resolved to %q, a file outside the root", target, p)
+		}
+	})
+}
+
+func FuzzDecodePath(f *testing.F) {
+	for _, seed := range []string{"/a%20b", "/%", "/%%", "/%2e%2E", "/%ff%00"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, raw string) {
+		decoded, err := decodePath(raw)
+		if err != nil {
+			return
+		}
+		if strings.Contains(decoded, "\x00") || len(decoded) > len(raw) {
+			t.Fatalf("decodePath(%q) = %q", raw, decoded)
+		}
+	})
+}
@@ -0,0 +1,417 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// load balancing strategies for ProxyHandler.Balance
+const (
+	BalanceRoundRobin = "round_robin"
+	BalanceLeastConn  = "least_conn"
+)
+
+// headers that only describe a single connection, a proxy never passes
+// them on (RFC 7230 6.1)
+var hopByHopHeaders = []string{"Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Proxy-Connection", "TE", "Trailer", "Transfer-Encoding", "Upgrade"}
+
+// one backend server of a ProxyHandler
+type upstream struct {
+	addr		string
+	active		int64 // requests in flight, updated atomically
+
+	// passive health checking, guarded by the handler's mu
+	failures	int
+	downUntil	time.Time
+}
+
+/*
+ProxyHandler forwards requests to a pool of upstream servers and streams
+their responses back. Upstreams are health checked passively: MaxFails
+failures in a row (refused connections, timeouts, garbage responses) take
+one out of rotation for FailTimeout. If every upstream is down they're all
+tried anyway, it's better than failing every request until the timeout ends.
+*/
+type ProxyHandler struct {
+	Prefix		string        // the path prefix this handler is mounted on
+	StripPrefix	bool          // forward "/api/x" as "/x" for prefix "/api"
+	Balance		string        // BalanceRoundRobin (default) or BalanceLeastConn
+	MaxFails	int
+	FailTimeout	time.Duration
+	Timeout		time.Duration // for connecting and for each read from upstream
+
+	mu		sync.Mutex
+	upstreams	[]*upstream
+	next		int // round robin position
+}
+
+func NewProxyHandler(prefix string, targets []string, balance string) (*ProxyHandler, error) {
+	if balance == "" {
+		balance = BalanceRoundRobin
+	}
+	if balance != BalanceRoundRobin && balance != BalanceLeastConn {
+		return nil, errors.New("Unknown balance strategy: " + balance)
+	}
+
+	p := &ProxyHandler{Prefix: prefix, Balance: balance, MaxFails: 3,
+		FailTimeout: 10 * time.Second, Timeout: 30 * time.Second}
+	for _, target := range targets {
+		target = strings.TrimSpace(target)
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			return nil, errors.New("Upstream must be host:port, got " + target)
+		}
+		p.upstreams = append(p.upstreams, &upstream{addr: target})
+	}
+	if len(p.upstreams) == 0 {
+		return nil, errors.New("No upstreams for " + prefix)
+	}
+	return p, nil
+}
+
+func (p *ProxyHandler) ServeHTTP(w *ResponseWriter, requestHeader *HttpRequestHeader) {
+	request := p.upstreamRequest(w, requestHeader)
+
+	// a request nobody received can safely go to the next upstream, so
+	// only connection failures are retried
+	var conn net.Conn
+	var up *upstream
+	tried := map[*upstream]bool{}
+	for len(tried) < len(p.upstreams) {
+		up = p.pick(tried)
+		tried[up] = true
+
+		var err error
+		conn, err = net.DialTimeout("tcp", up.addr, p.Timeout)
+		if err == nil {
+			break
+		}
+		log.Println("Proxy: can't reach", up.addr+":", err)
+		p.markFailed(up)
+		conn = nil
+	}
+	if conn == nil {
+		handleErrorResponse(w, 502)
+		return
+	}
+	defer conn.Close()
+
+	atomic.AddInt64(&up.active, 1)
+	defer atomic.AddInt64(&up.active, -1)
+
+	conn.SetDeadline(time.Now().Add(p.Timeout))
+	if _, err := conn.Write(request); err != nil {
+		p.fail(w, up, err)
+		return
+	}
+
+	reader := bufio.NewReader(&deadlineReader{conn: conn, timeout: p.Timeout})
+	statusCode, headers, err := readUpstreamHeader(reader)
+	if err != nil {
+		p.fail(w, up, err)
+		return
+	}
+	p.markHealthy(up)
+
+	// the body's framing is decided before the headers are copied, so
+	// a chunked upstream body loses its length and gets re-chunked by w
+	body, err := upstreamBody(reader, headers, statusCode, requestHeader.verb)
+	if err != nil {
+		p.fail(w, up, err)
+		return
+	}
+	for key, value := range headers {
+		w.Headers()[key] = value
+	}
+	w.Headers()["Via"] = appendHeader(headers["Via"], "1.1 TritonHTTP")
+
+	w.WriteHeader(statusCode)
+	if body != nil {
+		_, err := io.Copy(w, body)
+		if lr, ok := body.(*io.LimitedReader); ok && err == nil && lr.N > 0 {
+			err = io.ErrUnexpectedEOF // the upstream closed short of its Content-Length
+		}
+		if err != nil {
+			// the client already has the status line, all we can do is
+			// cut the connection so it knows the body is incomplete
+			log.Println("Proxy: error streaming from", up.addr+":", err)
+			w.abort()
+		}
+	}
+}
+
+// reports a failed exchange, as a 504 for timeouts and 502 otherwise
+func (p *ProxyHandler) fail(w *ResponseWriter, up *upstream, err error) {
+	log.Println("Proxy: error talking to", up.addr+":", err)
+	p.markFailed(up)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		handleErrorResponse(w, 504)
+	} else {
+		handleErrorResponse(w, 502)
+	}
+}
+
+// builds the request line and headers we send upstream
+func (p *ProxyHandler) upstreamRequest(w *ResponseWriter, requestHeader *HttpRequestHeader) []byte {
+	target := requestURI(requestHeader)
+	if p.StripPrefix {
+		target = "/" + strings.TrimPrefix(strings.TrimPrefix(target, strings.TrimSuffix(p.Prefix, "/")), "/")
+	}
+
+	headers := map[string]string{}
+	for key, value := range requestHeader.headers {
+		headers[key] = value
+	}
+	removeHopByHop(headers)
+
+	clientIP, _, _ := net.SplitHostPort(w.conn.RemoteAddr().String())
+	proto := "http"
+	if _, ok := w.conn.(*tls.Conn); ok {
+		proto = "https"
+	}
+	headers["X-Forwarded-For"] = appendHeader(headers["X-Forwarded-For"], clientIP)
+	headers["X-Forwarded-Proto"] = proto
+	headers["X-Forwarded-Host"] = requestHeader.headers["Host"]
+	headers["Via"] = appendHeader(headers["Via"], "1.1 TritonHTTP")
+	// one request per upstream connection keeps the framing simple
+	headers["Connection"] = "close"
+	if requestHeader.body != nil {
+		headers["Content-Length"] = strconv.Itoa(len(requestHeader.body))
+	}
+
+	var b strings.Builder
+	b.WriteString(requestHeader.verb + " " + target + " HTTP/1.1" + CRLF)
+	for key, value := range headers {
+		b.WriteString(key + ": " + value + CRLF)
+	}
+	b.WriteString(CRLF)
+	return append([]byte(b.String()), requestHeader.body...)
+}
+
+// chooses an upstream not yet tried for this request
+func (p *ProxyHandler) pick(tried map[*upstream]bool) *upstream {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	candidates := []*upstream{}
+	for _, up := range p.upstreams {
+		if !tried[up] && now.After(up.downUntil) {
+			candidates = append(candidates, up)
+		}
+	}
+	if len(candidates) == 0 { // everyone is down, try them anyway
+		for _, up := range p.upstreams {
+			if !tried[up] {
+				candidates = append(candidates, up)
+			}
+		}
+	}
+
+	if p.Balance == BalanceLeastConn {
+		best := candidates[0]
+		for _, up := range candidates[1:] {
+			if atomic.LoadInt64(&up.active) < atomic.LoadInt64(&best.active) {
+				best = up
+			}
+		}
+		return best
+	}
+
+	p.next++
+	return candidates[p.next%len(candidates)]
+}
+
+func (p *ProxyHandler) markFailed(up *upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	up.failures++
+	if up.failures >= p.MaxFails {
+		log.Println("Proxy: marking", up.addr, "down for", p.FailTimeout)
+		up.downUntil = time.Now().Add(p.FailTimeout)
+		up.failures = 0
+	}
+}
+
+func (p *ProxyHandler) markHealthy(up *upstream) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	up.failures = 0
+	up.downUntil = time.Time{}
+}
+
+// drops the hop-by-hop headers, including any the Connection header names
+func removeHopByHop(headers map[string]string) {
+	for _, name := range strings.Split(headers["Connection"], ",") {
+		delete(headers, textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)))
+	}
+	for _, name := range hopByHopHeaders {
+		delete(headers, textproto.CanonicalMIMEHeaderKey(name))
+	}
+}
+
+func appendHeader(existing string, value string) string {
+	if existing == "" {
+		return value
+	}
+	return existing + ", " + value
+}
+
+// parses the upstream's status line and headers. repeated headers are
+// joined the way headerToString expects.
+func readUpstreamHeader(reader *bufio.Reader) (int, map[string]string, error) {
+	statusLine, err := readCRLFLine(reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	fields := strings.SplitN(statusLine, " ", 3)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "HTTP/1.") {
+		return 0, nil, errors.New("Bad status line from upstream: " + statusLine)
+	}
+	statusCode, err := strconv.Atoi(fields[1])
+	if err != nil || statusCode < 100 || statusCode > 999 {
+		return 0, nil, errors.New("Bad status code from upstream: " + fields[1])
+	}
+
+	headers := map[string]string{}
+	for {
+		line, err := readCRLFLine(reader)
+		if err != nil {
+			return 0, nil, err
+		}
+		if line == "" {
+			break
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return 0, nil, errors.New("Bad header from upstream: " + line)
+		}
+		key, value := textproto.CanonicalMIMEHeaderKey(line[:i]), strings.TrimSpace(line[i+1:])
+		if existing, ok := headers[key]; ok {
+			sep := ", "
+			if key == "Set-Cookie" { // can't be comma joined
+				sep = "\n"
+			}
+			value = existing + sep + value
+		}
+		headers[key] = value
+	}
+
+	// interim responses (100 Continue, 102 Processing, 103 Early Hints) are
+	// followed by the real one. a 101 is final, the connection switched.
+	if statusCode < 200 && statusCode != 101 {
+		return readUpstreamHeader(reader)
+	}
+
+	isChunked := strings.ToLower(headers["Transfer-Encoding"]) == "chunked"
+	removeHopByHop(headers)
+	if isChunked {
+		headers["Transfer-Encoding"] = "chunked"
+	}
+	return statusCode, headers, nil
+}
+
+/*
+Returns a reader for the upstream's response body (RFC 7230 3.3.3)
+	1. nil for HEAD requests and 1xx/204/304 responses
+	2. a dechunking reader for Transfer-Encoding: chunked
+	3. exactly Content-Length bytes
+	4. otherwise everything until the upstream closes the connection
+The Transfer-Encoding header is consumed here, we send our own framing.
+*/
+func upstreamBody(reader *bufio.Reader, headers map[string]string, statusCode int, verb string) (io.Reader, error) {
+	chunked := headers["Transfer-Encoding"] == "chunked"
+	delete(headers, "Transfer-Encoding")
+
+	if verb == "HEAD" || !bodyAllowed(statusCode) {
+		return nil, nil
+	}
+	if chunked {
+		delete(headers, "Content-Length")
+		return &chunkedReader{r: reader}, nil
+	}
+	if cl, ok := headers["Content-Length"]; ok {
+		length, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || length < 0 {
+			return nil, errors.New("Bad Content-Length from upstream: " + cl)
+		}
+		return io.LimitReader(reader, length), nil
+	}
+	return reader, nil
+}
+
+func readCRLFLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, CRLF), nil
+}
+
+// decodes a chunked body as it arrives, trailers are skipped
+type chunkedReader struct {
+	r		*bufio.Reader
+	remaining	int64 // bytes left in the current chunk
+	done		bool
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.done {
+		return 0, io.EOF
+	}
+	if cr.remaining == 0 {
+		line, err := readCRLFLine(cr.r)
+		if err != nil {
+			return 0, err
+		}
+		if i := strings.Index(line, ";"); i >= 0 {
+			line = line[:i]
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+		if err != nil || size < 0 {
+			return 0, errors.New("Invalid chunk size: " + line)
+		}
+		if size == 0 {
+			for { // trailers end with an empty line
+				if line, err = readCRLFLine(cr.r); err != nil || line == "" {
+					break
+				}
+			}
+			cr.done = true
+			return 0, io.EOF
+		}
+		cr.remaining = size
+	}
+
+	if int64(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+	n, err := cr.r.Read(p)
+	cr.remaining -= int64(n)
+	if cr.remaining == 0 && err == nil {
+		_, err = readCRLFLine(cr.r) // the CRLF after the chunk data
+	}
+	return n, err
+}
+
+// extends the read deadline before every read, so a slow but steady
+// upstream isn't cut off while an idle one is
+type deadlineReader struct {
+	conn	net.Conn
+	timeout	time.Duration
+}
+
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	dr.conn.SetReadDeadline(time.Now().Add(dr.timeout))
+	return dr.conn.Read(p)
+}
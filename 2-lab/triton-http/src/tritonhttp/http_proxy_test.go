@@ -0,0 +1,181 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a backend that echoes what it received and answers with its name
+func newTestBackend(t *testing.T, name string) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Backend", name)
+		w.Header().Set("Keep-Alive", "timeout=5") // hop-by-hop, must not reach the client
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		fmt.Fprintf(w, "%s %s xff=%s via=%s", name, r.URL.RequestURI(),
+			r.Header.Get("X-Forwarded-For"), r.Header.Get("Via"))
+		w.(http.Flusher).Flush() // no Content-Length, so the body arrives chunked
+	}))
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+func dechunk(body string) string {
+	var b strings.Builder
+	for {
+		var size int
+		i := strings.Index(body, CRLF)
+		fmt.Sscanf(body[:i], "%x", &size)
+		if size == 0 {
+			return b.String()
+		}
+		b.WriteString(body[i+2 : i+2+size])
+		body = body[i+2+size+2:]
+	}
+}
+
+func proxyGet(t *testing.T, addr string, request string) (string, map[string]string, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return roundTrip(t, conn, request)
+}
+
+func TestProxyRoundRobin(t *testing.T) {
+	a, b := newTestBackend(t, "a"), newTestBackend(t, "b")
+	proxy, err := NewProxyHandler("/api", []string{a.Listener.Addr().String(),
+		b.Listener.Addr().String()}, BalanceRoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.StripPrefix = true
+
+	hs := newTestServer(t)
+	hs.Mux.Handle("/api", proxy)
+	addr := serveTest(t, hs, nil)
+
+	seen := map[string]int{}
+	for i := 0; i < 4; i++ {
+		status, headers, body := proxyGet(t, addr,
+			"GET /api/items?x=1 HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n\r\n")
+		if status != "HTTP/1.1 200 OK" {
+			t.Fatalf("got %q", status)
+		}
+		if _, ok := headers["Keep-Alive"]; ok {
+			t.Fatal("hop-by-hop header Keep-Alive was forwarded")
+		}
+		if headers["Via"] != "1.1 TritonHTTP" {
+			t.Fatalf("got Via %q", headers["Via"])
+		}
+		body = dechunk(body)
+		want := headers["X-Backend"] + " /items?x=1 xff=127.0.0.1 via=1.1 TritonHTTP"
+		if body != want {
+			t.Fatalf("got body %q, want %q", body, want)
+		}
+		seen[headers["X-Backend"]]++
+	}
+	if seen["a"] != 2 || seen["b"] != 2 {
+		t.Fatalf("requests not spread evenly: %v", seen)
+	}
+}
+
+func TestProxyPassiveHealthCheck(t *testing.T) {
+	a := newTestBackend(t, "a")
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadAddr := dead.Listener.Addr().String()
+	dead.Close()
+
+	proxy, err := NewProxyHandler("/api", []string{deadAddr, a.Listener.Addr().String()}, BalanceLeastConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.MaxFails = 1
+
+	hs := newTestServer(t)
+	hs.Mux.Handle("/api", proxy)
+	addr := serveTest(t, hs, nil)
+
+	for i := 0; i < 3; i++ {
+		status, headers, _ := proxyGet(t, addr, "GET /api HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n\r\n")
+		if status != "HTTP/1.1 200 OK" || headers["X-Backend"] != "a" {
+			t.Fatalf("request %d got %q from %q", i, status, headers["X-Backend"])
+		}
+	}
+	if proxy.upstreams[0].downUntil.IsZero() {
+		t.Fatal("dead upstream was not marked down")
+	}
+
+	a.Close()
+	status, _, _ := proxyGet(t, addr, "GET /api HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n\r\n")
+	if status != "HTTP/1.1 502 Bad Gateway" {
+		t.Fatalf("got %q with every upstream down", status)
+	}
+}
+
+func TestProxyShortBody(t *testing.T) {
+	upstream, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	go func() {
+		conn, err := upstream.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		http.ReadRequest(bufio.NewReader(conn))
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nshort"))
+	}()
+
+	proxy, err := NewProxyHandler("/api", []string{upstream.Addr().String()}, BalanceRoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := newTestServer(t)
+	hs.Mux.Handle("/api", proxy)
+	addr := serveTest(t, hs, nil)
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	conn.Write([]byte("GET /api HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	// the client can only tell it's incomplete if the connection closes
+	response, err := io.ReadAll(conn)
+	if err != nil || !strings.HasSuffix(string(response), "\r\n\r\nshort") {
+		t.Errorf("got %q, %v", response, err)
+	}
+}
+
+func TestReadUpstreamHeaderInterim(t *testing.T) {
+	cases := map[string]int{
+		"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 200 OK\r\n\r\n":				200,
+		"HTTP/1.1 102 Processing\r\n\r\nHTTP/1.1 201 Created\r\n\r\n":			201,
+		"HTTP/1.1 103 Early Hints\r\nLink: </a.css>\r\n\r\nHTTP/1.1 200 OK\r\n\r\n":	200,
+		"HTTP/1.1 100 Continue\r\n\r\nHTTP/1.1 103 Early Hints\r\n\r\nHTTP/1.1 404 Not Found\r\n\r\n": 404,
+		"HTTP/1.1 101 Switching Protocols\r\n\r\nHTTP/1.1 200 OK\r\n\r\n":		101,
+	}
+	for response, want := range cases {
+		statusCode, headers, err := readUpstreamHeader(bufio.NewReader(strings.NewReader(response)))
+		if err != nil || statusCode != want {
+			t.Errorf("%q: got %d %v, want %d", response, statusCode, err, want)
+		}
+		if headers["Link"] != "" {
+			t.Errorf("%q: kept the interim response's headers %v", response, headers)
+		}
+	}
+}
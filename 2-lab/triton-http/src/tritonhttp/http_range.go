@@ -0,0 +1,198 @@
+package tritonhttp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// a single satisfiable range of the file, in absolute offsets
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return "bytes " + strconv.FormatInt(r.start, 10) + "-" +
+		strconv.FormatInt(r.start+r.length-1, 10) + "/" + strconv.FormatInt(size, 10)
+}
+
+// a Range header we don't understand is ignored and the whole file is sent
+var errInvalidRange = errors.New("Invalid range")
+
+// a well-formed Range header where no range overlaps the file gets a 416
+var errUnsatisfiableRange = errors.New("Range not satisfiable")
+
+// upper bound on ranges in one request, so a client can't make us emit a
+// multipart body many times the size of the file
+const maxRanges = 32
+
+/*
+Parses "bytes=0-99,200-,-50" (RFC 7233 2.1) against a file of the given size.
+Each range is one of
+	1. first-last, last clamped to the end of the file
+	2. first-, everything from first onwards
+	3. -suffix, the final suffix bytes
+Ranges starting past the end are dropped; if none remain the whole set is
+unsatisfiable.
+*/
+func parseRange(header string, size int64) ([]byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, errInvalidRange
+	}
+
+	specs := strings.Split(header[len(prefix):], ",")
+	if len(specs) > maxRanges {
+		return nil, errInvalidRange
+	}
+
+	ranges := []byteRange{}
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		i := strings.Index(spec, "-")
+		if i < 0 {
+			return nil, errInvalidRange
+		}
+		first, last := spec[:i], spec[i+1:]
+
+		var r byteRange
+		if first == "" {
+			suffix, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || suffix < 0 {
+				return nil, errInvalidRange
+			}
+			if suffix == 0 {
+				continue
+			}
+			if suffix > size {
+				suffix = size
+			}
+			r = byteRange{start: size - suffix, length: suffix}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errInvalidRange
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	return ranges, nil
+}
+
+// If-Range lets the client say "only send the range if it's still this
+// version", otherwise we send the full file. an ETag must match strongly, a
+// date must be exactly our Last-Modified.
+func ifRangeMatch(requestHeader *HttpRequestHeader, etag string, lastModified string) bool {
+	ifRange, ok := requestHeader.headers["If-Range"]
+	if !ok {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, "W/") {
+		return etagListMatch(ifRange, etag, true)
+	}
+	return ifRange == lastModified
+}
+
+func (hs *HttpServer) handleRangeRequest(w *ResponseWriter, file *cachedFile, rangeHeader string) {
+	size := file.size
+	ranges, err := parseRange(rangeHeader, size)
+	if err == errInvalidRange {
+		hs.sendResponse(w, file)
+		return
+	}
+
+	headers := w.Headers()
+	if err == errUnsatisfiableRange {
+		headers["Content-Range"] = "bytes */" + strconv.FormatInt(size, 10)
+		headers["Content-Length"] = "0"
+		delete(headers, "Content-Type")
+		w.WriteHeader(416)
+		return
+	}
+
+	f, err := file.open()
+	if err != nil {
+		log.Println(err)
+		handleErrorResponse(w, fileErrorStatus(err))
+		return
+	}
+	defer file.release(f)
+
+	if len(ranges) == 1 {
+		headers["Content-Range"] = ranges[0].contentRange(size)
+		headers["Content-Length"] = strconv.FormatInt(ranges[0].length, 10)
+		w.WriteHeader(206)
+		copyFileRange(w, f, ranges[0])
+		return
+	}
+
+	// multiple ranges go out as multipart/byteranges, each part carrying
+	// its own Content-Type and Content-Range
+	boundary := multipartBoundary()
+	partHeaders := make([]string, len(ranges))
+	length := int64(0)
+	for i, r := range ranges {
+		partHeaders[i] = CRLF + "--" + boundary + CRLF +
+			"Content-Type: " + headers["Content-Type"] + CRLF +
+			"Content-Range: " + r.contentRange(size) + CRLF + CRLF
+		length += int64(len(partHeaders[i])) + r.length
+	}
+	closing := CRLF + "--" + boundary + "--" + CRLF
+	length += int64(len(closing))
+
+	headers["Content-Type"] = "multipart/byteranges; boundary=" + boundary
+	headers["Content-Length"] = strconv.FormatInt(length, 10)
+	w.WriteHeader(206)
+	for i, r := range ranges {
+		if _, err := w.Write([]byte(partHeaders[i])); err != nil {
+			return
+		}
+		if err := copyFileRange(w, f, r); err != nil {
+			return
+		}
+	}
+	w.Write([]byte(closing))
+}
+
+// seeks rather than wrapping f in a SectionReader, io.CopyN keeps f an
+// *os.File underneath so the range can still go out with sendfile
+func copyFileRange(w io.Writer, f *os.File, r byteRange) error {
+	_, err := f.Seek(r.start, io.SeekStart)
+	if err == nil {
+		_, err = io.CopyN(w, f, r.length)
+	}
+	if err != nil {
+		log.Println("Error sending range:", err)
+	}
+	return err
+}
+
+func multipartBoundary() string {
+	buf := make([]byte, 12)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
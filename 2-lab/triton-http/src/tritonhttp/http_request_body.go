@@ -0,0 +1,162 @@
+package tritonhttp
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var errBodyTooLarge = errors.New("Request body too large")
+var errExpectationFailed = errors.New("Unsupported Expect")
+
+/*
+Reads the request body that follows the headers (RFC 7230 3.3.3), either
+	1. Transfer-Encoding: chunked, decoded until the zero sized chunk or
+	2. Content-Length bytes or
+	3. nothing, requests without either header have no body
+Sending both headers is rejected since the two could disagree about where
+the next request starts. An HTTP/1.1 client that sent Expect: 100-continue
+gets its 100 once the body's size has been checked, any other expectation
+is refused.
+*/
+func readBody(conn net.Conn, sb *SimpleBuffer, reqHeader *HttpRequestHeader, maxSize int64) error {
+	te, chunked := reqHeader.headers["Transfer-Encoding"]
+	cl, hasLength := reqHeader.headers["Content-Length"]
+
+	if chunked && hasLength {
+		return errors.New("Both Transfer-Encoding and Content-Length present")
+	}
+	expect, expecting := reqHeader.headers["Expect"]
+	if expecting && !strings.EqualFold(strings.TrimSpace(expect), "100-continue") {
+		return errExpectationFailed
+	}
+	// HTTP/1.0 clients don't know about 100 (RFC 9110 10.1.1)
+	expecting = expecting && reqHeader.proto == "HTTP/1.1"
+
+	if chunked {
+		if strings.ToLower(strings.TrimSpace(te)) != "chunked" {
+			return errors.New("Unsupported Transfer-Encoding: " + te)
+		}
+		if err := sendContinue(conn, expecting); err != nil {
+			return err
+		}
+		body, err := readChunkedBody(conn, sb, maxSize)
+		if err != nil {
+			return err
+		}
+		reqHeader.body = body
+		return nil
+	}
+
+	if hasLength {
+		length, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || length < 0 {
+			return errors.New("Invalid Content-Length: " + cl)
+		}
+		if length > maxSize {
+			return errBodyTooLarge
+		}
+		if err := sendContinue(conn, expecting && length > 0); err != nil {
+			return err
+		}
+		body, err := readBytes(conn, sb, length)
+		if err != nil {
+			return err
+		}
+		reqHeader.body = body
+	}
+	return nil
+}
+
+// tells a client waiting on Expect: 100-continue to send the body
+func sendContinue(conn net.Conn, expecting bool) error {
+	if !expecting {
+		return nil
+	}
+	_, err := conn.Write([]byte("HTTP/1.1 100 Continue" + EoR))
+	return err
+}
+
+// chunk-size [; ext] CRLF data CRLF ... 0 CRLF [trailers] CRLF
+func readChunkedBody(conn net.Conn, sb *SimpleBuffer, maxSize int64) ([]byte, error) {
+	body := []byte{}
+	for {
+		line, err := readLine(conn, sb)
+		if err != nil {
+			return nil, err
+		}
+		if i := strings.Index(line, ";"); i >= 0 { // drop chunk extensions
+			line = line[:i]
+		}
+		// 1*HEXDIG, ParseInt alone would take a sign
+		hex := strings.TrimSpace(line)
+		size, err := strconv.ParseInt(hex, 16, 64)
+		if err != nil || hex == "" || strings.Trim(hex, "0123456789abcdefABCDEF") != "" {
+			return nil, errors.New("Invalid chunk size: " + line)
+		}
+
+		if size == 0 {
+			break
+		}
+		if int64(len(body))+size > maxSize {
+			return nil, errBodyTooLarge
+		}
+
+		chunk, err := readBytes(conn, sb, size)
+		if err != nil {
+			return nil, err
+		}
+		body = append(body, chunk...)
+
+		if line, err = readLine(conn, sb); err != nil {
+			return nil, err
+		} else if line != "" {
+			return nil, errors.New("Missing CRLF after chunk data")
+		}
+	}
+
+	// trailers aren't used for anything, just skip to the blank line
+	for {
+		line, err := readLine(conn, sb)
+		if err != nil {
+			return nil, err
+		}
+		if line == "" {
+			return body, nil
+		}
+	}
+}
+
+// returns the next CRLF terminated line without the CRLF
+func readLine(conn net.Conn, sb *SimpleBuffer) (string, error) {
+	for {
+		if i := sb.IndexOf([]byte(CRLF)); i >= 0 {
+			return sb.Read(i+2)[:i], nil
+		}
+		if sb.IsFull() {
+			return "", errors.New("Line too long")
+		}
+		if err := fillBuffer(conn, sb); err != nil {
+			return "", err
+		}
+	}
+}
+
+// returns exactly n bytes, which may be more than the buffer holds
+func readBytes(conn net.Conn, sb *SimpleBuffer, n int64) ([]byte, error) {
+	data := make([]byte, 0, n)
+	for int64(len(data)) < n {
+		if sb.IsEmpty() {
+			if err := fillBuffer(conn, sb); err != nil {
+				return nil, err
+			}
+		}
+		toRead := n - int64(len(data))
+		if toRead > int64(sb.size) {
+			toRead = int64(sb.size)
+		}
+		data = append(data, sb.Read(int(toRead))...)
+	}
+	return data, nil
+}
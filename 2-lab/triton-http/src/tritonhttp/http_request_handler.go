@@ -1,15 +1,19 @@
 package tritonhttp
 
 import (
+	"crypto/tls"
 	"io"
-	"log"
 	"net"
 	"time"
+	"strconv"
 	"strings"
-	"regexp"
+	"net/textproto"
+	"net/url"
 	"errors"
 )
 
+var errVersionNotSupported = errors.New("HTTP version not supported")
+
 /*
 For a connection, keep handling requests until
 	1. a timeout occurs or
@@ -17,51 +21,145 @@ For a connection, keep handling requests until
 	3. client sends a bad request (wrong format or size >8KB)
 */
 func (hs *HttpServer) handleConnection(conn net.Conn) {
-	log.Println("Accepted new connection from: ", conn.RemoteAddr())
+	hs.debugLog("Accepted new connection from:", conn.RemoteAddr())
 	defer conn.Close()
-	defer log.Println("Closed connection.\n\n")
+	defer hs.untrackConn(conn)
+	defer hs.debugLog("Closed connection.")
+
+	// TLS clients pick HTTP/2 or HTTP/1.1 during the handshake (ALPN)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(deadlineAfter(hs.IdleTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			hs.debugLog("TLS handshake failed:", err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+			hs.serveHTTP2(conn, nil, nil, nil)
+			return
+		}
+	}
 
-	// create an 8 KB buffer
-	sb := SimpleBuffer{ buffer: make([]byte, 32*KB), size: 0}
+	// the request header has to fit in the buffer
+	sb := SimpleBuffer{ buffer: make([]byte, hs.maxHeaderSize()), size: 0}
 
 	// keep looping until we -
-	//	1. getNextReq() returns err: timeout, disconnected or Req > 8KB
+	//	1. getNextReq() returns err: timeout, disconnected or Req > MaxHeaderSize
 	//	2. A bad req. - mostly due to parsing err below
-	//	3. Request header has "Connection : Close"
-	for {
-		reqData, err := getNextReq(conn, &sb)
+	//	3. Request header has "Connection : Close" (or the handler closes it)
+	//	4. The server is shutting down
+	//	5. MaxRequestsPerConn requests have been served
+	for requests := 1; ; requests++ {
+		reqData, start, err := getNextReq(conn, &sb, hs.IdleTimeout, hs.HeaderTimeout)
 		if err != nil {
-			if err != io.EOF && !sb.IsEmpty(){ // timeout or req >8KB
-				log.Println("Bad request: timeout or req > 8KB")
-				hs.handleBadRequest(conn)
+			hs.debugLog("Error reading conn data:", err)
+			if err != io.EOF && !sb.IsEmpty() && !hs.shuttingDown() { // timeout or req too long
+				hs.debugLog("Bad request: timeout or req > MaxHeaderSize")
+				hs.handleBadRequest(conn, start)
 			}
 			// else client disconnected, don't do anything
 			return
 		}
 
+		// an HTTP/2 client with prior knowledge, the rest of the preface
+		// and maybe its first frames are already in the buffer
+		if requests == 1 && reqData == "PRI * HTTP/2.0" && !hs.DisableHTTP2 {
+			hs.serveHTTP2(conn, []byte(reqData+EoR+sb.Read(sb.size)), nil, nil)
+			return
+		}
+
+		// from here until the response is out Shutdown waits for us
+		if !hs.setConnActive(conn, true) {
+			return
+		}
+
 		// create the HttpRequestHeader
 		reqHeader, err := makeReqHeader(reqData)
-		if err != nil {
-			log.Println("Bad request.", err)
-			hs.handleBadRequest(conn)
+		if err == nil {
+			// pull the body (if any) off the wire so it doesn't get
+			// mistaken for the next request
+			conn.SetReadDeadline(deadlineAfter(hs.ReadTimeout))
+			err = readBody(conn, &sb, &reqHeader, hs.bodyLimit(conn.RemoteAddr(), &reqHeader))
+			if err == io.EOF {
+				return
+			}
+		}
+
+		if err == errBodyTooLarge {
+			hs.debugLog("Request body too large.")
+			hs.handleRequestTooLarge(conn, start)
+			break
+		} else if err == errPathTraversal {
+			hs.debugLog("Path traversal attempt.")
+			hs.handleConnectionError(conn, 403, start)
+			break
+		} else if err == errVersionNotSupported {
+			hs.debugLog("Unsupported HTTP version.")
+			hs.handleConnectionError(conn, 505, start)
+			break
+		} else if err == errExpectationFailed {
+			hs.debugLog("Unsupported expectation.")
+			hs.handleConnectionError(conn, 417, start)
+			break
+		} else if err != nil {
+			hs.debugLog("Bad request.", err)
+			hs.handleBadRequest(conn, start)
 			break
-		} else {
-			log.Println("Request Parsed:\n", reqHeader)
-			hs.handleResponse(&reqHeader, conn)
 		}
 
-		if reqHeader.headers["Connection"] == "close" {
+		hs.debugLog("Request Parsed:\n", reqHeader)
+		if settings, ok := h2cUpgradeSettings(conn, &reqHeader); ok && !hs.DisableHTTP2 {
+			conn.Write([]byte("HTTP/1.1 101 Switching Protocols" + CRLF +
+				"Connection: Upgrade" + CRLF + "Upgrade: h2c" + EoR))
+			hs.serveHTTP2(conn, []byte(sb.Read(sb.size)), &reqHeader, settings)
+			return
+		}
+
+		w := newResponseWriter(hs, conn, &reqHeader)
+		w.pending = &sb
+		if hs.MaxRequestsPerConn > 0 && requests >= hs.MaxRequestsPerConn {
+			w.Headers()["Connection"] = "close"
+		}
+		if hs.WriteTimeout > 0 {
+			conn.SetWriteDeadline(time.Now().Add(hs.WriteTimeout))
+		}
+
+		hs.serveRequest(w, &reqHeader, start, requests > 1)
+
+		// after a 101 the connection belonged to another protocol
+		if !w.keepAlive() || hs.shuttingDown() || w.StatusCode() == 101 {
 			break
 		}
+		hs.setConnActive(conn, false)
 	}
 
 }
 
+// answers a request and records it, whichever protocol it came over
+func (hs *HttpServer) serveRequest(w *ResponseWriter, reqHeader *HttpRequestHeader, start time.Time, reused bool) {
+	if allowed, retryAfter := hs.allowRequest(w.conn); !allowed {
+		w.Headers()["Retry-After"] = strconv.Itoa(retryAfter)
+		handleErrorResponse(w, 429)
+	} else if _, secure := w.conn.(*tls.Conn); hs.RedirectToHTTPS && !secure {
+		hs.redirectToHTTPS(w, reqHeader)
+	} else if hs.authorize(w, reqHeader) {
+		hs.Mux.ServeHTTP(w, reqHeader)
+	}
+	w.finish()
+	hs.logAccess(w, reqHeader, start)
+	hs.metrics.observe(w, reqHeader, start, reused)
+}
 
-// this waits on and fetches incoming req.
-func getNextReq(conn net.Conn, sb *SimpleBuffer) (string, error){
-	// local buf to read from socket
-	tmpBuf := make([]byte, 32*KB) // to handle large requests
+// this waits on and fetches incoming req. the client gets idleTimeout to
+// start a request and from its first byte headerTimeout to finish the header,
+// a timeout of 0 waits forever. also returns when the first byte came in,
+// which is when the request started even if it turns out to be bad
+func getNextReq(conn net.Conn, sb *SimpleBuffer, idleTimeout, headerTimeout time.Duration) (string, time.Time, error){
+	started := time.Now()
+	deadline := deadlineAfter(idleTimeout)
+	if !sb.IsEmpty() { // a pipelined request has already started
+		deadline = deadlineAfter(headerTimeout)
+	}
 
 	// keep looping until we -
 	// find a valid req, or buffer is full, or error reading conn (timeout)
@@ -69,60 +167,149 @@ func getNextReq(conn net.Conn, sb *SimpleBuffer) (string, error){
 		// does request exist in the buffer?
 		if i := sb.IndexOf([]byte(EoR)); i >= 0 {
 			data := sb.Read(i+4)
-			return data[:i], nil
+			return data[:i], started, nil
 		}
 
 		// The buffer is full & still no valid req => a bad request
 		if sb.IsFull() {
-			return "", errors.New("Request too long")
+			return "", started, errors.New("Request too long")
 		}
 
 		// if not try to read for more
-		timeoutDuration := 5 * time.Second
-		conn.SetReadDeadline(time.Now().Add(timeoutDuration))
-		numBytes, err := conn.Read(tmpBuf)
-		if err != nil {
-			log.Println("Error reading conn data:", err)
-			return "", err
+		wasEmpty := sb.IsEmpty()
+		conn.SetReadDeadline(deadline)
+		if err := fillBuffer(conn, sb); err != nil {
+			return "", started, err
 		}
-		sb.Write(tmpBuf[:numBytes])
+		if wasEmpty {
+			started = time.Now()
+			deadline = deadlineAfter(headerTimeout)
+		}
+	}
+}
+
+// reads whatever the client has sent next into the free part of the buffer,
+// the caller sets the read deadline
+func fillBuffer(conn net.Conn, sb *SimpleBuffer) error {
+	numBytes, err := conn.Read(sb.buffer[sb.size:])
+	if err != nil {
+		return err
 	}
+	sb.size += numBytes
+	return nil
 }
 
 func makeReqHeader(reqData string) (HttpRequestHeader, error) {
 	data := strings.Split(reqData, "\r\n")
 	reqLine := strings.Fields(data[0])
 	if !(len(reqLine) == 3 &&
-		 reqLine[0] == "GET" &&
-		 strings.HasPrefix(reqLine[1], "/") &&
-		 reqLine[2] == "HTTP/1.1" ){
+		 isToken(reqLine[0]) &&
+		 strings.HasPrefix(reqLine[1], "/")){
 			reqHeader := HttpRequestHeader{}
 			return reqHeader, errors.New("Unexpected request line: " + data[0])
 	}
 
+	// a well-formed version we don't speak gets a 505 rather than a 400
+	major, minor, ok := parseHTTPVersion(reqLine[2])
+	if !ok {
+		return HttpRequestHeader{}, errors.New("Unexpected request line: " + data[0])
+	}
+	if major != 1 || minor > 1 {
+		return HttpRequestHeader{}, errVersionNotSupported
+	}
+
 	headers := map[string]string{}
-	reg, _ := regexp.Compile(`^([\w-]+): (.*)$`)
+	name := "" // the last header, for folded lines
 
 	for _, header := range data[1:] {
-		kvList := reg.FindStringSubmatch(header)
-		if len(kvList) != 3 {
+		// obsolete line folding (RFC 7230 3.2.4), the continuation
+		// is joined onto the previous header with a space
+		if name != "" && (strings.HasPrefix(header, " ") || strings.HasPrefix(header, "\t")) {
+			headers[name] += " " + strings.Trim(header, " \t")
+			continue
+		}
+
+		key, value, ok := strings.Cut(header, ":")
+		if !ok || !isToken(key) {
 			reqHeader := HttpRequestHeader{}
 			return reqHeader, errors.New("Unexpected header format: " + header)
 		}
-		headers[kvList[1]] = kvList[2]
+
+		// header names are case-insensitive, we keep them canonical
+		name = textproto.CanonicalMIMEHeaderKey(key)
+		value = strings.Trim(value, " \t")
+		if existing, ok := headers[name]; ok {
+			if name == "Host" || name == "Content-Length" {
+				return HttpRequestHeader{}, errors.New("Repeated header: " + name)
+			}
+			value = joinHeaderValues(name, existing, value)
+		}
+		headers[name] = value
 	}
 
-	// check for Host header
-	if _, ok := headers["Host"]; !ok {
+	// check for Host header, HTTP/1.0 clients needn't send one
+	if _, ok := headers["Host"]; !ok && minor == 1 {
 		reqHeader := HttpRequestHeader{}
 		return reqHeader, errors.New("Missing header 'Host'")
 	}
 
 	reqHeader := HttpRequestHeader{
+		requestLine: data[0],
 		verb: reqLine[0],
-		url: strings.Split(reqLine[1], "?")[0],
+		proto: reqLine[2],
 		headers: headers,
 	}
+	if err := reqHeader.setTarget(reqLine[1]); err != nil {
+		return HttpRequestHeader{}, err
+	}
 
 	return reqHeader, nil
 }
+
+// handlers see the decoded path, the raw one and the query string are
+// kept for the ones passing the request on, like CGI and proxies
+func (rh *HttpRequestHeader) setTarget(target string) error {
+	rawPath, rawQuery, _ := strings.Cut(target, "?")
+	decoded, err := decodePath(rawPath)
+	if err != nil {
+		return err
+	}
+	rh.url, rh.rawPath, rh.rawQuery = decoded, rawPath, rawQuery
+	rh.query, _ = url.ParseQuery(rawQuery) // keeps what it could parse
+	return nil
+}
+
+// splits "HTTP/1.1" into 1 and 1
+func parseHTTPVersion(proto string) (int, int, bool) {
+	if len(proto) != len("HTTP/1.1") || !strings.HasPrefix(proto, "HTTP/") || proto[6] != '.' {
+		return 0, 0, false
+	}
+	major, minor := proto[5], proto[7]
+	if major < '0' || major > '9' || minor < '0' || minor > '9' {
+		return 0, 0, false
+	}
+	return int(major - '0'), int(minor - '0'), true
+}
+
+// repeated headers are the same as one comma separated list (RFC 7230
+// 3.2.2), except cookies which are separated by "; "
+func joinHeaderValues(name string, existing string, value string) string {
+	if name == "Cookie" {
+		return existing + "; " + value
+	}
+	return existing + ", " + value
+}
+
+// whether s is a valid header name, a token as defined in RFC 7230 3.2.6
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+			strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,232 @@
+package tritonhttp
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMakeReqHeaderHeaders(t *testing.T) {
+	reqHeader, err := makeReqHeader("GET /a?b=c HTTP/1.1\r\n" +
+		"host: example.com\r\n" +
+		"ACCEPT-encoding:gzip\r\n" +
+		"Accept-Encoding:  br \r\n" +
+		"Cookie: a=1\r\n" +
+		"cookie: b=2\r\n" +
+		"X-Folded: one\r\n" +
+		"\t two")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"Host":            "example.com",
+		"accept-encoding": "gzip, br",
+		"Cookie":          "a=1; b=2",
+		"X-FOLDED":        "one two",
+	}
+	for key, want := range tests {
+		if got := reqHeader.Header(key); got != want {
+			t.Errorf("Header(%q) = %q, want %q", key, got, want)
+		}
+	}
+	if values := reqHeader.HeaderValues("Accept-Encoding"); len(values) != 2 || values[1] != "br" {
+		t.Errorf("HeaderValues = %q", values)
+	}
+	if reqHeader.Proto() != "HTTP/1.1" || reqHeader.URL() != "/a" || reqHeader.RawQuery() != "b=c" {
+		t.Errorf("got %s %s ? %s", reqHeader.Proto(), reqHeader.URL(), reqHeader.RawQuery())
+	}
+}
+
+func TestMakeReqHeaderErrors(t *testing.T) {
+	tests := []struct {
+		request	string
+		ok	bool
+		err	error // the exact error, if it matters
+	}{
+		{"GET / HTTP/1.0", true, nil},
+		{"GET / HTTP/1.1", false, nil}, // missing Host
+		{"GET / HTTP/2.0\r\nHost: a", false, errVersionNotSupported},
+		{"GET / HTTP/1.2\r\nHost: a", false, errVersionNotSupported},
+		{"GET / HTTP/1\r\nHost: a", false, nil},
+		{"GET / HTTP/1.1\r\nHo st: a", false, nil},
+		{"GET / HTTP/1.1\r\nHost : a", false, nil},
+		{"GET / HTTP/1.1\r\nHost: a\r\nHost: b", false, nil},
+		{"LOCK / HTTP/1.1\r\nHost: a", true, nil}, // the router answers methods it doesn't route
+		{"G(ET / HTTP/1.1\r\nHost: a", false, nil},
+		{"GET / HTTP/1.1\r\n folded\r\nHost: a", false, nil},
+	}
+	for _, test := range tests {
+		_, err := makeReqHeader(test.request)
+		if test.ok && err != nil {
+			t.Errorf("%q: %v, want it accepted", test.request, err)
+		} else if !test.ok && (err == nil || test.err != nil && err != test.err) {
+			t.Errorf("%q: got %v, want an error", test.request, err)
+		}
+	}
+}
+
+func TestRequestHeaderString(t *testing.T) {
+	reqHeader, err := makeReqHeader("GET /a HTTP/1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reqHeader.String(); got != "GET /a HTTP/1.0\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestHTTP10KeepAlive(t *testing.T) {
+	hs := newTestServer(t)
+	hs.Mux.HandleFunc("/stream", func(w *ResponseWriter, r *HttpRequestHeader) {
+		w.Write([]byte("no length"))
+	})
+	addr := serveTest(t, hs, nil)
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	status, headers, _ := roundTrip(t, conn, "GET /index.html HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n")
+	if status != "HTTP/1.1 200 OK" || headers["Connection"] != "keep-alive" {
+		t.Fatalf("got %q with Connection %q, want 200 keep-alive", status, headers["Connection"])
+	}
+
+	// without a length the body can't be chunked, it ends with the connection
+	status, headers, body := roundTrip(t, conn, "GET /stream HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	if headers["Connection"] != "close" || headers["Transfer-Encoding"] != "" || body != "no length" {
+		t.Fatalf("got %q %v %q, want an unchunked body and close", status, headers, body)
+	}
+}
+
+func TestHTTP10ClosesByDefault(t *testing.T) {
+	hs := newTestServer(t)
+	addr := serveTest(t, hs, nil)
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, headers, _ := roundTrip(t, conn, "GET /index.html HTTP/1.0\r\n\r\n"); headers["Connection"] != "close" {
+		t.Fatalf("Connection is %q, want close", headers["Connection"])
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("got %d more bytes, want the connection closed", n)
+	}
+}
+
+func TestConnectionCloseAnyCase(t *testing.T) {
+	hs := newTestServer(t)
+	addr := serveTest(t, hs, nil)
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, headers, _ := roundTrip(t, conn, "GET /index.html HTTP/1.1\r\nhost: 127.0.0.1\r\nconnection: Close\r\n\r\n")
+	if headers["Connection"] != "close" {
+		t.Fatalf("Connection is %q, want close", headers["Connection"])
+	}
+}
+
+func TestVersionNotSupported(t *testing.T) {
+	hs := newTestServer(t)
+	addr := serveTest(t, hs, nil)
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	status, headers, _ := roundTrip(t, conn, "GET /index.html HTTP/3.0\r\nHost: 127.0.0.1\r\n\r\n")
+	if status != "HTTP/1.1 505 HTTP Version Not Supported" || headers["Connection"] != "close" {
+		t.Fatalf("got %q with Connection %q, want 505 and close", status, headers["Connection"])
+	}
+}
+
+// a server whose /echo answers with the request body
+func newBodyEchoServer(t *testing.T) string {
+	t.Helper()
+	hs := newTestServer(t)
+	hs.MaxBodySize = 10
+	hs.Mux.HandleFunc("/echo", func(w *ResponseWriter, r *HttpRequestHeader) {
+		w.Headers()["Content-Length"] = strconv.Itoa(len(r.Body()))
+		w.Write(r.Body())
+	}, "POST")
+	return serveTest(t, hs, nil)
+}
+
+func TestChunkedBody(t *testing.T) {
+	addr := newBodyEchoServer(t)
+	tests := []struct {
+		body	string
+		status	string
+	}{
+		{"5\r\nhello\r\n0\r\n\r\n", "HTTP/1.1 200 OK"},
+		{"5;name=value\r\nhello\r\n0\r\nX-Trailer: t\r\n\r\n", "HTTP/1.1 200 OK"},
+		{"+5\r\nhello\r\n0\r\n\r\n", "HTTP/1.1 400 Bad Request"},
+		{"-0\r\n\r\n", "HTTP/1.1 400 Bad Request"},
+		{"0x5\r\nhello\r\n0\r\n\r\n", "HTTP/1.1 400 Bad Request"},
+		{";ext\r\n\r\n", "HTTP/1.1 400 Bad Request"},
+		{"b\r\nhello world\r\n0\r\n\r\n", "HTTP/1.1 413 Content Too Large"},
+	}
+	for _, test := range tests {
+		conn, err := net.Dial("tcp4", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, _, body := roundTrip(t, conn, "POST /echo HTTP/1.1\r\nHost: 127.0.0.1\r\n"+
+			"Transfer-Encoding: chunked\r\nConnection: close\r\n\r\n"+test.body)
+		conn.Close()
+		if status != test.status || status == "HTTP/1.1 200 OK" && body != "hello" {
+			t.Errorf("%q: got %q %q, want %q", test.body, status, body, test.status)
+		}
+	}
+}
+
+func TestExpectContinue(t *testing.T) {
+	addr := newBodyEchoServer(t)
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the body only goes out once the server says so
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("POST /echo HTTP/1.1\r\nHost: 127.0.0.1\r\nExpect: 100-continue\r\n" +
+		"Content-Length: 5\r\n\r\n"))
+	interim := make([]byte, len("HTTP/1.1 100 Continue\r\n\r\n"))
+	if _, err := io.ReadFull(conn, interim); err != nil || string(interim) != "HTTP/1.1 100 Continue\r\n\r\n" {
+		t.Fatalf("got %q, %v", interim, err)
+	}
+	if status, _, body := roundTrip(t, conn, "hello"); status != "HTTP/1.1 200 OK" || body != "hello" {
+		t.Errorf("got %q %q", status, body)
+	}
+
+	tests := map[string]string{
+		"Expect: 100-continue\r\nContent-Length: 11\r\n":	"HTTP/1.1 413 Content Too Large",
+		"Expect: teapot\r\nContent-Length: 5\r\n":		"HTTP/1.1 417 Expectation Failed",
+	}
+	for headers, want := range tests {
+		conn, err := net.Dial("tcp4", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// refused before the client sends the body
+		if status, _, _ := roundTrip(t, conn, "POST /echo HTTP/1.1\r\nHost: 127.0.0.1\r\n"+headers+"\r\n"); status != want {
+			t.Errorf("%q: got %q, want %q", headers, status, want)
+		}
+		conn.Close()
+	}
+}
@@ -1,138 +1,233 @@
 package tritonhttp
 
 import (
-	"os"
+	"html"
 	"io"
 	"log"
 	"net"
 	"time"
 	"strconv"
 	"strings"
-	"path/filepath"
 )
 
-func fileExists(path string) bool {
-    fileInfo, err := os.Stat(path)
-    return !os.IsNotExist(err) && !fileInfo.IsDir()
-}
-
-func isDir(path string) bool {
-    fileInfo, err := os.Stat(path)
-    return !os.IsNotExist(err) && fileInfo.IsDir()
-}
-
-func fileLastModified(path string) string {
-	fileInfo, err := os.Stat(path)
-	if err != nil { // should result in server error
-		log.Println(err)
-		return "" // ok?
-	}
-	return fileInfo.ModTime().Format(time.RFC1123)
-}
-
-func fileSize(path string) int64 {
-	fileInfo, err := os.Stat(path)
-	if err != nil { // should be server error
-		log.Println(err)
-		return 0 // ok?
-	}
-	return fileInfo.Size()
-}
-
 func headerToString(resHeader HttpResponseHeader) string{
 	var b strings.Builder
 
 	// HTTP/1.1 200 OK\r\n
 	b.WriteString(resHeader.Proto + " " + resHeader.Status + CRLF)
 
+	// a header that has to be repeated (Set-Cookie) keeps its values
+	// separated by "\n", each one goes out on its own line
 	for key, value := range resHeader.Headers {
-		b.WriteString(key + ": " + value + CRLF)
+		for _, v := range strings.Split(value, "\n") {
+			b.WriteString(key + ": " + v + CRLF)
+		}
 	}
 	b.WriteString(CRLF)
 	return b.String()
 }
 
-func (hs *HttpServer) handleBadRequest(conn net.Conn) {
-	body := "Bad Request"
+func (hs *HttpServer) handleBadRequest(conn net.Conn, start time.Time) {
+	hs.metrics.badRequest()
+	hs.handleConnectionError(conn, 400, start)
+}
+
+func (hs *HttpServer) handleRequestTooLarge(conn net.Conn, start time.Time) {
+	hs.handleConnectionError(conn, 413, start)
+}
 
-	headers := map[string]string{ "Server": "TritonHTTP", "Connection": "close",
-				"Content-Type": "text/plain", "Content-Length": strconv.Itoa(len(body))}
-	resHeader := HttpResponseHeader{Proto: "HTTP/1.1", Headers: headers,
-										Status: "400 Bad Request", StatusCode:400}
+// answers a request we couldn't make sense of and gives up on the
+// connection, start is when the request began to arrive
+func (hs *HttpServer) handleConnectionError(conn net.Conn, statusCode int, start time.Time) {
+	w := newResponseWriter(hs, conn, nil)
+	w.Headers()["Connection"] = "close"
+	handleErrorResponse(w, statusCode)
+	hs.logAccess(w, nil, start)
+	hs.metrics.observe(w, nil, start, false)
+}
 
+// points the client at location, with a short html body for old clients
+func redirect(w *ResponseWriter, location string, statusCode int) {
+	body := "<a href=\"" + html.EscapeString(location) + "\">" + StatusText(statusCode) + "</a>.\n"
 
-	headerString := headerToString(resHeader)
-	log.Println("Sending response:\n", headerString)
-	conn.Write([]byte(headerString+body))
+	headers := w.Headers()
+	headers["Location"] = location
+	headers["Content-Type"] = "text/html"
+	headers["Content-Length"] = strconv.Itoa(len(body))
+	w.WriteHeader(statusCode)
+	w.Write([]byte(body))
 }
 
-func (hs *HttpServer) handleResponse(requestHeader *HttpRequestHeader, conn net.Conn) {
+// the static file server, registered on the mux for "/" by NewHttpdServer
+func (hs *HttpServer) handleResponse(w *ResponseWriter, requestHeader *HttpRequestHeader) {
+
+	// the Host header picks which site's files we serve
+	site := hs.virtualHost(requestHeader)
+	files := hs.files()
 
-	// check if file exists under the server-root dir
-	file, _ := filepath.Abs(hs.DocRoot + requestHeader.url)
-	if isDir(file){
-		file += "/index.html"
+	// check if file exists under the server-root dir, anything that
+	// resolves to somewhere else is an attempt to escape it
+	path, err := resolvePath(site.DocRoot, requestHeader.url)
+	if err != nil {
+		hs.debugLog("Refusing path outside the doc root:", requestHeader.url)
+		handleErrorResponse(w, 403)
+		return
 	}
 
-	headers := map[string]string{ "Server" : "TritonHTTP"}
-	if requestHeader.headers["Connection"] == "close"{
-		headers["Connection"] = "close"
+	// small files may be in memory already, the key tells "/dir" (a
+	// redirect) from "/dir/" (its index.html)
+	key := path
+	if strings.HasSuffix(requestHeader.url, "/") {
+		key += "/"
+	}
+	contents, gen := hs.contents(), uint64(0)
+	if contents != nil {
+		if c := contents.get(key); c != nil && hs.serveContent(w, requestHeader, c, site.contentType(c.path)) {
+			contents.hits.Add(1)
+			return
+		}
+		contents.misses.Add(1)
+		gen = contents.generation()
 	}
-	resHeader := HttpResponseHeader{Proto: "HTTP/1.1", Headers: headers}
 
-	if (strings.HasPrefix(file, hs.DocRoot) && fileExists(file)) {
+	// symlinks are only followed as far as the policy allows
+	if err := hs.checkSymlinks(site.DocRoot, path); err != nil {
+		hs.debugLog("Refusing symlink:", path, err)
+		handleErrorResponse(w, 403)
+		return
+	}
 
-		// ext = filepath.Ext(file)
-		ext := filepath.Ext(file)
-		contentType, exists := hs.MIMEMap[ext]
-		if !exists {
-			contentType = "application/octet-stream"
+	file, err := files.get(path)
+	if err == nil && file.isDir {
+		// relative links in the page only resolve against a url ending
+		// in "/", so send the client there first, query and all
+		if !strings.HasSuffix(requestHeader.url, "/") {
+			location := requestHeader.rawPath + "/"
+			if requestHeader.rawQuery != "" {
+				location += "?" + requestHeader.rawQuery
+			}
+			redirect(w, location, 301)
+			return
+		}
+		index, indexErr := files.get(path + "/index.html")
+		if (indexErr != nil || index.isDir) && site.AutoIndex {
+			hs.handleDirectoryListing(w, requestHeader, path)
+			return
+		}
+		path, file, err = path + "/index.html", index, indexErr
+		if err := hs.checkSymlinks(site.DocRoot, path); err != nil {
+			hs.debugLog("Refusing symlink:", path, err)
+			handleErrorResponse(w, 403)
+			return
 		}
-
-		resHeader.Status = "200 OK"
-		resHeader.StatusCode = 200
-		headers["Content-Type"] = contentType
-		headers["Content-Length"] = strconv.FormatInt(fileSize(file), 10)
-		headers["Last-Modified"] = fileLastModified(file)
-		hs.sendResponse(resHeader, conn, file)
-	} else{
-		resHeader.Status = "404 Not Found"
-		resHeader.StatusCode = 404
-		headers["Content-Type"] = "text/plain"
-		hs.handleFileNotFoundRequest(resHeader, conn)
 	}
-}
+	if err != nil {
+		hs.debugLog(err)
+		handleErrorResponse(w, fileErrorStatus(err))
+		return
+	}
+	if file.isDir {
+		handleErrorResponse(w, 404)
+		return
+	}
 
-func (hs *HttpServer) handleFileNotFoundRequest(responseHeader HttpResponseHeader, conn net.Conn) {
-	body := "404"
-	responseHeader.Headers["Content-Length"] = strconv.Itoa(len(body))
-	headerString := headerToString(responseHeader)
-	log.Println("Sending response:\n", headerString)
-	conn.Write([]byte(headerString))
-	conn.Write([]byte(body))
-}
+	// find out now if we can't read the file, once the headers are out
+	// it's too late to say so. the handle stays cached for sending it.
+	f, err := file.open()
+	if err != nil {
+		log.Println(err)
+		handleErrorResponse(w, fileErrorStatus(err))
+		return
+	}
+	file.release(f)
 
-func (hs *HttpServer) sendResponse(responseHeader HttpResponseHeader, conn net.Conn, path string) {
-	// Send headers
-	headerString := headerToString(responseHeader)
-	log.Println("Sending response:\n", headerString)
-	conn.Write([]byte(headerString))
+	headers := w.Headers()
+	contentType := site.contentType(path)
 
-	//Create 8KB buffer (or should I decide dynamically based on file size)
-	buffer := make([]byte, 8*KB)
+	// a .gz file stored next to the original is sent instead of
+	// compressing it ourselves, if the symlink policy lets us at it
+	var gz *cachedFile
+	if compressible(contentType) && hs.checkSymlinks(site.DocRoot, path+".gz") == nil {
+		if sibling, err := files.get(path + ".gz"); err == nil && !sibling.isDir {
+			gz = sibling
+		}
+	}
 
-	f, err := os.Open(path)
-	if err!= nil {
-		return // what would one really do here?
+	if contents != nil {
+		if targets, ok := hs.symlinkTargets(site.DocRoot, file, gz); ok {
+			if c := contents.load(key, file, gz, targets, compressible(contentType), gen); c != nil &&
+				hs.serveContent(w, requestHeader, c, contentType) {
+				return
+			}
+		}
 	}
-	defer f.Close()
 
-	// can use bufio WriteTo instead
-	for {
-		num, err := f.Read(buffer)
-		if err == io.EOF {
-			break
+	// text-like files may go out compressed, either from the .gz
+	// file or compressed as we send it
+	encoding, compressOnTheFly := "", false
+	if compressible(contentType) {
+		headers["Vary"] = "Accept-Encoding"
+		encoding = negotiateEncoding(requestHeader.headers["Accept-Encoding"])
+		if encoding == "gzip" && gz != nil {
+			file = gz
+		} else {
+			compressOnTheFly = encoding != ""
 		}
-		conn.Write(buffer[:num])
+	}
+
+	headers["Content-Type"] = contentType
+	headers["Content-Length"] = strconv.FormatInt(file.size, 10)
+	headers["Last-Modified"] = file.lastModified()
+	headers["ETag"] = file.etag
+	headers["Accept-Ranges"] = "bytes"
+	if encoding != "" {
+		headers["Content-Encoding"] = encoding
+	}
+	if compressOnTheFly {
+		// the compressed length isn't known up front, and the bytes
+		// differ from the plain file so they need their own tag
+		delete(headers, "Content-Length")
+		headers["ETag"] = encodedETag(headers["ETag"], encoding)
+	}
+
+	rangeHeader, hasRange := requestHeader.headers["Range"]
+	if notModified(requestHeader, headers["ETag"], file.modTime) {
+		hs.handleNotModified(w)
+	} else if requestHeader.verb == "HEAD" {
+		w.WriteHeader(200)
+	} else if compressOnTheFly {
+		// ranges can't be served from a stream we're still compressing
+		hs.sendCompressed(w, file, encoding)
+	} else if hasRange && ifRangeMatch(requestHeader, headers["ETag"], headers["Last-Modified"]) {
+		hs.handleRangeRequest(w, file, rangeHeader)
+	} else {
+		hs.sendResponse(w, file)
+	}
+}
+
+// a 304 only repeats the validators, there's no body and no content headers
+func (hs *HttpServer) handleNotModified(w *ResponseWriter) {
+	delete(w.Headers(), "Content-Type")
+	delete(w.Headers(), "Content-Length")
+	w.WriteHeader(304)
+}
+
+// sends the whole file. io.Copy hands it to the writer's ReadFrom, which
+// on a plain TCP connection lets the kernel send it with sendfile
+func (hs *HttpServer) sendResponse(w *ResponseWriter, file *cachedFile) {
+	f, err := file.open()
+	if err != nil {
+		log.Println(err)
+		handleErrorResponse(w, fileErrorStatus(err))
+		return
+	}
+	defer file.release(f)
+
+	// Send headers
+	w.WriteHeader(200)
+
+	if _, err := io.Copy(w, f); err != nil {
+		hs.debugLog("Error sending file:", err)
+		w.Headers()["Connection"] = "close" // the client is out of step now
 	}
 }
@@ -0,0 +1,204 @@
+package tritonhttp
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/*
+Handlers send their response through a ResponseWriter. It owns the status
+line and the framing of the body
+	1. with a Content-Length header the body is written as is
+	2. without one it is sent with chunked transfer-encoding
+	3. unless the client speaks HTTP/1.0, then the connection is closed
+	   after the body
+	4. for HEAD requests and 1xx/204/304 responses the body is dropped
+On an HTTP/2 connection the headers and body go out as frames on the
+request's stream instead, which ends the body itself.
+*/
+type ResponseWriter struct {
+	server		*HttpServer
+	conn		net.Conn
+	request		*HttpRequestHeader // nil if the request couldn't be parsed
+	header		HttpResponseHeader
+	headOnly	bool  // HEAD request, only the headers go out
+	http10		bool  // HTTP/1.0 client, it can't take a chunked body
+	wroteHeader	bool
+	reason		string // reason phrase to send instead of the standard one
+	chunked		bool
+	written		int64 // body bytes written by the handler
+	stream		responseStream // set for HTTP/2 requests
+	pending		*SimpleBuffer  // read past the request, for handlers that take over the conn
+}
+
+// where the response goes on an HTTP/2 connection, see h2Stream
+type responseStream interface {
+	writeHeader(header HttpResponseHeader, endStream bool) error
+	write(data []byte) error
+	end() error // the body is complete
+	abort()     // the response can't be completed, the client is told so
+}
+
+func newResponseWriter(hs *HttpServer, conn net.Conn, requestHeader *HttpRequestHeader) *ResponseWriter {
+	headers := map[string]string{"Server": "TritonHTTP"}
+	w := &ResponseWriter{server: hs, conn: conn,
+		header: HttpResponseHeader{Proto: "HTTP/1.1", Headers: headers}}
+
+	if requestHeader != nil {
+		w.request = requestHeader
+		w.headOnly = requestHeader.verb == "HEAD"
+		w.http10 = requestHeader.proto == "HTTP/1.0"
+		if !requestHeader.keepAlive() {
+			headers["Connection"] = "close"
+		} else if w.http10 {
+			headers["Connection"] = "keep-alive"
+		}
+	}
+	return w
+}
+
+// the response headers, changes after WriteHeader have no effect
+func (w *ResponseWriter) Headers() map[string]string {
+	return w.header.Headers
+}
+
+// the status code sent, 0 if nothing has been sent yet
+func (w *ResponseWriter) StatusCode() int {
+	return w.header.StatusCode
+}
+
+// number of body bytes the handler has written
+func (w *ResponseWriter) BytesWritten() int64 {
+	return w.written
+}
+
+// sends the status line and headers, only the first call has any effect
+func (w *ResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+
+	w.header.StatusCode = statusCode
+	reason := w.reason
+	if reason == "" {
+		reason = statusReason(statusCode)
+	}
+	w.header.Status = strconv.Itoa(statusCode) + " " + reason
+
+	if w.stream != nil {
+		w.server.debugLog("Sending response:\n", w.header)
+		w.stream.writeHeader(w.header, w.headOnly || !bodyAllowed(statusCode))
+		return
+	}
+
+	headers := w.header.Headers
+	if w.server.shuttingDown() { // this is the last response on the conn
+		headers["Connection"] = "close"
+	}
+	if !bodyAllowed(statusCode) {
+		delete(headers, "Transfer-Encoding")
+	} else if _, ok := headers["Content-Length"]; !ok && !w.headOnly {
+		if w.http10 { // closing the connection ends the body
+			headers["Connection"] = "close"
+		} else {
+			headers["Transfer-Encoding"] = "chunked"
+			w.chunked = true
+		}
+	}
+
+	headerString := headerToString(w.header)
+	w.server.debugLog("Sending response:\n", headerString)
+	w.conn.Write([]byte(headerString))
+}
+
+func (w *ResponseWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	if w.headOnly || !bodyAllowed(w.header.StatusCode) {
+		return len(data), nil
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	var err error
+	if w.stream != nil {
+		err = w.stream.write(data)
+	} else if w.chunked {
+		_, err = w.conn.Write([]byte(strconv.FormatInt(int64(len(data)), 16) + CRLF))
+		if err == nil {
+			_, err = w.conn.Write(data)
+		}
+		if err == nil {
+			_, err = w.conn.Write([]byte(CRLF))
+		}
+	} else {
+		_, err = w.conn.Write(data)
+	}
+	if err != nil {
+		return 0, err
+	}
+	w.written += int64(len(data))
+	return len(data), nil
+}
+
+// lets io.Copy hand the body straight to the connection, so a file sent
+// with a Content-Length over plain TCP goes out with sendfile
+func (w *ResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(200)
+	}
+	if w.stream != nil || w.chunked || w.headOnly || !bodyAllowed(w.header.StatusCode) {
+		return io.Copy(writerOnly{w}, r)
+	}
+	n, err := io.Copy(w.conn, r)
+	w.written += n
+	return n, err
+}
+
+// hides ReadFrom so io.Copy doesn't call it again
+type writerOnly struct {
+	io.Writer
+}
+
+// completes the response once the handler returns. a handler that wrote
+// nothing gets an empty 200.
+func (w *ResponseWriter) finish() {
+	if !w.wroteHeader {
+		if _, ok := w.header.Headers["Content-Length"]; !ok {
+			w.header.Headers["Content-Length"] = "0"
+		}
+		w.WriteHeader(200)
+	}
+	if w.stream != nil {
+		w.stream.end()
+	} else if w.chunked {
+		w.conn.Write([]byte("0" + CRLF + CRLF))
+	}
+}
+
+// gives up on a response whose status line is already out, cutting the
+// connection (or resetting the HTTP/2 stream) so the client knows it's
+// incomplete
+func (w *ResponseWriter) abort() {
+	w.Headers()["Connection"] = "close"
+	if w.stream != nil {
+		w.stream.abort()
+	} else {
+		w.conn.Close()
+	}
+}
+
+// whether the client should expect another response on this connection
+func (w *ResponseWriter) keepAlive() bool {
+	return !strings.EqualFold(w.header.Headers["Connection"], "close")
+}
+
+// informational, 204 and 304 responses never carry a body (RFC 7230 3.3.3)
+func bodyAllowed(statusCode int) bool {
+	return statusCode >= 200 && statusCode != 204 && statusCode != 304
+}
@@ -0,0 +1,488 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// every handshake's accept key is derived with this (RFC 6455 1.3)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// message types for ReadMessage and WriteMessage
+const (
+	WebSocketText	= 0x1
+	WebSocketBinary	= 0x2
+)
+
+// the other opcodes, these never reach the handler
+const (
+	wsContinuation	= 0x0
+	wsClose		= 0x8
+	wsPing		= 0x9
+	wsPong		= 0xa
+)
+
+// close codes (RFC 6455 7.4.1)
+const (
+	WebSocketCloseNormal		= 1000
+	WebSocketCloseGoingAway		= 1001
+	WebSocketCloseProtocolError	= 1002
+	WebSocketCloseUnsupportedData	= 1003
+	WebSocketCloseNoStatus		= 1005 // received without a code, never sent
+	WebSocketCloseInvalidPayload	= 1007
+	WebSocketClosePolicyViolation	= 1008
+	WebSocketCloseMessageTooBig	= 1009
+	WebSocketCloseInternalError	= 1011
+	WebSocketCloseTryAgainLater	= 1013
+)
+
+// largest message accepted unless the handler says otherwise
+const DefaultWebSocketMaxMessage = 1024*KB
+
+const (
+	wsWriteFrameSize	= 32*KB // longer messages are sent in fragments
+	wsCloseTimeout		= 2 * time.Second // for the client to answer our close
+)
+
+var ErrWebSocketClosed = errors.New("tritonhttp: WebSocket closed")
+
+// what ReadMessage returns once the connection is closing, with the code
+// and reason sent by whichever side closed it
+type WebSocketCloseError struct {
+	Code	int
+	Reason	string
+}
+
+func (e *WebSocketCloseError) Error() string {
+	return "WebSocket closed with " + strconv.Itoa(e.Code) + " " + e.Reason
+}
+
+/*
+A WebSocket connection (RFC 6455). Messages are read by one goroutine at a
+time, the handler's, but may be written from any number of them.
+*/
+type WebSocket struct {
+	conn		net.Conn
+	br		*bufio.Reader
+	protocol	string
+	maxMessage	int64
+	readTimeout	time.Duration // between frames, 0 for none
+	writeTimeout	time.Duration
+
+	writeMu		sync.Mutex
+	closeSent	bool // guarded by writeMu
+	closeReceived	bool // reader only
+	failed		bool // reader only, the client broke the protocol
+}
+
+// buffered is whatever the client sent after the handshake that we've
+// already read off conn
+func newWebSocket(conn net.Conn, buffered []byte, protocol string, maxMessage int64, writeTimeout time.Duration) *WebSocket {
+	conn.SetDeadline(time.Time{}) // whatever was left from the handshake
+	r := io.MultiReader(bytes.NewReader(buffered), conn)
+	return &WebSocket{conn: conn, br: bufio.NewReader(r), protocol: protocol,
+		maxMessage: maxMessage, writeTimeout: writeTimeout}
+}
+
+// the subprotocol agreed in the handshake, "" if none
+func (ws *WebSocket) Protocol() string {
+	return ws.protocol
+}
+
+func (ws *WebSocket) RemoteAddr() net.Addr {
+	return ws.conn.RemoteAddr()
+}
+
+/*
+Returns the next text or binary message, reassembled from its fragments.
+Pings are answered and pongs dropped along the way. Once the connection is
+closing it returns a *WebSocketCloseError
+	1. with the client's code when the client closed it, which we've answered
+	2. with ours when the client broke the protocol, which we've told it
+*/
+func (ws *WebSocket) ReadMessage() (int, []byte, error) {
+	var message []byte
+	messageType := 0
+	for {
+		fin, opcode, payload, err := ws.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case wsPing:
+			ws.writeFrame(true, wsPong, payload)
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			return 0, nil, ws.closeReceivedFrame(payload)
+		case wsContinuation:
+			if messageType == 0 {
+				return 0, nil, ws.fail(WebSocketCloseProtocolError, "Unexpected continuation")
+			}
+		case WebSocketText, WebSocketBinary:
+			if messageType != 0 {
+				return 0, nil, ws.fail(WebSocketCloseProtocolError, "Expected continuation")
+			}
+			messageType = opcode
+		default:
+			return 0, nil, ws.fail(WebSocketCloseProtocolError, "Unknown opcode")
+		}
+
+		if int64(len(message)+len(payload)) > ws.maxMessage {
+			return 0, nil, ws.fail(WebSocketCloseMessageTooBig, "Message too big")
+		}
+		message = append(message, payload...)
+		if fin {
+			if messageType == WebSocketText && !utf8.Valid(message) {
+				return 0, nil, ws.fail(WebSocketCloseInvalidPayload, "Invalid UTF-8")
+			}
+			return messageType, message, nil
+		}
+	}
+}
+
+/*
+Reads one frame and unmasks it (RFC 6455 5.2). Client frames have to be
+masked, control frames unfragmented and short, and with no extensions
+negotiated the RSV bits must be clear.
+*/
+func (ws *WebSocket) readFrame() (bool, int, []byte, error) {
+	if ws.readTimeout > 0 && !ws.closing() { // Close set its own
+		ws.conn.SetReadDeadline(time.Now().Add(ws.readTimeout))
+	}
+	var header [2]byte
+	if _, err := io.ReadFull(ws.br, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin, opcode := header[0]&0x80 != 0, int(header[0]&0x0f)
+	masked, length := header[1]&0x80 != 0, uint64(header[1]&0x7f)
+	if header[0]&0x70 != 0 || !masked {
+		return false, 0, nil, ws.fail(WebSocketCloseProtocolError, "Bad frame header")
+	}
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(ws.br, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode&0x8 != 0 && (!fin || length > 125) {
+		return false, 0, nil, ws.fail(WebSocketCloseProtocolError, "Bad control frame")
+	}
+	if length > uint64(ws.maxMessage) {
+		return false, 0, nil, ws.fail(WebSocketCloseMessageTooBig, "Message too big")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(ws.br, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.br, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+// answers the client's close frame with the same code (RFC 6455 5.5.1)
+func (ws *WebSocket) closeReceivedFrame(payload []byte) error {
+	ws.closeReceived = true
+	if len(payload) == 0 {
+		ws.sendClose(nil)
+		return &WebSocketCloseError{Code: WebSocketCloseNoStatus}
+	}
+
+	if len(payload) < 2 || !validCloseCode(int(binary.BigEndian.Uint16(payload))) {
+		return ws.fail(WebSocketCloseProtocolError, "Bad close code")
+	}
+	code, reason := int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+	if !utf8.ValidString(reason) {
+		return ws.fail(WebSocketCloseInvalidPayload, "Invalid UTF-8")
+	}
+	ws.sendClose(payload[:2])
+	return &WebSocketCloseError{Code: code, Reason: reason}
+}
+
+// codes a client may send, the reserved ones and those only meant to be
+// reported locally aren't
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	}
+	return code >= 3000 && code <= 4999
+}
+
+// closes with code after the client broke the protocol
+func (ws *WebSocket) fail(code int, reason string) error {
+	ws.failed = true
+	ws.Close(code, reason)
+	return &WebSocketCloseError{Code: code, Reason: reason}
+}
+
+/*
+Starts the close handshake. A ReadMessage blocked in another goroutine
+returns once the client answers, or after wsCloseTimeout if it doesn't.
+*/
+func (ws *WebSocket) Close(code int, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	if len(reason) > 123 { // control frames carry at most 125 bytes
+		reason = reason[:123]
+	}
+	err := ws.sendClose(append(payload, reason...))
+	ws.conn.SetReadDeadline(time.Now().Add(wsCloseTimeout))
+	return err
+}
+
+// whether we've sent our close frame
+func (ws *WebSocket) closing() bool {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	return ws.closeSent
+}
+
+func (ws *WebSocket) sendClose(payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	if ws.closeSent {
+		return nil
+	}
+	ws.closeSent = true
+	return ws.writeFrameLocked(true, wsClose, payload)
+}
+
+// sends a message, in fragments if it's long
+func (ws *WebSocket) WriteMessage(messageType int, data []byte) error {
+	if messageType != WebSocketText && messageType != WebSocketBinary {
+		return errors.New("Unknown message type " + strconv.Itoa(messageType))
+	}
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	if ws.closeSent {
+		return ErrWebSocketClosed
+	}
+	opcode := messageType
+	for {
+		chunk := data[:min(len(data), wsWriteFrameSize)]
+		data = data[len(chunk):]
+		if err := ws.writeFrameLocked(len(data) == 0, opcode, chunk); err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		opcode = wsContinuation
+	}
+}
+
+// asks for a pong, the client's answer only shows as the read deadline
+// being pushed back
+func (ws *WebSocket) Ping(data []byte) error {
+	return ws.writeFrame(true, wsPing, data)
+}
+
+func (ws *WebSocket) writeFrame(fin bool, opcode int, payload []byte) error {
+	ws.writeMu.Lock()
+	defer ws.writeMu.Unlock()
+	if ws.closeSent {
+		return ErrWebSocketClosed
+	}
+	return ws.writeFrameLocked(fin, opcode, payload)
+}
+
+// the caller holds writeMu. server frames aren't masked
+func (ws *WebSocket) writeFrameLocked(fin bool, opcode int, payload []byte) error {
+	first := byte(opcode)
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 127), uint64(n))
+	}
+
+	if ws.writeTimeout > 0 {
+		ws.conn.SetWriteDeadline(time.Now().Add(ws.writeTimeout))
+	}
+	_, err := ws.conn.Write(append(frame, payload...))
+	return err
+}
+
+// ends the connection once the handler is done with it, giving the client
+// a chance to answer our close
+func (ws *WebSocket) finish() {
+	ws.Close(WebSocketCloseNormal, "")
+	for !ws.closeReceived && !ws.failed {
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+/*
+Upgrades requests to WebSocket (RFC 6455 4.2) and hands the connection to
+Serve, it's closed when Serve returns. Mount it on the mux like any other
+handler, middleware sees the handshake request.
+*/
+type WebSocketHandler struct {
+	Serve		func(ws *WebSocket, requestHeader *HttpRequestHeader)
+	Protocols	[]string // subprotocols we speak, by preference
+	MaxMessageSize	int64
+	PingInterval	time.Duration // 0 for no pings, a client that misses two is dropped
+
+	// whether to accept a browser's cross-origin handshake, nil only
+	// allows an Origin on the same host as the request
+	CheckOrigin	func(origin string, requestHeader *HttpRequestHeader) bool
+}
+
+func NewWebSocketHandler(serve func(ws *WebSocket, requestHeader *HttpRequestHeader)) *WebSocketHandler {
+	return &WebSocketHandler{Serve: serve, MaxMessageSize: DefaultWebSocketMaxMessage}
+}
+
+/*
+Checks the handshake and switches protocols
+	1. 426 for a request that isn't asking to upgrade, or for a version
+	   other than 13
+	2. 400 for a missing or malformed key
+	3. 403 for an origin CheckOrigin turns down
+*/
+func (h *WebSocketHandler) ServeHTTP(w *ResponseWriter, requestHeader *HttpRequestHeader) {
+	headers := w.Headers()
+	if w.stream != nil || requestHeader.proto != "HTTP/1.1" ||
+		!requestHeader.hasToken("Upgrade", "websocket") || !requestHeader.hasToken("Connection", "Upgrade") {
+		headers["Upgrade"] = "websocket"
+		handleErrorResponse(w, 426)
+		return
+	}
+	if requestHeader.Header("Sec-WebSocket-Version") != "13" {
+		headers["Sec-WebSocket-Version"] = "13"
+		handleErrorResponse(w, 426)
+		return
+	}
+	key := requestHeader.Header("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		handleErrorResponse(w, 400)
+		return
+	}
+	checkOrigin := h.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if origin := requestHeader.Header("Origin"); origin != "" && !checkOrigin(origin, requestHeader) {
+		handleErrorResponse(w, 403)
+		return
+	}
+
+	protocol := ""
+	offered := requestHeader.HeaderValues("Sec-WebSocket-Protocol")
+	for _, p := range h.Protocols {
+		if protocol == "" && slices.Contains(offered, p) {
+			protocol = p
+		}
+	}
+
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	headers["Upgrade"] = "websocket"
+	headers["Connection"] = "Upgrade"
+	headers["Sec-WebSocket-Accept"] = base64.StdEncoding.EncodeToString(accept[:])
+	if protocol != "" {
+		headers["Sec-WebSocket-Protocol"] = protocol
+	}
+	w.WriteHeader(101)
+
+	maxMessage := h.MaxMessageSize
+	if maxMessage <= 0 {
+		maxMessage = DefaultWebSocketMaxMessage
+	}
+	var buffered []byte
+	if w.pending != nil {
+		buffered = []byte(w.pending.Read(w.pending.size))
+	}
+	ws := newWebSocket(w.conn, buffered, protocol, maxMessage, w.server.WriteTimeout)
+	if h.PingInterval > 0 {
+		ws.readTimeout = 2 * h.PingInterval
+		done := make(chan bool)
+		defer close(done)
+		go ws.keepAlive(h.PingInterval, done)
+	}
+	if !w.server.trackWebSocket(ws, true) {
+		ws.Close(WebSocketCloseGoingAway, "Server shutting down")
+		return
+	}
+	defer w.server.trackWebSocket(ws, false)
+
+	h.Serve(ws, requestHeader)
+	ws.finish()
+}
+
+// pings the client every interval until done
+func (ws *WebSocket) keepAlive(interval time.Duration, done chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if ws.Ping(nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+// whether origin names the host the request was sent to
+func sameOrigin(origin string, requestHeader *HttpRequestHeader) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, requestHeader.Header("Host"))
+}
+
+// adds or removes ws from the connections Shutdown closes, false if we're
+// already shutting down
+func (hs *HttpServer) trackWebSocket(ws *WebSocket, add bool) bool {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if !add {
+		delete(hs.webSockets, ws)
+		return true
+	}
+	if hs.inShutdown {
+		return false
+	}
+	if hs.webSockets == nil {
+		hs.webSockets = map[*WebSocket]bool{}
+	}
+	hs.webSockets[ws] = true
+	return true
+}
@@ -0,0 +1,383 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a client that speaks raw frames, so it can also send broken ones
+type wsTestClient struct {
+	t	*testing.T
+	conn	net.Conn
+	r	*bufio.Reader
+}
+
+// the handshake request for path, extra goes in as is
+func wsHandshake(path string, extra string) string {
+	return "GET " + path + " HTTP/1.1" + CRLF + "Host: localhost" + CRLF +
+		"Upgrade: websocket" + CRLF + "Connection: keep-alive, Upgrade" + CRLF +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==" + CRLF +
+		"Sec-WebSocket-Version: 13" + CRLF + extra + CRLF
+}
+
+// connects and upgrades, returning the 101's headers
+func dialWebSocket(t *testing.T, addr string, path string, extra string) (*wsTestClient, map[string]string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &wsTestClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	conn.Write([]byte(wsHandshake(path, extra)))
+
+	status, _ := c.r.ReadString('\n')
+	if !strings.HasPrefix(status, "HTTP/1.1 101 ") {
+		t.Fatalf("got %q", status)
+	}
+	headers := map[string]string{}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimRight(line, CRLF)
+		if line == "" {
+			return c, headers
+		}
+		kv := strings.SplitN(line, ": ", 2)
+		headers[kv[0]] = kv[1]
+	}
+}
+
+// sends a masked frame
+func (c *wsTestClient) send(fin bool, opcode int, payload []byte) {
+	first := byte(opcode)
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(len(payload)))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 0x80|127), uint64(len(payload)))
+	}
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// reads the next frame from the server, which mustn't be masked
+func (c *wsTestClient) read() (bool, int, []byte) {
+	c.t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if header[1]&0x80 != 0 {
+		c.t.Fatal("server frame is masked")
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.r, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.r, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.r, payload); err != nil {
+		c.t.Fatal(err)
+	}
+	return header[0]&0x80 != 0, int(header[0] & 0x0f), payload
+}
+
+// reads frames until a close and returns its code
+func (c *wsTestClient) expectClose(want int) {
+	c.t.Helper()
+	for {
+		_, opcode, payload := c.read()
+		if opcode != wsClose {
+			continue
+		}
+		if len(payload) < 2 || int(binary.BigEndian.Uint16(payload)) != want {
+			c.t.Fatalf("closed with %x, want %d", payload, want)
+		}
+		return
+	}
+}
+
+func closePayload(code int, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+// a server with an echo endpoint at /echo
+func newEchoServer(t *testing.T) (*HttpServer, string) {
+	hs := newTestServer(t)
+	echo := NewWebSocketHandler(func(ws *WebSocket, requestHeader *HttpRequestHeader) {
+		for {
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(messageType, data)
+		}
+	})
+	echo.Protocols = []string{"echo", "chat"}
+	echo.MaxMessageSize = 64 * KB
+	hs.Mux.Handle("/echo", echo, "GET")
+	return hs, serveTest(t, hs, nil)
+}
+
+func TestWebSocketHandshake(t *testing.T) {
+	_, addr := newEchoServer(t)
+
+	// RFC 6455 1.3
+	_, headers := dialWebSocket(t, addr, "/echo", "Sec-WebSocket-Protocol: chat, echo"+CRLF)
+	if headers["Sec-WebSocket-Accept"] != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("accept %q", headers["Sec-WebSocket-Accept"])
+	}
+	if headers["Sec-WebSocket-Protocol"] != "echo" || headers["Upgrade"] != "websocket" {
+		t.Errorf("headers %v", headers)
+	}
+
+	bad := map[string]struct {
+		request	string
+		status	string
+	}{
+		"not an upgrade": {"GET /echo HTTP/1.1" + CRLF + "Host: localhost" + CRLF + "Connection: close" + EoR, "426"},
+		"old version": {wsHandshake("/echo", "Sec-WebSocket-Version: 8"+CRLF+"Connection: close"+CRLF), "426"},
+		"short key": {strings.Replace(wsHandshake("/echo", ""), "dGhlIHNhbXBsZSBub25jZQ==", "c2hvcnQ=", 1), "400"},
+		"cross origin": {wsHandshake("/echo", "Origin: http://evil.example"+CRLF), "403"},
+	}
+	for name, tc := range bad {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, _, _ := roundTrip(t, conn, tc.request)
+		if !strings.Contains(status, " "+tc.status+" ") {
+			t.Errorf("%s: got %q, want %s", name, status, tc.status)
+		}
+		conn.Close()
+	}
+}
+
+func TestWebSocketEcho(t *testing.T) {
+	_, addr := newEchoServer(t)
+	c, _ := dialWebSocket(t, addr, "/echo", "")
+
+	c.send(true, WebSocketText, []byte("hello"))
+	if _, opcode, payload := c.read(); opcode != WebSocketText || string(payload) != "hello" {
+		t.Errorf("got %d %q", opcode, payload)
+	}
+
+	// fragmented, with a ping in between
+	c.send(false, WebSocketBinary, []byte("frag"))
+	c.send(true, wsPing, []byte("are you there"))
+	c.send(true, wsContinuation, []byte("mented"))
+	if _, opcode, payload := c.read(); opcode != wsPong || string(payload) != "are you there" {
+		t.Errorf("got %d %q, want the pong", opcode, payload)
+	}
+	if _, opcode, payload := c.read(); opcode != WebSocketBinary || string(payload) != "fragmented" {
+		t.Errorf("got %d %q", opcode, payload)
+	}
+
+	// longer than a frame both ways, it comes back in fragments
+	long := []byte(strings.Repeat("0123456789", 5000))
+	c.send(true, WebSocketBinary, long)
+	var echoed []byte
+	for {
+		fin, _, payload := c.read()
+		echoed = append(echoed, payload...)
+		if fin {
+			break
+		}
+	}
+	if string(echoed) != string(long) {
+		t.Errorf("got %d bytes back, sent %d", len(echoed), len(long))
+	}
+
+	c.send(true, wsClose, closePayload(WebSocketCloseNormal, "bye"))
+	c.expectClose(WebSocketCloseNormal)
+	if _, err := c.r.ReadByte(); err != io.EOF {
+		t.Errorf("connection still open: %v", err)
+	}
+}
+
+func TestWebSocketProtocolErrors(t *testing.T) {
+	_, addr := newEchoServer(t)
+	cases := map[string]struct {
+		send	func(c *wsTestClient)
+		code	int
+	}{
+		"unmasked": {func(c *wsTestClient) { c.conn.Write([]byte{0x81, 0x02, 'h', 'i'}) }, WebSocketCloseProtocolError},
+		"rsv bit": {func(c *wsTestClient) { c.send(true, WebSocketText|0x40, []byte("hi")) }, WebSocketCloseProtocolError},
+		"fragmented ping": {func(c *wsTestClient) { c.send(false, wsPing, nil) }, WebSocketCloseProtocolError},
+		"bare continuation": {func(c *wsTestClient) { c.send(true, wsContinuation, []byte("x")) }, WebSocketCloseProtocolError},
+		"bad utf-8": {func(c *wsTestClient) { c.send(true, WebSocketText, []byte{0xff, 0xfe}) }, WebSocketCloseInvalidPayload},
+		"too big": {func(c *wsTestClient) { c.send(true, WebSocketBinary, make([]byte, 65*KB)) }, WebSocketCloseMessageTooBig},
+		"bad close code": {func(c *wsTestClient) { c.send(true, wsClose, closePayload(1005, "")) }, WebSocketCloseProtocolError},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			c, _ := dialWebSocket(t, addr, "/echo", "")
+			tc.send(c)
+			c.expectClose(tc.code)
+		})
+	}
+}
+
+// the handshake and the first frame arriving in one packet
+func TestWebSocketFrameWithHandshake(t *testing.T) {
+	_, addr := newEchoServer(t)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &wsTestClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	frame := []byte{0x81, 0x82, 0, 0, 0, 0, 'h', 'i'} // masked with zeros
+	conn.Write(append([]byte(wsHandshake("/echo", "")), frame...))
+
+	for line, _ := c.r.ReadString('\n'); line != CRLF; line, _ = c.r.ReadString('\n') {
+		if line == "" {
+			t.Fatal("no handshake response")
+		}
+	}
+	if _, _, payload := c.read(); string(payload) != "hi" {
+		t.Errorf("got %q", payload)
+	}
+}
+
+func TestWebSocketShutdown(t *testing.T) {
+	hs, addr := newEchoServer(t)
+	c, _ := dialWebSocket(t, addr, "/echo", "")
+	c.send(true, WebSocketText, []byte("hello"))
+	c.read()
+
+	done := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- hs.Shutdown(ctx)
+	}()
+	c.expectClose(WebSocketCloseGoingAway)
+	c.send(true, wsClose, closePayload(WebSocketCloseGoingAway, ""))
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestChangesFeed(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte("hello"), 0644)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	hs, err := NewHttpdServer("", dir, "../mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.WatchPollInterval = 50 * time.Millisecond
+	hs.Mux.Handle("/changes", hs.ChangesHandler(), "GET")
+	addr := serveTest(t, hs, nil)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		hs.Shutdown(ctx)
+	})
+
+	c, _ := dialWebSocket(t, addr, "/changes", "")
+	time.Sleep(100 * time.Millisecond) // for the watcher's first scan
+	os.WriteFile(filepath.Join(dir, "sub", "new.html"), []byte("new"), 0644)
+	for {
+		_, opcode, payload := c.read()
+		if opcode != WebSocketText {
+			t.Fatalf("got opcode %d", opcode)
+		}
+		if string(payload) == `{"path":"/sub/new.html"}` {
+			break
+		}
+	}
+
+	c.send(true, wsClose, closePayload(WebSocketCloseNormal, ""))
+	c.expectClose(WebSocketCloseNormal)
+}
+
+func TestChangesFeedFiltered(t *testing.T) {
+	dir, blogDir := t.TempDir(), t.TempDir()
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	os.Mkdir(filepath.Join(dir, "subdir1"), 0755)
+	hs, err := NewHttpdServer("", dir, "../mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blog, err := NewVirtualHost("blog", []string{"blog.example.com"}, blogDir, "../mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.VirtualHosts = []*VirtualHost{blog}
+	hs.AuthRules = []*AuthRule{newTestAuthRule(t, true, false)}
+	hs.WatchPollInterval = 50 * time.Millisecond
+	hs.Mux.Handle("/changes", hs.ChangesHandler(), "GET")
+	hs.Mux.Handle("/subdir1/changes", hs.ChangesHandler(), "GET")
+	addr := serveTest(t, hs, nil)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		hs.Shutdown(ctx)
+	})
+
+	anonymous, _ := dialWebSocket(t, addr, "/changes", "")
+	private, _ := dialWebSocket(t, addr, "/subdir1/changes",
+		"Authorization: "+basicCredentials("alice", "secret")+CRLF)
+	time.Sleep(100 * time.Millisecond) // for the watcher's first scan
+	for _, name := range []string{filepath.Join(blogDir, "post.html"), filepath.Join(dir, ".htpasswd"),
+		filepath.Join(dir, "sub", ".upload-123"), filepath.Join(dir, "subdir1", "secret.html")} {
+		os.WriteFile(name, []byte("x"), 0644)
+	}
+	time.Sleep(200 * time.Millisecond) // so the last one comes after them
+	os.WriteFile(filepath.Join(dir, "sub", "last.html"), []byte("x"), 0644)
+
+	// a file may be reported more than once, but nothing else may show up
+	// before the last one
+	cases := []struct {
+		c	*wsTestClient
+		want	string
+	}{
+		{anonymous, `{"path":"/sub/last.html"}`},
+		{private, `{"path":"/subdir1/secret.html"} {"path":"/sub/last.html"}`},
+	}
+	for _, tc := range cases {
+		var got []string
+		for len(got) == 0 || got[len(got)-1] != `{"path":"/sub/last.html"}` {
+			_, _, payload := tc.c.read()
+			if len(got) == 0 || got[len(got)-1] != string(payload) {
+				got = append(got, string(payload))
+			}
+		}
+		if strings.Join(got, " ") != tc.want {
+			t.Errorf("got %s, want %s", got, tc.want)
+		}
+	}
+}
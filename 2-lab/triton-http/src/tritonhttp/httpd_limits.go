@@ -0,0 +1,83 @@
+package tritonhttp
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// forget clients that have been quiet this long, their bucket is full again
+const rateLimiterIdle = 10 * time.Minute
+
+// a token bucket, refilled at the limiter's rate up to its burst size
+type tokenBucket struct {
+	tokens		float64
+	lastRefill	time.Time
+}
+
+// per client IP token buckets, every request takes one token
+type rateLimiter struct {
+	mu		sync.Mutex
+	rate		float64 // tokens added per second
+	burst		float64 // bucket size
+	buckets		map[string]*tokenBucket
+	lastSweep	time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst),
+		buckets: map[string]*tokenBucket{}, lastSweep: time.Now()}
+}
+
+// takes a token for ip. if there's none left it returns false and the
+// number of seconds until there will be.
+func (rl *rateLimiter) allow(ip string, now time.Time) (bool, int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) > rateLimiterIdle {
+		for key, b := range rl.buckets {
+			if now.Sub(b.lastRefill) > rateLimiterIdle {
+				delete(rl.buckets, key)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, lastRefill: now}
+		rl.buckets[ip] = b
+	}
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.lastRefill).Seconds()*rl.rate)
+	b.lastRefill = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, int(math.Ceil((1 - b.tokens) / rl.rate))
+}
+
+// applies RateLimit to the client on conn, always true if it's not set
+func (hs *HttpServer) allowRequest(conn net.Conn) (bool, int) {
+	hs.mu.Lock()
+	if hs.limiter == nil && hs.active.RateLimit > 0 {
+		hs.limiter = newRateLimiter(hs.active.RateLimit, hs.active.RateBurst)
+	}
+	limiter := hs.limiter
+	hs.mu.Unlock()
+	if limiter == nil {
+		return true, 0
+	}
+
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		ip = conn.RemoteAddr().String()
+	}
+	return limiter.allow(ip, time.Now())
+}
@@ -0,0 +1,185 @@
+package tritonhttp
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const limitsRequest = "GET /index.html HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"
+
+func TestRateLimit(t *testing.T) {
+	hs := newTestServer(t)
+	hs.RateLimit = 0.01
+	hs.RateBurst = 2
+	addr := serveTest(t, hs, nil)
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		if status, _, _ := roundTrip(t, conn, limitsRequest); status != "HTTP/1.1 200 OK" {
+			t.Fatalf("request %d got %q, want 200", i+1, status)
+		}
+	}
+	status, headers, _ := roundTrip(t, conn, limitsRequest)
+	if status != "HTTP/1.1 429 Too Many Requests" {
+		t.Fatalf("got %q, want 429", status)
+	}
+	if headers["Retry-After"] != "100" {
+		t.Errorf("Retry-After is %q, want 100", headers["Retry-After"])
+	}
+
+	// the connection stays usable, it's the client that is limited
+	if status, _, _ := roundTrip(t, conn, limitsRequest); status != "HTTP/1.1 429 Too Many Requests" {
+		t.Errorf("got %q, want 429", status)
+	}
+}
+
+func TestTokenBucketRefills(t *testing.T) {
+	rl := newRateLimiter(1, 1)
+	now := time.Now()
+	if ok, _ := rl.allow("10.0.0.1", now); !ok {
+		t.Fatal("first request was limited")
+	}
+	if ok, retry := rl.allow("10.0.0.1", now); ok || retry != 1 {
+		t.Fatalf("got %v, %d; want limited with Retry-After 1", ok, retry)
+	}
+	if ok, _ := rl.allow("10.0.0.2", now); !ok {
+		t.Error("another client was limited")
+	}
+	if ok, _ := rl.allow("10.0.0.1", now.Add(time.Second)); !ok {
+		t.Error("bucket did not refill after a second")
+	}
+}
+
+func TestMaxRequestsPerConn(t *testing.T) {
+	hs := newTestServer(t)
+	hs.MaxRequestsPerConn = 2
+	addr := serveTest(t, hs, nil)
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, headers, _ := roundTrip(t, conn, limitsRequest); headers["Connection"] == "close" {
+		t.Fatal("first response closed the connection")
+	}
+	if _, headers, _ := roundTrip(t, conn, limitsRequest); headers["Connection"] != "close" {
+		t.Fatal("second response did not close the connection")
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("got %d more bytes, want the connection closed", n)
+	}
+}
+
+func TestMaxConns(t *testing.T) {
+	hs := newTestServer(t)
+	hs.MaxConns = 1
+	addr := serveTest(t, hs, nil)
+
+	first, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	roundTrip(t, first, limitsRequest)
+
+	// the second client sits in the backlog until the first one leaves
+	second, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	second.Write([]byte(limitsRequest))
+	second.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, err := second.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("second connection got %d bytes while the first was open", n)
+	}
+
+	first.Close()
+	if status, _, _ := roundTrip(t, second, ""); status != "HTTP/1.1 200 OK" {
+		t.Errorf("got %q, want 200 once the first connection closed", status)
+	}
+}
+
+func TestIdleAndHeaderTimeouts(t *testing.T) {
+	hs := newTestServer(t)
+	hs.IdleTimeout = 100 * time.Millisecond
+	hs.HeaderTimeout = 100 * time.Millisecond
+	addr := serveTest(t, hs, nil)
+
+	// an idle connection is closed without a response
+	idle, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := idle.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Fatalf("idle connection got %d bytes, %v", n, err)
+	}
+
+	// a header that never finishes gets a 400
+	partial, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer partial.Close()
+	if status, _, _ := roundTrip(t, partial, "GET /index.html HTTP/1.1\r\n"); status != "HTTP/1.1 400 Bad Request" {
+		t.Errorf("got %q, want 400", status)
+	}
+}
+
+func TestMaxHeaderSize(t *testing.T) {
+	hs := newTestServer(t)
+	hs.MaxHeaderSize = 128
+	addr := serveTest(t, hs, nil)
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := "GET /index.html HTTP/1.1\r\nHost: 127.0.0.1\r\nX-Long: " + strings.Repeat("a", 200) + "\r\n\r\n"
+	if status, _, _ := roundTrip(t, conn, request); status != "HTTP/1.1 400 Bad Request" {
+		t.Errorf("got %q, want 400", status)
+	}
+}
+
+// 0 turns a limit off, it mustn't drop every request
+func TestZeroLimits(t *testing.T) {
+	cases := map[string]func(hs *HttpServer){
+		"max header size":	func(hs *HttpServer) { hs.MaxHeaderSize = 0 },
+		"idle timeout":		func(hs *HttpServer) { hs.IdleTimeout = 0 },
+		"header timeout":	func(hs *HttpServer) { hs.HeaderTimeout = 0 },
+		"read timeout":		func(hs *HttpServer) { hs.ReadTimeout = 0 },
+	}
+	for name, zero := range cases {
+		hs := newTestServer(t)
+		zero(hs)
+		addr := serveTest(t, hs, nil)
+
+		conn, err := net.Dial("tcp4", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		// a pause before the request, in the header and before the body
+		for _, part := range []string{"GET /index.html HTTP/1.1\r\n",
+			"Host: 127.0.0.1\r\nContent-Length: 5\r\n\r\n", "hello"} {
+			time.Sleep(20 * time.Millisecond)
+			conn.Write([]byte(part))
+		}
+		if status, _, _ := roundTrip(t, conn, ""); status != "HTTP/1.1 200 OK" {
+			t.Errorf("%s: got %q, want 200", name, status)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package tritonhttp
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"html/template"
+	"log"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// a map diff lists this many keys, then just counts the rest
+const maxListedChanges = 10
+
+/*
+Makes next the server's configuration. Connections accepted from now on
+are served by next, the ones already open keep the configuration they
+started with until they close. next is built like the running server (by
+NewHttpdServer and the config file) but not started, it takes over the
+listeners, connections and caches. In order
+	1. next is checked: the settings the listeners were opened with can't
+	   change, and every doc root has to be a directory
+	2. auth rules that were there before keep their Digest nonces, the
+	   handlers Start would mount (metrics, change feed, WebDAV) are
+	   mounted on next's Mux, and the admin port switches to next's paths
+	3. next becomes active, caches whose settings changed are dropped and
+	   the doc root watcher follows the roots
+Returns what changed, one line per setting, and logs it. If next is
+refused nothing changes.
+*/
+func (hs *HttpServer) Reload(next *HttpServer) ([]string, error) {
+	hs.reloadMu.Lock()
+	defer hs.reloadMu.Unlock()
+
+	cur := hs.current()
+	if err := cur.checkReload(next); err != nil {
+		return nil, err
+	}
+	if next.Loader == nil {
+		next.Loader = cur.Loader
+	}
+	keepDigestNonces(cur, next)
+	next.mountBuiltins()
+	changes := diffConfig(cur, next)
+
+	hs.mu.Lock()
+	if hs.inShutdown {
+		hs.mu.Unlock()
+		return nil, ErrServerClosed
+	}
+	next.serverState = hs.serverState
+	hs.active = next
+	if next.RateLimit != cur.RateLimit || next.RateBurst != cur.RateBurst {
+		hs.limiter = nil
+	}
+	if next.FileCacheSize != cur.FileCacheSize && hs.fileCache != nil {
+		hs.fileCache.clear()
+		hs.fileCache = nil
+	}
+	rootsMoved := !reflect.DeepEqual(next.docRoots(), cur.docRoots()) ||
+		next.WatchPollInterval != cur.WatchPollInterval
+	// cache hits are served before the symlink policy is checked, so a
+	// new policy has to start from an empty cache
+	if rootsMoved || next.ContentCacheSize != cur.ContentCacheSize ||
+		next.ContentCacheMaxFile != cur.ContentCacheMaxFile || next.SymlinkPolicy != cur.SymlinkPolicy {
+		hs.contentCache = nil // the next request starts a new one
+	}
+	if rootsMoved && hs.watcher != nil {
+		hs.watcher.Close()
+		hs.watcher = nil
+		if len(hs.changeSubs) > 0 {
+			hs.watchDocRootsLocked()
+		}
+	}
+	admin := hs.admin
+	hs.mu.Unlock()
+
+	if admin != nil {
+		nextAdmin := newAdminServer(next)
+		admin.mu.Lock()
+		nextAdmin.serverState = admin.serverState
+		admin.active = nextAdmin
+		admin.mu.Unlock()
+	}
+
+	if len(changes) == 0 {
+		log.Println("Reloaded configuration, nothing changed")
+	} else {
+		log.Println("Reloaded configuration:")
+	}
+	for _, change := range changes {
+		log.Println("  " + change)
+	}
+	return changes, nil
+}
+
+/*
+Builds the next configuration with Loader and swaps it in with Reload,
+e.g. when the config file has changed
+*/
+func (hs *HttpServer) ReloadConfig() ([]string, error) {
+	loader := hs.current().Loader
+	if loader == nil {
+		return nil, errors.New("No Loader to reload the configuration with")
+	}
+	next, err := loader()
+	if err != nil {
+		return nil, err
+	}
+	return hs.Reload(next)
+}
+
+// reloads the configuration on a POST and answers with what changed,
+// newAdminServer mounts it at ReloadPath
+func (hs *HttpServer) ReloadHandler() Handler {
+	return HandlerFunc(func(w *ResponseWriter, requestHeader *HttpRequestHeader) {
+		status := 200
+		changes, err := hs.ReloadConfig()
+		body := strings.Join(changes, "\n") + "\n"
+		if err != nil {
+			log.Println("Reload failed:", err)
+			status, body = 500, "Reload failed: "+err.Error()+"\n"
+		} else if len(changes) == 0 {
+			body = "No changes\n"
+		}
+		w.Headers()["Content-Type"] = "text/plain; charset=utf-8"
+		w.Headers()["Content-Length"] = strconv.Itoa(len(body))
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	})
+}
+
+// hands each of next's auth rules the nonces of the rule in cur for the
+// same site and prefix, so Digest clients don't have to start over
+func keepDigestNonces(cur *HttpServer, next *HttpServer) {
+	byKey := map[string]*AuthRule{}
+	for _, rule := range cur.AuthRules {
+		byKey[rule.key()] = rule
+	}
+	for _, rule := range next.AuthRules {
+		if old, ok := byKey[rule.key()]; ok {
+			rule.nonces = old.nonces
+		}
+	}
+}
+
+// why next can't replace hs, nil if it can
+func (hs *HttpServer) checkReload(next *HttpServer) error {
+	switch {
+	case next == nil || next.Mux == nil:
+		return errors.New("Reload needs a server made by NewHttpdServer")
+	case next.ServerPort != hs.ServerPort || next.TLSPort != hs.TLSPort || next.MetricsPort != hs.MetricsPort:
+		return errors.New("Changing ports needs a restart")
+	case next.CertFile != hs.CertFile || next.KeyFile != hs.KeyFile ||
+		next.TLSMinVersion != hs.TLSMinVersion || next.DisableHTTP2 != hs.DisableHTTP2:
+		return errors.New("Changing TLS or HTTP/2 settings needs a restart")
+	case next.MaxConns != hs.MaxConns:
+		return errors.New("Changing max_conns needs a restart")
+	case next.hasAdminServer() != hs.hasAdminServer():
+		return errors.New("Turning the admin port on or off needs a restart")
+	}
+
+	for _, root := range next.docRoots() {
+		info, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return errors.New("Doc root " + root + " is not a directory")
+		}
+	}
+	if next.DefaultHost != "" {
+		for _, vhost := range next.VirtualHosts {
+			if vhost.Name == next.DefaultHost {
+				return nil
+			}
+		}
+		return errors.New("No virtual host named " + next.DefaultHost)
+	}
+	return nil
+}
+
+/*
+What differs between two configurations, as "Setting: old -> new" lines.
+Every exported setting is compared, maps key by key, virtual hosts by
+name, auth rules by site and prefix and the Mux by its routes. Functions
+can't be compared and are left out.
+*/
+func diffConfig(cur *HttpServer, next *HttpServer) []string {
+	return diffFields("", reflect.ValueOf(cur).Elem(), reflect.ValueOf(next).Elem())
+}
+
+func diffFields(prefix string, cur reflect.Value, next reflect.Value) []string {
+	var changes []string
+	for i := 0; i < cur.NumField(); i++ {
+		field := cur.Type().Field(i)
+		if !field.IsExported() || field.Anonymous {
+			continue
+		}
+		name := prefix + field.Name
+		a, b := cur.Field(i), next.Field(i)
+		switch v := a.Interface().(type) {
+		case map[string]string:
+			changes = append(changes, diffMap(name, v, b.Interface().(map[string]string))...)
+		case []*VirtualHost:
+			changes = append(changes, diffVirtualHosts(name, v, b.Interface().([]*VirtualHost))...)
+		case []*AuthRule:
+			changes = append(changes, diffAuthRules(name, v, b.Interface().([]*AuthRule))...)
+		case map[int]*template.Template:
+			changes = append(changes, diffMap(name, describeErrorPages(v),
+				describeErrorPages(b.Interface().(map[int]*template.Template)))...)
+		case *ServeMux:
+			changes = append(changes, diffMap(name, v.describeRoutes(), b.Interface().(*ServeMux).describeRoutes())...)
+		default:
+			switch {
+			case a.Kind() == reflect.Func:
+			case a.Kind() == reflect.Interface: // e.g. the access log, only its identity means anything
+				if a.Interface() != b.Interface() {
+					changes = append(changes, name+": changed")
+				}
+			case !reflect.DeepEqual(a.Interface(), b.Interface()):
+				changes = append(changes, name+": "+formatSetting(a)+" -> "+formatSetting(b))
+			}
+		}
+	}
+	return changes
+}
+
+func formatSetting(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return strconv.Quote(v.String())
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// keys added, removed and changed, in order, or just how many if there are
+// too many to list
+func diffMap(name string, cur map[string]string, next map[string]string) []string {
+	var changes []string
+	added, removed, changed := 0, 0, 0
+	for key, value := range next {
+		old, ok := cur[key]
+		switch {
+		case !ok:
+			added++
+			changes = append(changes, name+"["+key+"]: added "+strconv.Quote(value))
+		case old != value:
+			changed++
+			changes = append(changes, name+"["+key+"]: "+strconv.Quote(old)+" -> "+strconv.Quote(value))
+		}
+	}
+	for key := range cur {
+		if _, ok := next[key]; !ok {
+			removed++
+			changes = append(changes, name+"["+key+"]: removed")
+		}
+	}
+	if len(changes) > maxListedChanges {
+		return []string{fmt.Sprintf("%s: %d added, %d removed, %d changed", name, added, removed, changed)}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+func diffVirtualHosts(name string, cur []*VirtualHost, next []*VirtualHost) []string {
+	var changes []string
+	byName := map[string]*VirtualHost{}
+	for _, vhost := range cur {
+		byName[vhost.Name] = vhost
+	}
+	for _, vhost := range next {
+		old, ok := byName[vhost.Name]
+		delete(byName, vhost.Name)
+		if !ok {
+			changes = append(changes, name+"["+vhost.Name+"]: added")
+			continue
+		}
+		changes = append(changes, diffFields(name+"["+vhost.Name+"].",
+			reflect.ValueOf(old).Elem(), reflect.ValueOf(vhost).Elem())...)
+	}
+	for _, vhost := range cur {
+		if _, ok := byName[vhost.Name]; ok {
+			changes = append(changes, name+"["+vhost.Name+"]: removed")
+		}
+	}
+	return changes
+}
+
+// the rules' users are compared too, but not shown
+func diffAuthRules(name string, cur []*AuthRule, next []*AuthRule) []string {
+	var changes []string
+	byKey := map[string]*AuthRule{}
+	for _, rule := range cur {
+		byKey[rule.key()] = rule
+	}
+	for _, rule := range next {
+		old, ok := byKey[rule.key()]
+		delete(byKey, rule.key())
+		if !ok {
+			changes = append(changes, name+"["+rule.key()+"]: added")
+			continue
+		}
+		changes = append(changes, diffFields(name+"["+rule.key()+"].",
+			reflect.ValueOf(old).Elem(), reflect.ValueOf(rule).Elem())...)
+		if !reflect.DeepEqual(old.users, rule.users) || !reflect.DeepEqual(old.digestUsers, rule.digestUsers) {
+			changes = append(changes, name+"["+rule.key()+"]: users changed")
+		}
+	}
+	for _, rule := range cur {
+		if _, ok := byKey[rule.key()]; ok {
+			changes = append(changes, name+"["+rule.key()+"]: removed")
+		}
+	}
+	return changes
+}
+
+// each error page's file and a checksum of its template, by status code
+func describeErrorPages(pages map[int]*template.Template) map[string]string {
+	described := map[string]string{}
+	for statusCode, tmpl := range pages {
+		sum := crc32.ChecksumIEEE([]byte(tmpl.Tree.Root.String()))
+		described[strconv.Itoa(statusCode)] = tmpl.Name() + "#" + strconv.FormatUint(uint64(sum), 16)
+	}
+	return described
+}
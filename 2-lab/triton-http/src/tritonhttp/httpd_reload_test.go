@@ -0,0 +1,284 @@
+package tritonhttp
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a doc root with index.html holding body and a.xyz, and a MIME table
+// mapping .xyz to xyzType
+func newReloadRoot(t *testing.T, body string, xyzType string) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "index.html"), []byte(body), 0644)
+	os.WriteFile(filepath.Join(dir, "a.xyz"), []byte("xyz"), 0644)
+	mimePath := filepath.Join(t.TempDir(), "mime.types")
+	os.WriteFile(mimePath, []byte("# test types\n.html text/html\n\n.xyz "+xyzType+"\n"), 0644)
+	return dir, mimePath
+}
+
+func getKeepAlive(t *testing.T, conn net.Conn, path string) (string, map[string]string, string) {
+	t.Helper()
+	return roundTrip(t, conn, "GET "+path+" HTTP/1.1"+CRLF+"Host: localhost"+CRLF+CRLF)
+}
+
+func TestReloadSwapsConfiguration(t *testing.T) {
+	oldRoot, oldMIME := newReloadRoot(t, "old", "text/x-old")
+	hs, err := NewHttpdServer("", oldRoot, oldMIME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTest(t, hs, nil)
+
+	before, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Close()
+	if _, _, body := getKeepAlive(t, before, "/"); body != "old" {
+		t.Fatalf("got %q", body)
+	}
+
+	newRoot, newMIME := newReloadRoot(t, "new", "text/x-new")
+	next, err := NewHttpdServer("", newRoot, newMIME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := hs.Reload(next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{`DocRoot: "` + oldRoot + `" -> "` + newRoot + `"`,
+		`MIMEMap[.xyz]: "text/x-old" -> "text/x-new"`}
+	for _, line := range want {
+		if !strings.Contains(strings.Join(changes, "\n"), line) {
+			t.Errorf("%q missing from %q", line, changes)
+		}
+	}
+
+	// the open connection finishes on the old configuration
+	if _, headers, body := getKeepAlive(t, before, "/a.xyz"); body != "xyz" || headers["Content-Type"] != "text/x-old" {
+		t.Errorf("open connection got %q as %q", body, headers["Content-Type"])
+	}
+	after, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer after.Close()
+	if _, _, body := getKeepAlive(t, after, "/"); body != "new" {
+		t.Errorf("new connection got %q", body)
+	}
+	if _, headers, _ := getKeepAlive(t, after, "/a.xyz"); headers["Content-Type"] != "text/x-new" {
+		t.Errorf("new connection got %q", headers["Content-Type"])
+	}
+
+	// both are still tracked, so Shutdown waits for them
+	hs.mu.Lock()
+	open := len(hs.conns)
+	hs.mu.Unlock()
+	if hs.current() != next || open != 2 {
+		t.Errorf("active %p, want %p, %d connections", hs.current(), next, open)
+	}
+}
+
+func TestReloadRefused(t *testing.T) {
+	root, mimePath := newReloadRoot(t, "old", "text/x-old")
+	hs, err := NewHttpdServer("8080", root, mimePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]func(next *HttpServer){
+		"port":			func(next *HttpServer) { next.ServerPort = "8081" },
+		"TLS port":		func(next *HttpServer) { next.TLSPort = "8443" },
+		"max conns":		func(next *HttpServer) { next.MaxConns = 10 },
+		"missing doc root":	func(next *HttpServer) { next.DocRoot = filepath.Join(root, "missing") },
+		"file doc root":	func(next *HttpServer) { next.DocRoot = filepath.Join(root, "index.html") },
+		"default host":		func(next *HttpServer) { next.DefaultHost = "nobody" },
+		"admin port":		func(next *HttpServer) { next.MetricsPort, next.ReloadPath = "9090", "/reload" },
+	}
+	for name, change := range cases {
+		next, _ := NewHttpdServer("8080", root, mimePath)
+		change(next)
+		if _, err := hs.Reload(next); err == nil {
+			t.Errorf("%s: reloaded", name)
+		}
+		if hs.current() != hs {
+			t.Fatalf("%s: swapped in a refused configuration", name)
+		}
+	}
+
+	os.WriteFile(mimePath, []byte(".html text/html\n.broken\n"), 0644)
+	if _, err := NewHttpdServer("8080", root, mimePath); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("broken MIME table: got %v", err)
+	}
+}
+
+func TestReloadHandler(t *testing.T) {
+	root, mimePath := newReloadRoot(t, "old", "text/x-old")
+	hs, err := NewHttpdServer("", root, mimePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.Mux.Handle("/-/reload", hs.ReloadHandler(), "POST")
+	addr := serveTest(t, hs, nil)
+
+	post := func() (string, string) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		status, _, body := roundTrip(t, conn, "POST /-/reload HTTP/1.1"+CRLF+"Host: localhost"+CRLF+
+			"Content-Length: 0"+CRLF+"Connection: close"+CRLF+CRLF)
+		return status, body
+	}
+
+	if status, body := post(); !strings.Contains(status, " 500 ") || !strings.Contains(body, "Loader") {
+		t.Errorf("without a Loader: got %q %q", status, body)
+	}
+
+	var loadErr error
+	hs.Loader = func() (*HttpServer, error) {
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		next, err := NewHttpdServer("", root, mimePath)
+		if err == nil {
+			next.AutoIndex = true
+			next.Mux.Handle("/-/reload", next.ReloadHandler(), "POST")
+		}
+		return next, err
+	}
+	if status, body := post(); !strings.Contains(status, " 200 ") || body != "AutoIndex: false -> true\n" {
+		t.Errorf("got %q %q", status, body)
+	}
+	// the next configuration keeps the Loader
+	if status, body := post(); !strings.Contains(status, " 200 ") || body != "No changes\n" {
+		t.Errorf("again: got %q %q", status, body)
+	}
+	loadErr = errors.New("Broken config")
+	if status, body := post(); !strings.Contains(status, " 500 ") || !strings.Contains(body, "Broken config") {
+		t.Errorf("broken config: got %q %q", status, body)
+	}
+	if !hs.current().AutoIndex {
+		t.Error("a failed reload changed the configuration")
+	}
+}
+
+func TestDiffConfig(t *testing.T) {
+	root, mimePath := newReloadRoot(t, "old", "text/x-old")
+	cur, _ := NewHttpdServer("", root, mimePath)
+	next, _ := NewHttpdServer("", root, mimePath)
+
+	blog, _ := NewVirtualHost("blog", []string{"blog.example.com"}, root, mimePath)
+	shop, _ := NewVirtualHost("shop", []string{"shop.example.com"}, root, mimePath)
+	cur.VirtualHosts = []*VirtualHost{blog}
+	moved := *blog
+	moved.HostNames = []string{"www.example.com"}
+	next.VirtualHosts = []*VirtualHost{&moved, shop}
+
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	os.WriteFile(htpasswd, []byte(testHtpasswd), 0644)
+	rule := NewAuthRule("/private/", "Private")
+	rule.LoadHtpasswd(htpasswd)
+	cur.AuthRules = []*AuthRule{rule, NewAuthRule("/old/", "Old")}
+	next.AuthRules = []*AuthRule{NewAuthRule("/private/", "Private")}
+
+	for i := 0; i < 2*maxListedChanges; i++ {
+		next.MIMEMap["."+strings.Repeat("x", i+1)] = "text/plain"
+	}
+	next.Mux.HandleFunc("/api/", func(w *ResponseWriter, r *HttpRequestHeader) {}, "POST", "GET")
+	next.ReadTimeout *= 2
+
+	got := diffConfig(cur, next)
+	want := []string{
+		"MIMEMap: 20 added, 0 removed, 0 changed",
+		"ReadTimeout: 5s -> 10s",
+		"AuthRules[/private/]: users changed",
+		"AuthRules[/old/]: removed",
+		`Mux[/api/]: added "GET, POST"`,
+		`VirtualHosts[blog].HostNames: [blog.example.com] -> [www.example.com]`,
+		"VirtualHosts[shop]: added",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if diff := diffConfig(cur, cur); len(diff) != 0 {
+		t.Errorf("a configuration differs from itself: %q", diff)
+	}
+}
+
+func TestReloadKeepsDigestNonces(t *testing.T) {
+	hs := newTestServer(t)
+	hs.AuthRules = []*AuthRule{newTestAuthRule(t, false, true)}
+	addr := serveTest(t, hs, nil)
+
+	uri := "/subdir1/index.html"
+	_, headers := authRequest(t, addr, uri, "")
+	challenge := headers["WWW-Authenticate"]
+	if status, _ := authRequest(t, addr, uri, digestCredentials(challenge, "alice", "secret", "GET", uri, "00000001")); !strings.Contains(status, " 200 ") {
+		t.Fatalf("before the reload: got %q", status)
+	}
+
+	// the same rule loaded afresh, and one for a path it didn't have
+	next := newTestServer(t)
+	moved := newTestAuthRule(t, false, true)
+	moved.Prefix = "/subdir2/"
+	next.AuthRules = []*AuthRule{newTestAuthRule(t, false, true), moved}
+	if _, err := hs.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+
+	if status, _ := authRequest(t, addr, uri, digestCredentials(challenge, "alice", "secret", "GET", uri, "00000002")); !strings.Contains(status, " 200 ") {
+		t.Errorf("nonce from before the reload: got %q", status)
+	}
+	if status, _ := authRequest(t, addr, uri, digestCredentials(challenge, "alice", "secret", "GET", uri, "00000001")); !strings.Contains(status, " 401 ") {
+		t.Errorf("nc replayed across the reload: got %q", status)
+	}
+	if next.AuthRules[0].nonces != hs.AuthRules[0].nonces || moved.nonces == hs.AuthRules[0].nonces {
+		t.Error("nonces handed to the wrong rules")
+	}
+}
+
+func TestReloadStricterSymlinkPolicy(t *testing.T) {
+	root, _ := newSymlinkRoot(t)
+	hs, err := NewHttpdServer("", root, "../mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs.ContentCacheSize = 1024 * KB
+	addr := serveTest(t, hs, nil)
+
+	get := func() string {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		status, _, _ := roundTrip(t, conn, "GET /link.txt HTTP/1.1"+CRLF+"Host: localhost"+CRLF+
+			"Connection: close"+CRLF+CRLF)
+		return status
+	}
+	for i := 0; i < 2; i++ { // the second comes from the cache
+		if status := get(); status != "HTTP/1.1 200 OK" {
+			t.Fatalf("following links: got %q", status)
+		}
+	}
+	if hits := hs.contents().hits.Load(); hits == 0 {
+		t.Fatal("the link was never cached")
+	}
+
+	next, _ := NewHttpdServer("", root, "../mime.types")
+	next.ContentCacheSize, next.SymlinkPolicy = hs.ContentCacheSize, SymlinksDeny
+	if _, err := hs.Reload(next); err != nil {
+		t.Fatal(err)
+	}
+	if status := get(); status != "HTTP/1.1 403 Forbidden" {
+		t.Errorf("after reloading to deny: got %q", status)
+	}
+}
@@ -0,0 +1,169 @@
+package tritonhttp
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Handler responds to a single request
+type Handler interface {
+	ServeHTTP(w *ResponseWriter, requestHeader *HttpRequestHeader)
+}
+
+// adapts a plain function to the Handler interface
+type HandlerFunc func(w *ResponseWriter, requestHeader *HttpRequestHeader)
+
+func (f HandlerFunc) ServeHTTP(w *ResponseWriter, requestHeader *HttpRequestHeader) {
+	f(w, requestHeader)
+}
+
+// A Middleware wraps a handler, e.g. to log or to reject requests early
+type Middleware func(Handler) Handler
+
+type route struct {
+	prefix	string
+	methods	[]string // empty means any method
+	handler	Handler
+}
+
+/*
+ServeMux dispatches a request to the handler registered for the longest
+path prefix matching the request url. A prefix ending in "/" matches
+everything below it, any other prefix matches itself and the paths below it
+("/api" matches "/api" and "/api/x" but not "/apix").
+
+When the path matches but none of the handlers for it accept the method the
+client gets a 405 listing the methods that would work, when nothing matches
+it gets a 404.
+*/
+type ServeMux struct {
+	mu		sync.RWMutex
+	routes		[]route // sorted longest prefix first
+	middleware	[]Middleware
+}
+
+func NewServeMux() *ServeMux {
+	return &ServeMux{}
+}
+
+// registers handler for prefix, limited to the given methods if any. a
+// handler that accepts GET also answers HEAD.
+func (mux *ServeMux) Handle(prefix string, handler Handler, methods ...string) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+
+	mux.routes = append(mux.routes, route{prefix: prefix, methods: methods, handler: handler})
+	sort.SliceStable(mux.routes, func(i, j int) bool {
+		return len(mux.routes[i].prefix) > len(mux.routes[j].prefix)
+	})
+}
+
+func (mux *ServeMux) HandleFunc(prefix string, f func(*ResponseWriter, *HttpRequestHeader), methods ...string) {
+	mux.Handle(prefix, HandlerFunc(f), methods...)
+}
+
+// adds middleware around every request the mux serves, the first one added
+// is the outermost
+func (mux *ServeMux) Use(middleware ...Middleware) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	mux.middleware = append(mux.middleware, middleware...)
+}
+
+// the methods routed for each prefix, "*" for any, e.g. to log what a
+// reload changed
+func (mux *ServeMux) describeRoutes() map[string]string {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+	methods := map[string][]string{}
+	for _, r := range mux.routes {
+		if len(r.methods) == 0 {
+			methods[r.prefix] = append(methods[r.prefix], "*")
+		}
+		methods[r.prefix] = append(methods[r.prefix], r.methods...)
+	}
+	described := map[string]string{}
+	for prefix, m := range methods {
+		sort.Strings(m)
+		described[prefix] = strings.Join(m, ", ")
+	}
+	return described
+}
+
+func (mux *ServeMux) ServeHTTP(w *ResponseWriter, requestHeader *HttpRequestHeader) {
+	mux.mu.RLock()
+	var handler Handler = HandlerFunc(mux.dispatch)
+	for i := len(mux.middleware) - 1; i >= 0; i-- {
+		handler = mux.middleware[i](handler)
+	}
+	mux.mu.RUnlock()
+
+	handler.ServeHTTP(w, requestHeader)
+}
+
+func (mux *ServeMux) dispatch(w *ResponseWriter, requestHeader *HttpRequestHeader) {
+	handler, allowed := mux.match(requestHeader.verb, requestHeader.url)
+	if handler != nil {
+		handler.ServeHTTP(w, requestHeader)
+	} else if len(allowed) > 0 {
+		// like any error that means the client got something wrong, the
+		// connection is closed after the 405
+		w.Headers()["Allow"] = strings.Join(allowed, ", ")
+		w.Headers()["Connection"] = "close"
+		handleErrorResponse(w, 405)
+	} else {
+		handleErrorResponse(w, 404)
+	}
+}
+
+// finds the handler for the request. if the path is routed but not for this
+// method, the methods that are accepted there are returned instead.
+func (mux *ServeMux) match(method string, url string) (Handler, []string) {
+	mux.mu.RLock()
+	defer mux.mu.RUnlock()
+
+	allowed := []string{}
+	matchedPrefix := ""
+	for _, r := range mux.routes {
+		if !prefixMatch(r.prefix, url) {
+			continue
+		}
+		// routes are sorted, so once a longer prefix matched only routes
+		// for that same prefix are candidates
+		if matchedPrefix != "" && r.prefix != matchedPrefix {
+			break
+		}
+		matchedPrefix = r.prefix
+
+		if len(r.methods) == 0 {
+			return r.handler, nil
+		}
+		for _, m := range r.methods {
+			if m == method || (m == "GET" && method == "HEAD") {
+				return r.handler, nil
+			}
+			allowed = appendMethod(allowed, m)
+			if m == "GET" {
+				allowed = appendMethod(allowed, "HEAD")
+			}
+		}
+	}
+	return nil, allowed
+}
+
+func prefixMatch(prefix string, url string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(url, prefix)
+	}
+	return url == prefix || strings.HasPrefix(url, prefix+"/")
+}
+
+func appendMethod(methods []string, method string) []string {
+	for _, m := range methods {
+		if m == method {
+			return methods
+		}
+	}
+	return append(methods, method)
+}
@@ -0,0 +1,162 @@
+package tritonhttp
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// a handler that answers with its name
+type namedHandler string
+
+func (name namedHandler) ServeHTTP(w *ResponseWriter, requestHeader *HttpRequestHeader) {
+	w.Headers()["Content-Length"] = "0"
+	w.Headers()["X-Handler"] = string(name)
+	w.WriteHeader(200)
+}
+
+func TestPrefixMatch(t *testing.T) {
+	cases := []struct {
+		prefix	string
+		url	string
+		match	bool
+	}{
+		{"/", "/", true},
+		{"/", "/anything/at/all", true},
+		{"/api", "/api", true},
+		{"/api", "/api/", true},
+		{"/api", "/api/x", true},
+		{"/api", "/apix", false},
+		{"/api", "/", false},
+		{"/api/", "/api/x", true},
+		{"/api/", "/api/", true},
+		{"/api/", "/api", false},
+		{"/api/v1", "/api/v1/users", true},
+		{"/api/v1", "/api/v10", false},
+	}
+	for _, tc := range cases {
+		if got := prefixMatch(tc.prefix, tc.url); got != tc.match {
+			t.Errorf("prefixMatch(%q, %q) = %v, want %v", tc.prefix, tc.url, got, tc.match)
+		}
+	}
+}
+
+func TestServeMuxMatch(t *testing.T) {
+	mux := NewServeMux()
+	mux.Handle("/", namedHandler("files"), "GET")
+	mux.Handle("/api", namedHandler("api-read"), "GET")
+	mux.Handle("/api", namedHandler("api-write"), "POST", "PUT")
+	mux.Handle("/api/admin/", namedHandler("admin"))
+	mux.Handle("/upload", namedHandler("upload"), "PUT")
+
+	cases := []struct {
+		method	string
+		url	string
+		handler	string // "" when nothing answers
+		allowed	string // the Allow list when nothing answers
+	}{
+		{"GET", "/index.html", "files", ""},
+		{"HEAD", "/index.html", "files", ""},
+		{"POST", "/index.html", "", "GET, HEAD"},
+		{"GET", "/api", "api-read", ""},
+		{"HEAD", "/api/users", "api-read", ""},
+		{"PUT", "/api/users", "api-write", ""},
+		{"DELETE", "/api/users", "", "GET, HEAD, POST, PUT"},
+		{"GET", "/apix", "files", ""},
+		{"DELETE", "/api/admin/x", "admin", ""},
+		{"GET", "/api/admin", "api-read", ""},
+		// the longer prefix wins, even though "/" would take a GET
+		{"GET", "/upload", "", "PUT"},
+		{"GET", "/upload/a", "", "PUT"},
+	}
+	for _, tc := range cases {
+		handler, allowed := mux.match(tc.method, tc.url)
+		name, _ := handler.(namedHandler)
+		if string(name) != tc.handler || strings.Join(allowed, ", ") != tc.allowed {
+			t.Errorf("%s %s: got %q allowing %q, want %q allowing %q",
+				tc.method, tc.url, name, strings.Join(allowed, ", "), tc.handler, tc.allowed)
+		}
+	}
+
+	if handler, allowed := NewServeMux().match("GET", "/"); handler != nil || len(allowed) != 0 {
+		t.Errorf("an empty mux matched: %v %v", handler, allowed)
+	}
+}
+
+func TestServeMuxResponses(t *testing.T) {
+	hs := newTestServer(t)
+	hs.Mux = NewServeMux()
+	hs.Mux.Handle("/only-put", namedHandler("put"), "PUT")
+	var mu sync.Mutex
+	var order []string
+	ran := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return strings.Join(order, ",")
+	}
+	for _, name := range []string{"outer", "inner"} {
+		name := name
+		hs.Mux.Use(func(next Handler) Handler {
+			return HandlerFunc(func(w *ResponseWriter, requestHeader *HttpRequestHeader) {
+				mu.Lock()
+				order = append(order, name)
+				mu.Unlock()
+				next.ServeHTTP(w, requestHeader)
+			})
+		})
+	}
+	addr := serveTest(t, hs, nil)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	status, headers, _ := roundTrip(t, conn, "PUT /only-put HTTP/1.1"+CRLF+"Host: localhost"+CRLF+
+		"Content-Length: 0"+CRLF+CRLF)
+	if status != "HTTP/1.1 200 OK" || headers["X-Handler"] != "put" {
+		t.Fatalf("got %q %v", status, headers)
+	}
+	if ran() != "outer,inner" {
+		t.Errorf("middleware ran as %v", ran())
+	}
+
+	status, headers, _ = roundTrip(t, conn, "GET /only-put HTTP/1.1"+CRLF+"Host: localhost"+CRLF+CRLF)
+	if status != "HTTP/1.1 405 Method Not Allowed" || headers["Allow"] != "PUT" || headers["Connection"] != "close" {
+		t.Errorf("got %q %v", status, headers)
+	}
+
+	// middleware runs for unrouted requests too
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	mu.Lock()
+	order = nil
+	mu.Unlock()
+	if status, _, _ := roundTrip(t, conn, "GET /nothing HTTP/1.1"+CRLF+"Host: localhost"+CRLF+CRLF); status != "HTTP/1.1 404 Not Found" {
+		t.Errorf("got %q", status)
+	}
+	if ran() != "outer,inner" {
+		t.Errorf("middleware ran as %v", ran())
+	}
+}
+
+func TestUnroutedMethod(t *testing.T) {
+	hs := newTestServer(t)
+	addr := serveTest(t, hs, nil)
+
+	for _, method := range []string{"LOCK", "PROPPATCH", "X-CUSTOM"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		status, headers, _ := roundTrip(t, conn, method+" /index.html HTTP/1.1"+CRLF+"Host: localhost"+CRLF+CRLF)
+		if status != "HTTP/1.1 405 Method Not Allowed" || headers["Allow"] != "GET, HEAD" {
+			t.Errorf("%s: got %q %v", method, status, headers)
+		}
+		conn.Close()
+	}
+}
@@ -1,18 +1,31 @@
 package tritonhttp
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"log"
 	"net"
+	"strings"
+	"time"
 )
 
+// returned by Start and Serve after Shutdown
+var ErrServerClosed = errors.New("tritonhttp: Server closed")
+
+// how often Shutdown checks whether the active connections are done
+const shutdownPollInterval = 100 * time.Millisecond
+
 /**
 	Initialize the tritonhttp server by populating HttpServer structure
 **/
 func NewHttpdServer(port, docRoot, mimePath string) (*HttpServer, error) {
 
 	// Initialize mimeMap for server to refer
-	// ParseMIME()
-	mimeMap, _ := ParseMIME(mimePath)
+	mimeMap, err := ParseMIME(mimePath)
+	if err != nil {
+		return nil, err
+	}
 
 	// Return pointer to HttpServer
 	server := &HttpServer{
@@ -20,35 +33,307 @@ func NewHttpdServer(port, docRoot, mimePath string) (*HttpServer, error) {
 		DocRoot: docRoot,
 		MIMEPath: mimePath,
 		MIMEMap: mimeMap,
+		MaxBodySize: DefaultMaxBodySize,
+		MaxHeaderSize: DefaultMaxHeaderSize,
+		IdleTimeout: DefaultIdleTimeout,
+		HeaderTimeout: DefaultHeaderTimeout,
+		ReadTimeout: DefaultReadTimeout,
+		FileCacheSize: DefaultFileCacheSize,
+		ContentCacheMaxFile: DefaultContentCacheMaxFile,
+		MaxUploadSize: DefaultMaxUploadSize,
+		WatchPollInterval: DefaultWatchPollInterval,
+		Mux: NewServeMux(),
 	}
+	server.serverState = &serverState{active: server, metrics: newServerMetrics()}
+
+	// static files are just the catch-all route, more specific handlers
+	// can be added to server.Mux before starting the server
+	server.Mux.HandleFunc("/", server.handleResponse, "GET")
 
 	return server, nil
 }
 
 /**
-	Start the tritonhttp server
+	Start the tritonhttp server on the plain HTTP port, the HTTPS port or both
 **/
 func (hs *HttpServer) Start() (err error) {
 
-	log.Println("Server Created")
+	hs.debugLog("Server Created")
 
-	// Start listening to the server port
-	sock, err := net.Listen("tcp4", ":"+hs.ServerPort)
-	if err != nil {
-		log.Panicln(err)
+	if hs.ServerPort == "" && hs.TLSPort == "" {
+		return errors.New("No port to listen on")
+	}
+
+	// each listener gets its own accept loop, the first one to fail
+	// brings the server down
+	errs := make(chan error, 3)
+
+	if hs.hasAdminServer() {
+		admin := newAdminServer(hs)
+		sock, err := net.Listen("tcp4", adminAddr(hs.MetricsPort))
+		if err != nil {
+			return err
+		}
+		log.Println("Serving admin endpoints on", sock.Addr())
+		hs.mu.Lock()
+		hs.admin = admin
+		hs.mu.Unlock()
+		go func() { errs <- admin.Serve(sock) }()
 	}
-	log.Println("Listening to connections on", sock.Addr())
+	hs.mountBuiltins()
+
+	if hs.ServerPort != "" {
+		// Start listening to the server port
+		sock, err := net.Listen("tcp4", ":"+hs.ServerPort)
+		if err != nil {
+			hs.closeListeners()
+			return err
+		}
+		log.Println("Listening to connections on", sock.Addr())
+		hs.trackListener(sock)
+		go func() { errs <- hs.Serve(sock) }()
+	}
+
+	if hs.TLSPort != "" {
+		var sock net.Listener
+		tlsConfig, err := hs.tlsConfig()
+		if err == nil {
+			sock, err = tls.Listen("tcp4", ":"+hs.TLSPort, tlsConfig)
+		}
+		if err != nil {
+			hs.closeListeners()
+			return err
+		}
+		log.Println("Listening to TLS connections on", sock.Addr())
+		hs.trackListener(sock)
+		go func() { errs <- hs.Serve(sock) }()
+	}
+
+	err = <-errs
+	hs.closeListeners()
+	if admin := hs.adminServer(); admin != nil {
+		admin.closeListeners()
+	}
+	return err
+}
+
+// mounts the handlers the config turns on, except those on the admin port
+func (hs *HttpServer) mountBuiltins() {
+	if hs.MetricsPath != "" && hs.MetricsPort == "" {
+		hs.Mux.Handle(hs.MetricsPath, hs.MetricsHandler(), "GET")
+	}
+	if hs.ChangesPath != "" {
+		hs.Mux.Handle(hs.ChangesPath, hs.ChangesHandler(), "GET")
+	}
+	if hs.Writable {
+		hs.Mux.Handle("/", hs.DAVHandler(), davMethods...)
+	}
+}
+
+/**
+	Accept connections on sock until it fails, this lets the server run on a
+	listener set up elsewhere (e.g. on a random port in tests). Returns
+	ErrServerClosed once Shutdown is called.
+**/
+func (hs *HttpServer) Serve(sock net.Listener) error {
 	defer sock.Close()
 
+	if !hs.trackListener(sock) {
+		return ErrServerClosed
+	}
+
+	slots := hs.connectionSlots()
 	for {
+		// with MaxConns connections open we stop accepting, new clients
+		// wait in the listen backlog until a slot frees up
+		if slots != nil {
+			slots <- true
+		}
+
 		// Accept connection from client
 		conn, err := sock.Accept()
 		if err != nil {
-			log.Panicln(err)
+			if slots != nil {
+				<-slots
+			}
+			if hs.shuttingDown() {
+				return ErrServerClosed
+			}
+			return err
+		}
+
+		// Spawn a go routine to handle request, with whatever
+		// configuration is active now for as long as the connection lasts
+		if hs.trackConn(conn) {
+			active := hs.current()
+			go func() {
+				active.handleConnection(conn)
+				if slots != nil {
+					<-slots
+				}
+			}()
+		} else {
+			conn.Close()
+			if slots != nil {
+				<-slots
+			}
+		}
+	}
+}
+
+/**
+	Stop the server without interrupting anyone
+		1. stop accepting new connections
+		2. close connections that are waiting for a request
+		3. let the ones in the middle of a response finish, they're closed
+		   once the response is sent
+		4. send WebSocket clients a close (going away)
+	Returns once every connection is closed, or with the context's error if
+	that happens first.
+**/
+func (hs *HttpServer) Shutdown(ctx context.Context) error {
+	hs.mu.Lock()
+	hs.inShutdown = true
+	if hs.watcher != nil {
+		hs.watcher.Close()
+	}
+	webSockets := make([]*WebSocket, 0, len(hs.webSockets))
+	for ws := range hs.webSockets {
+		webSockets = append(webSockets, ws)
+	}
+	hs.mu.Unlock()
+	hs.closeListeners()
+	for _, ws := range webSockets {
+		ws.Close(WebSocketCloseGoingAway, "Server shutting down")
+	}
+	if admin := hs.adminServer(); admin != nil {
+		admin.Shutdown(ctx)
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if hs.closeIdleConns() {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
 		}
+	}
+}
 
-		// Spawn a go routine to handle request
-		go hs.handleConnection(conn)
+// where the admin port listens. anyone who can reach it can reload the
+// configuration, so a bare port is only opened on loopback, "host:port"
+// picks the interface, e.g. "0.0.0.0:9090" for every one
+func adminAddr(metricsPort string) string {
+	if strings.Contains(metricsPort, ":") {
+		return metricsPort
 	}
+	return "127.0.0.1:" + metricsPort
 }
 
+// whether Start serves anything on MetricsPort
+func (hs *HttpServer) hasAdminServer() bool {
+	return hs.MetricsPort != "" && (hs.MetricsPath != "" || hs.ReloadPath != "")
+}
+
+// the server for MetricsPort, nil if there's none
+func (hs *HttpServer) adminServer() *HttpServer {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.admin
+}
+
+// the configuration new connections get, hs itself until a Reload
+func (hs *HttpServer) current() *HttpServer {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.active
+}
+
+func (hs *HttpServer) shuttingDown() bool {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	return hs.inShutdown
+}
+
+// the semaphore shared by all listeners for MaxConns, nil if unlimited
+func (hs *HttpServer) connectionSlots() chan bool {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.MaxConns > 0 && hs.connSlots == nil {
+		hs.connSlots = make(chan bool, hs.MaxConns)
+	}
+	return hs.connSlots
+}
+
+// registers sock so Shutdown can close it, false if we're already shut down
+func (hs *HttpServer) trackListener(sock net.Listener) bool {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.inShutdown {
+		return false
+	}
+	if hs.listeners == nil {
+		hs.listeners = map[net.Listener]bool{}
+	}
+	hs.listeners[sock] = true
+	return true
+}
+
+func (hs *HttpServer) closeListeners() {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	for sock := range hs.listeners {
+		sock.Close()
+		delete(hs.listeners, sock)
+	}
+}
+
+// new connections start out idle, waiting for their first request
+func (hs *HttpServer) trackConn(conn net.Conn) bool {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if hs.inShutdown {
+		return false
+	}
+	if hs.conns == nil {
+		hs.conns = map[net.Conn]bool{}
+	}
+	hs.conns[conn] = false
+	hs.metrics.connectionAccepted()
+	return true
+}
+
+func (hs *HttpServer) untrackConn(conn net.Conn) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	delete(hs.conns, conn)
+}
+
+// marks a connection as serving a request (or done with it). false means
+// Shutdown already closed the connection while it was idle.
+func (hs *HttpServer) setConnActive(conn net.Conn, active bool) bool {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	if _, ok := hs.conns[conn]; !ok {
+		return false
+	}
+	hs.conns[conn] = active
+	return true
+}
+
+// closes every idle connection, true if no connections are left at all
+func (hs *HttpServer) closeIdleConns() bool {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+	for conn, active := range hs.conns {
+		if !active {
+			conn.Close()
+			delete(hs.conns, conn)
+		}
+	}
+	return len(hs.conns) == 0
+}
@@ -0,0 +1,139 @@
+package tritonhttp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainsActiveConnections(t *testing.T) {
+	hs := newTestServer(t)
+	release := make(chan bool)
+	started := make(chan bool)
+	hs.Mux.HandleFunc("/slow", func(w *ResponseWriter, r *HttpRequestHeader) {
+		started <- true
+		<-release
+		w.Headers()["Content-Length"] = "4"
+		w.Write([]byte("done"))
+	})
+
+	sock, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- hs.Serve(sock) }()
+
+	idle, err := net.Dial("tcp4", sock.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	active, err := net.Dial("tcp4", sock.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Close()
+	active.Write([]byte("GET /slow HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- hs.Shutdown(context.Background()) }()
+
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("Serve returned %v, want ErrServerClosed", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the active request finished", err)
+	case <-time.After(3 * shutdownPollInterval):
+	}
+
+	// the idle connection is closed without a response
+	idle.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := idle.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("idle connection got %d bytes, want it closed", n)
+	}
+
+	close(release)
+	status, headers, body := roundTrip(t, active, "")
+	if status != "HTTP/1.1 200 OK" || body != "done" || headers["Connection"] != "close" {
+		t.Fatalf("got %q %v %q", status, headers, body)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown returned %v", err)
+	}
+}
+
+func TestShutdownContextExpires(t *testing.T) {
+	hs := newTestServer(t)
+	release := make(chan bool)
+	defer close(release)
+	started := make(chan bool)
+	hs.Mux.HandleFunc("/slow", func(w *ResponseWriter, r *HttpRequestHeader) {
+		started <- true
+		<-release
+	})
+	addr := serveTest(t, hs, nil)
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET /slow HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := hs.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown returned %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestAdminPortOnLoopback(t *testing.T) {
+	for port, want := range map[string]string{
+		"9090":		"127.0.0.1:9090",
+		"0.0.0.0:9090":	"0.0.0.0:9090",
+		"10.0.0.1:9090":	"10.0.0.1:9090",
+	} {
+		if got := adminAddr(port); got != want {
+			t.Errorf("%q: got %q, want %q", port, got, want)
+		}
+	}
+
+	hs := newTestServer(t)
+	hs.ServerPort, hs.MetricsPort, hs.ReloadPath = "0", "0", "/-/reload"
+	started := make(chan error, 1)
+	go func() { started <- hs.Start() }()
+	defer hs.Shutdown(context.Background())
+
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if admin := hs.adminServer(); admin != nil {
+			admin.mu.Lock()
+			var addrs []net.Addr
+			for sock := range admin.listeners {
+				addrs = append(addrs, sock.Addr())
+			}
+			admin.mu.Unlock()
+			if len(addrs) == 1 {
+				if ip := addrs[0].(*net.TCPAddr).IP; !ip.IsLoopback() {
+					t.Errorf("admin port open on %v", addrs[0])
+				}
+				return
+			}
+		}
+		select {
+		case err := <-started:
+			t.Fatal(err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the admin port never opened")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
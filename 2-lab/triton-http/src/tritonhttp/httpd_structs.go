@@ -1,7 +1,14 @@
 package tritonhttp
 
 import (
+	"html/template"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
 type HttpServer	struct {
@@ -9,6 +16,104 @@ type HttpServer	struct {
 	DocRoot		string
 	MIMEPath	string
 	MIMEMap		map[string]string
+	MaxBodySize	int64 // larger request bodies get a 413
+
+	// connection limits, 0 means no limit or no timeout, except for
+	// MaxHeaderSize where it means DefaultMaxHeaderSize
+	MaxHeaderSize		int           // request line + headers, larger gets a 400
+	IdleTimeout		time.Duration // to wait for the next request on a connection
+	HeaderTimeout		time.Duration // to receive a header once it has started
+	ReadTimeout		time.Duration // to receive the body after the header
+	WriteTimeout		time.Duration // to send the whole response
+	MaxConns		int           // open connections, beyond that we stop accepting
+	MaxRequestsPerConn	int           // then the connection is closed
+	RateLimit		float64       // requests per second per client IP
+	RateBurst		int           // requests a client may make at once
+
+	FileCacheSize	int // files whose metadata and open handles are kept, 0 for none
+
+	// small files kept in memory, off unless ContentCacheSize is set
+	ContentCacheSize	int64         // bytes of file contents, gzip variants included
+	ContentCacheMaxFile	int64         // larger files are always read from disk
+	WatchPollInterval	time.Duration // doc root rescans when inotify isn't available
+
+	// Prometheus metrics, served at MetricsPath (if set) on the main ports,
+	// or only on MetricsPort if that's set too. MetricsPort is a port on
+	// loopback, or "host:port" to listen elsewhere
+	MetricsPath	string
+	MetricsPort	string
+
+	// a WebSocket at ChangesPath (if set) telling clients about every file
+	// that changes under the doc roots
+	ChangesPath	string
+
+	ErrorPages	map[int]*template.Template // by status code, see LoadErrorPage
+	AuthRules	[]*AuthRule // checked before any handler runs
+	SymlinkPolicy	string // SymlinksFollow (the default), SymlinksOwnerMatch or SymlinksDeny
+	Mux		*ServeMux // routes every request, "/" goes to the file server
+	AutoIndex	bool // list directories that have no index.html
+
+	// WebDAV writes to the doc roots (PUT, DELETE and MKCOL), only from
+	// users an AuthRule has logged in. PUT bodies may be up to
+	// MaxUploadSize rather than MaxBodySize.
+	Writable	bool
+	MaxUploadSize	int64
+	DisableHTTP2	bool // no ALPN h2, h2c upgrades or prior knowledge
+
+	// sites picked by the Host header, requests for any other host go to
+	// the DefaultHost site or, if that's empty, the DocRoot above
+	VirtualHosts	[]*VirtualHost
+	DefaultHost	string
+
+	// HTTPS, enabled by setting TLSPort. with RedirectToHTTPS the plain
+	// port only redirects clients over to the TLS one.
+	TLSPort		string
+	CertFile	string
+	KeyFile		string
+	TLSMinVersion	uint16 // e.g. tls.VersionTLS12, 0 for the default
+	RedirectToHTTPS	bool
+
+	AccessLog	io.Writer // one line per response, nil to disable
+	AccessLogFormat	string    // AccessLogCombined (default) or AccessLogJSON
+	LogLevel	int       // LogInfo or LogDebug
+
+	// live reloads, see Reload. ReloadConfig builds the next configuration
+	// with Loader, a POST to ReloadPath on MetricsPort does the same.
+	Loader		func() (*HttpServer, error)
+	ReloadPath	string
+
+	realRoots	sync.Map // doc root -> the same with symlinks resolved, see realRoot
+
+	// shared by every configuration Reload swaps in, so only servers made
+	// by NewHttpdServer can be started
+	*serverState
+}
+
+/*
+What a server keeps across reloads: its listeners, connections, caches and
+counters. Everything is guarded by mu, conns maps each open connection to
+whether it's in the middle of a request. The caches are built from the
+active configuration's settings, Reload drops the ones whose settings
+changed.
+*/
+type serverState struct {
+	mu		sync.Mutex
+	active		*HttpServer // the configuration new connections get
+	listeners	map[net.Listener]bool
+	conns		map[net.Conn]bool
+	inShutdown	bool
+	connSlots	chan bool // one entry per open connection when MaxConns is set
+	limiter		*rateLimiter
+	fileCache	*fileCache
+	contentCache	*contentCache
+	watcher		fsWatcher // the doc roots, for the content cache and change feed
+	webSockets	map[*WebSocket]bool // closed with 1001 by Shutdown
+	changeSubs	map[chan string]bool // ChangesPath clients
+	metrics		*serverMetrics
+	admin		*HttpServer // serves MetricsPort
+
+	accessLogMu	sync.Mutex
+	reloadMu	sync.Mutex // one Reload at a time
 }
 
 type HttpResponseHeader struct {
@@ -21,14 +126,105 @@ type HttpResponseHeader struct {
 }
 
 type HttpRequestHeader struct {
+	requestLine	string // as sent, e.g. "GET /a?b=c HTTP/1.1"
 	verb	string
-	url		string
+	url		string // the path, percent-decoded
+	rawPath		string // the path as sent
+	rawQuery	string // everything after the "?", still encoded
+	query		url.Values
+	proto		string // "HTTP/1.0" or "HTTP/1.1"
 	headers map[string]string
+	body	[]byte
+	user		string // who an AuthRule let in, "" if nobody had to log in
+	authType	string // "Basic" or "Digest" when user is set
+}
+
+func (rh HttpRequestHeader) Verb() string {
+	return rh.verb
+}
+
+// the request path, without the query
+func (rh HttpRequestHeader) URL() string {
+	return rh.url
+}
+
+// the path as the client sent it, still percent-encoded
+func (rh HttpRequestHeader) RawPath() string {
+	return rh.rawPath
+}
+
+// the query string without the "?", "" if there was none
+func (rh HttpRequestHeader) RawQuery() string {
+	return rh.rawQuery
+}
+
+// the decoded query parameters
+func (rh HttpRequestHeader) Query() url.Values {
+	return rh.query
+}
+
+// the first value of a query parameter, "" if it wasn't sent
+func (rh HttpRequestHeader) QueryParam(key string) string {
+	return rh.query.Get(key)
+}
+
+// the user the request authenticated as, "" if its path isn't protected
+func (rh HttpRequestHeader) User() string {
+	return rh.user
+}
+
+// the request's HTTP version, e.g. "HTTP/1.1"
+func (rh HttpRequestHeader) Proto() string {
+	return rh.proto
+}
+
+// the value of a request header, "" if it wasn't sent. the key is
+// case-insensitive, repeated headers come back as one comma separated list
+func (rh HttpRequestHeader) Header(key string) string {
+	return rh.headers[textproto.CanonicalMIMEHeaderKey(key)]
+}
+
+// the elements of a comma separated request header, e.g. "Connection"
+func (rh HttpRequestHeader) HeaderValues(key string) []string {
+	var values []string
+	for _, value := range strings.Split(rh.Header(key), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// whether a comma separated request header lists token, ignoring case
+func (rh HttpRequestHeader) hasToken(key string, token string) bool {
+	for _, value := range rh.HeaderValues(key) {
+		if strings.EqualFold(value, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether the client wants the connection kept open after this request.
+// HTTP/1.1 connections persist unless closed, HTTP/1.0 ones only on request
+func (rh HttpRequestHeader) keepAlive() bool {
+	if rh.hasToken("Connection", "close") {
+		return false
+	}
+	if rh.proto == "HTTP/1.0" {
+		return rh.hasToken("Connection", "keep-alive")
+	}
+	return true
+}
+
+// the decoded request body, nil if the request didn't carry one
+func (rh HttpRequestHeader) Body() []byte {
+	return rh.body
 }
 
 func (rh HttpRequestHeader) String() string{
 	var b strings.Builder
-	b.WriteString(rh.verb + " " + rh.url + " HTTP/1.1\n")
+	b.WriteString(rh.verb + " " + rh.url + " " + rh.proto + "\n")
 	for k, v := range rh.headers {
 		b.WriteString(k + ": " + v + "\n")
 	}
@@ -0,0 +1,63 @@
+package tritonhttp
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+)
+
+// maps the tls_min_version config values to crypto/tls constants
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func ParseTLSVersion(version string) (uint16, error) {
+	if v, ok := TLSVersions[version]; ok {
+		return v, nil
+	}
+	return 0, errors.New("Unknown TLS version: " + version)
+}
+
+func (hs *HttpServer) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(hs.CertFile, hs.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	minVersion := hs.TLSMinVersion
+	if minVersion == 0 {
+		minVersion = tls.VersionTLS12
+	}
+	// HTTP/2 is offered first, clients that don't speak it stay on 1.1
+	nextProtos := []string{"h2", "http/1.1"}
+	if hs.DisableHTTP2 {
+		nextProtos = []string{"http/1.1"}
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion: minVersion,
+		NextProtos: nextProtos,
+	}, nil
+}
+
+// sends the client to the same url on the HTTPS port
+func (hs *HttpServer) redirectToHTTPS(w *ResponseWriter, requestHeader *HttpRequestHeader) {
+	host := requestHeader.headers["Host"]
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if hs.TLSPort != "443" {
+		host = net.JoinHostPort(host, hs.TLSPort)
+	}
+
+	// clients may turn a redirected POST into a GET on a 301, a 308 makes
+	// them resend the same method and body
+	statusCode := 301
+	if requestHeader.verb != "GET" && requestHeader.verb != "HEAD" {
+		statusCode = 308
+	}
+	redirect(w, "https://"+host+requestURI(requestHeader), statusCode)
+}
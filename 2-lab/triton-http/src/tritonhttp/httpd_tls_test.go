@@ -0,0 +1,127 @@
+package tritonhttp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writes a self-signed certificate for 127.0.0.1 into a temp dir
+func writeTestCert(t *testing.T) (certFile string, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{Organization: []string{"TritonHTTP test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := os.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestTLSServesFiles(t *testing.T) {
+	hs := newTestServer(t)
+	hs.CertFile, hs.KeyFile = writeTestCert(t)
+	tlsConfig, err := hs.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTest(t, hs, tlsConfig)
+
+	conn, err := tls.Dial("tcp4", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	status, _, body := roundTrip(t, conn,
+		"GET /index.html HTTP/1.1\r\nHost: 127.0.0.1\r\nConnection: close\r\n\r\n")
+	want, _ := os.ReadFile(filepath.Join(hs.DocRoot, "index.html"))
+	if status != "HTTP/1.1 200 OK" || body != string(want) {
+		t.Fatalf("got %q with body %q", status, body)
+	}
+}
+
+func TestTLSMinVersion(t *testing.T) {
+	hs := newTestServer(t)
+	hs.CertFile, hs.KeyFile = writeTestCert(t)
+	hs.TLSMinVersion = tls.VersionTLS13
+	tlsConfig, err := hs.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveTest(t, hs, tlsConfig)
+
+	conn, err := tls.Dial("tcp4", addr,
+		&tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12})
+	if err == nil {
+		conn.Close()
+		t.Fatal("TLS 1.2 handshake succeeded with a 1.3 minimum")
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	hs := newTestServer(t)
+	hs.TLSPort = "8443"
+	hs.RedirectToHTTPS = true
+	addr := serveTest(t, hs, nil)
+
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	status, headers, _ := roundTrip(t, conn,
+		"GET /subdir1/ HTTP/1.1\r\nHost: example.com:8080\r\nConnection: close\r\n\r\n")
+	if status != "HTTP/1.1 301 Moved Permanently" {
+		t.Fatalf("got %q", status)
+	}
+	if headers["Location"] != "https://example.com:8443/subdir1/" {
+		t.Fatalf("got Location %q", headers["Location"])
+	}
+}
+
+func TestParseTLSVersion(t *testing.T) {
+	if v, err := ParseTLSVersion("1.3"); err != nil || v != tls.VersionTLS13 {
+		t.Fatalf("got %v, %v", v, err)
+	}
+	if _, err := ParseTLSVersion("3.0"); err == nil {
+		t.Fatal("expected an error for an unknown version")
+	}
+}
@@ -0,0 +1,106 @@
+package tritonhttp
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// A VirtualHost is a site with its own files, served for a set of host names
+type VirtualHost struct {
+	Name		string   // identifies the site in the config and logs
+	HostNames	[]string // "example.com", or "*.example.com" for any subdomain
+	DocRoot		string
+	MIMEPath	string
+	MIMEMap		map[string]string
+	AutoIndex	bool
+}
+
+func NewVirtualHost(name string, hostNames []string, docRoot, mimePath string) (*VirtualHost, error) {
+	absDocRoot, err := filepath.Abs(docRoot)
+	if err != nil {
+		return nil, err
+	}
+	mimeMap, err := ParseMIME(mimePath)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, hostName := range hostNames {
+		if hostName = normalizeHost(hostName); hostName != "" {
+			names = append(names, hostName)
+		}
+	}
+
+	return &VirtualHost{
+		Name: name,
+		HostNames: names,
+		DocRoot: absDocRoot,
+		MIMEPath: mimePath,
+		MIMEMap: mimeMap,
+	}, nil
+}
+
+func (vh *VirtualHost) matches(host string) bool {
+	for _, name := range vh.HostNames {
+		if name == host {
+			return true
+		}
+		if strings.HasPrefix(name, "*.") && strings.HasSuffix(host, name[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Picks the site for a request by its Host header
+	1. an exact host name match wins over a wildcard one
+	2. a host no site claims goes to the site named by DefaultHost
+	3. failing that, to the server's own DocRoot
+*/
+func (hs *HttpServer) virtualHost(requestHeader *HttpRequestHeader) *VirtualHost {
+	host := normalizeHost(requestHeader.headers["Host"])
+
+	var wildcard *VirtualHost
+	for _, vh := range hs.VirtualHosts {
+		for _, name := range vh.HostNames {
+			if name == host {
+				return vh
+			}
+		}
+		if wildcard == nil && vh.matches(host) {
+			wildcard = vh
+		}
+	}
+	if wildcard != nil {
+		return wildcard
+	}
+
+	for _, vh := range hs.VirtualHosts {
+		if hs.DefaultHost != "" && vh.Name == hs.DefaultHost {
+			return vh
+		}
+	}
+	return &VirtualHost{DocRoot: hs.DocRoot, MIMEPath: hs.MIMEPath,
+		MIMEMap: hs.MIMEMap, AutoIndex: hs.AutoIndex}
+}
+
+// "Example.COM.:8080" and "example.com" are the same host
+func normalizeHost(host string) string {
+	host = strings.TrimSpace(host)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(strings.TrimSuffix(host, "]"), "[")
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// the MIME type for path by its extension
+func (vh *VirtualHost) contentType(path string) string {
+	if contentType, ok := vh.MIMEMap[filepath.Ext(path)]; ok {
+		return contentType
+	}
+	return "application/octet-stream"
+}
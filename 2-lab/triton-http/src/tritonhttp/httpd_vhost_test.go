@@ -0,0 +1,72 @@
+package tritonhttp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// a site whose index.html just says its name
+func newTestVirtualHost(t *testing.T, name string, hostNames ...string) *VirtualHost {
+	t.Helper()
+	docRoot := t.TempDir()
+	if err := os.WriteFile(filepath.Join(docRoot, "index.html"), []byte(name), 0644); err != nil {
+		t.Fatal(err)
+	}
+	vh, err := NewVirtualHost(name, hostNames, docRoot, "../mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vh
+}
+
+func TestVirtualHostSelection(t *testing.T) {
+	hs := newTestServer(t)
+	hs.VirtualHosts = []*VirtualHost{
+		newTestVirtualHost(t, "wild", "*.example.com"),
+		newTestVirtualHost(t, "docs", "docs.example.com", "Docs.Internal"),
+		newTestVirtualHost(t, "fallback", "fallback.example.org"),
+	}
+	addr := serveTest(t, hs, nil)
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"docs.example.com", "docs"},
+		{"DOCS.example.com:8080", "docs"},
+		{"docs.internal.", "docs"},
+		{"wiki.example.com", "wild"},
+		{"fallback.example.org", "fallback"},
+		{"unknown.example.org", ""}, // the server's own doc root
+	}
+	for _, test := range tests {
+		conn, err := net.Dial("tcp4", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, body := roundTrip(t, conn,
+			"GET / HTTP/1.1\r\nHost: "+test.host+"\r\nConnection: close\r\n\r\n")
+		conn.Close()
+
+		want := test.want
+		if want == "" {
+			index, _ := os.ReadFile(filepath.Join(hs.DocRoot, "index.html"))
+			want = string(index)
+		}
+		if body != want {
+			t.Errorf("Host %q got %q, want %q", test.host, body, want)
+		}
+	}
+
+	hs.DefaultHost = "fallback"
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, _, body := roundTrip(t, conn, "GET / HTTP/1.1\r\nHost: unknown\r\nConnection: close\r\n\r\n"); body != "fallback" {
+		t.Errorf("default host got %q", body)
+	}
+}
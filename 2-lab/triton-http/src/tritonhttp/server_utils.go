@@ -3,49 +3,179 @@ package tritonhttp
 
 import (
 	"os"
-	"log"
 	"bufio"
 	"bytes"
+	"errors"
+	"strconv"
 	"strings"
+	"time"
 )
 
+/*
+Reads a MIME table, one ".ext type" pair per line, anything after the type
+is a comment. Blank lines and lines starting with "#" are skipped, a line
+without a type is an error, so a broken file is caught before a reload
+starts using it.
+*/
 func ParseMIME(MIMEPath string) (map[string]string, error) {
 	file, err := os.Open(MIMEPath)
 	if err != nil {
-		log.Panicln(err)
+		return nil, err
 	}
-
-	defer func() {
-		if err = file.Close(); err != nil {
-			log.Panicln(err)
-		}
-	}()
+	defer file.Close()
 
 	MIMEMap := map[string]string{}
 
 	s := bufio.NewScanner(file)
-	for s.Scan() {
+	for lineNo := 1; s.Scan(); lineNo++ {
 		line := strings.Fields(s.Text()) // [".pdf", "application/pdf"]
+		if len(line) == 0 || strings.HasPrefix(line[0], "#") {
+			continue
+		}
+		if len(line) < 2 || !strings.HasPrefix(line[0], ".") {
+			return nil, errors.New(MIMEPath + ":" + strconv.Itoa(lineNo) + ": Expected an extension and a type")
+		}
 		MIMEMap[line[0]] = line[1]
 	}
-	err = s.Err()
-	if err != nil {
-		log.Panicln(err)
+	if err := s.Err(); err != nil {
+		return nil, err
 	}
-
 	return MIMEMap, nil
 }
 
-// maps the status code to it's description
-var StatusDesc = map[int]string{
+// reason phrases for every status code registered with IANA
+var statusText = map[int]string{
+	100: "Continue",
+	101: "Switching Protocols",
+	102: "Processing",
+	103: "Early Hints",
+
 	200: "OK",
+	201: "Created",
+	202: "Accepted",
+	203: "Non-Authoritative Information",
+	204: "No Content",
+	205: "Reset Content",
+	206: "Partial Content",
+	207: "Multi-Status",
+	208: "Already Reported",
+	226: "IM Used",
+
+	300: "Multiple Choices",
+	301: "Moved Permanently",
+	302: "Found",
+	303: "See Other",
+	304: "Not Modified",
+	305: "Use Proxy",
+	307: "Temporary Redirect",
+	308: "Permanent Redirect",
+
 	400: "Bad Request",
+	401: "Unauthorized",
+	402: "Payment Required",
+	403: "Forbidden",
 	404: "Not Found",
+	405: "Method Not Allowed",
+	406: "Not Acceptable",
+	407: "Proxy Authentication Required",
+	408: "Request Timeout",
+	409: "Conflict",
+	410: "Gone",
+	411: "Length Required",
+	412: "Precondition Failed",
+	413: "Content Too Large",
+	414: "URI Too Long",
+	415: "Unsupported Media Type",
+	416: "Range Not Satisfiable",
+	417: "Expectation Failed",
+	418: "I'm a teapot",
+	421: "Misdirected Request",
+	422: "Unprocessable Content",
+	423: "Locked",
+	424: "Failed Dependency",
+	425: "Too Early",
+	426: "Upgrade Required",
+	428: "Precondition Required",
+	429: "Too Many Requests",
+	431: "Request Header Fields Too Large",
+	451: "Unavailable For Legal Reasons",
+
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
+	505: "HTTP Version Not Supported",
+	506: "Variant Also Negotiates",
+	507: "Insufficient Storage",
+	508: "Loop Detected",
+	510: "Not Extended",
+	511: "Network Authentication Required",
+}
+
+// the reason phrase for a status code, "" if it's not one we know
+func StatusText(statusCode int) string {
+	return statusText[statusCode]
 }
 
+// the reason phrase to send, a generic one for its class if the code
+// isn't one we know, so the status line never ends in a bare space
+func statusReason(statusCode int) string {
+	if text := StatusText(statusCode); text != "" {
+		return text
+	}
+	switch statusCode / 100 {
+	case 1:
+		return "Informational"
+	case 2:
+		return "Success"
+	case 3:
+		return "Redirection"
+	case 4:
+		return "Client Error"
+	case 5:
+		return "Server Error"
+	}
+	return "Unknown Status"
+}
+
+// IMF-fixdate, the preferred date format for HTTP headers (RFC 7231 7.1.1.1)
+const HttpTimeFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
 // number of bytes in one kilobyte
 const KB = 1024
 
+// largest request body accepted unless the config says otherwise
+const DefaultMaxBodySize = 1024*KB
+
+// largest PUT accepted in writable mode unless the config says otherwise
+const DefaultMaxUploadSize = 64*1024*KB
+
+// connection limits unless the config says otherwise, see HttpServer
+const (
+	DefaultMaxHeaderSize = 32*KB
+	DefaultIdleTimeout = 5 * time.Second
+	DefaultHeaderTimeout = 5 * time.Second
+	DefaultReadTimeout = 5 * time.Second
+)
+
+// the deadline for something that may take timeout, none if it's 0
+func deadlineAfter(timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// the request header has to fit in a buffer, so MaxHeaderSize 0 means the
+// default rather than no limit
+func (hs *HttpServer) maxHeaderSize() int {
+	if hs.MaxHeaderSize <= 0 {
+		return DefaultMaxHeaderSize
+	}
+	return hs.MaxHeaderSize
+}
+
 const CRLF = "\r\n"
 const EoR = CRLF+CRLF
 
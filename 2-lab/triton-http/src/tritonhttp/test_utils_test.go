@@ -0,0 +1,78 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the sample doc root and MIME table shipped with the repo
+func newTestServer(t *testing.T) *HttpServer {
+	t.Helper()
+	docRoot, _ := filepath.Abs("../../sample_htdocs")
+	hs, err := NewHttpdServer("", docRoot, "../mime.types")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hs
+}
+
+// starts hs on a random local port, wrapped in TLS if tlsConfig is set
+func serveTest(t *testing.T, hs *HttpServer, tlsConfig *tls.Config) string {
+	t.Helper()
+	sock, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		sock = tls.NewListener(sock, tlsConfig)
+	}
+	go hs.Serve(sock)
+	t.Cleanup(func() { sock.Close() })
+	return sock.Addr().String()
+}
+
+// sends a raw request and returns the status line, headers and body
+func roundTrip(t *testing.T, conn net.Conn, request string) (string, map[string]string, string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	status, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimRight(line, CRLF)
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, ": ", 2)
+		headers[kv[0]] = kv[1]
+	}
+	var body []byte
+	if cl, ok := headers["Content-Length"]; ok {
+		n, _ := strconv.Atoi(cl)
+		body = make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		body, _ = io.ReadAll(r)
+	}
+	return strings.TrimRight(status, CRLF), headers, string(body)
+}
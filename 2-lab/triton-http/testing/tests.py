@@ -42,6 +42,16 @@ def test_get_index():
   assert res["body"] == subdir1_index
 
 
+def test_dir_redirect():
+  """Checks if a directory requested without a trailing slash is redirected
+  """
+  with RequestManager() as ch:
+    ch.send_get(url="/subdir1")
+    res = ch.read_get()
+  assert res["status_code"] == 301
+  assert res["headers"]["Location"] == "/subdir1/"
+
+
 def test_default_mime():
   """Checks if the mime-type is "application/octet-stream" for unknown filetype
   """
@@ -64,13 +74,23 @@ def test_404():
 
 
 def test_root_escape():
-  """Checks if root escape attempt will return 404
+  """Checks if root escape attempt will return 403
   """
   with RequestManager() as ch:
     r = b"GET /../src/main/main.go HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"
     ch.send(r)
     res = ch.read_get()
-  assert res["status_code"] == 404
+  assert res["status_code"] == 403
+
+
+def test_encoded_root_escape():
+  """Checks if a percent-encoded root escape attempt will return 403
+  """
+  with RequestManager() as ch:
+    r = b"GET /%2e%2e/src/main/main.go HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"
+    ch.send(r)
+    res = ch.read_get()
+  assert res["status_code"] == 403
 
 
 def test_conn_close():
@@ -163,6 +183,187 @@ def test_malformed_request():
     assert ch.is_socket_closed() == True
   assert res["status_code"] == 400
 
+def test_head():
+  """Checks if HEAD returns the same headers as GET but no body
+  """
+  with RequestManager() as ch:
+    ch.send(b"HEAD /index.html HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+    time.sleep(1)
+    data = ch.recv()
+  head, _, body = data.partition(b"\r\n\r\n")
+  assert head.startswith(b"HTTP/1.1 200 OK")
+  assert b"Content-Length: %d" %len(root_index) in head
+  assert b"Content-Type: text/html" in head
+  assert body == b""
+
+
+def test_405():
+  """Checks if a well-formed request with an unsupported verb returns 405 with
+  an Allow header and closes the connection
+  """
+  with RequestManager() as ch:
+    ch.send(b"DELETE /index.html HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n")
+    res = ch.read_get()
+    time.sleep(1) # wait for server to close
+    assert ch.is_socket_closed() == True
+  assert res["status_code"] == 405
+  assert res["headers"]["Allow"] == "GET, HEAD"
+
+
+def test_304():
+  """Checks if a matching If-None-Match or a later If-Modified-Since returns a
+  bodiless 304, and that a stale If-Modified-Since still returns the file
+  """
+  with RequestManager() as ch:
+    ch.send_get(url="/index.html")
+    res = ch.read_get()
+  etag = res["headers"]["ETag"]
+  last_modified = res["headers"]["Last-Modified"]
+
+  with RequestManager() as ch:
+    ch.send_get(url="/index.html", headers={"If-None-Match": etag})
+    time.sleep(1)
+    data = ch.recv()
+  assert data.startswith(b"HTTP/1.1 304 Not Modified")
+  assert data.endswith(b"\r\n\r\n")
+
+  with RequestManager() as ch:
+    ch.send_get(url="/index.html", headers={"If-Modified-Since": last_modified})
+    time.sleep(1)
+    data = ch.recv()
+  assert data.startswith(b"HTTP/1.1 304 Not Modified")
+
+  with RequestManager() as ch:
+    since = "Thu, 01 Jan 1970 00:00:00 GMT"
+    ch.send_get(url="/index.html", headers={"If-Modified-Since": since})
+    res = ch.read_get()
+  assert res["status_code"] == 200
+  assert res["body"] == root_index
+
+
+def test_206():
+  """Checks if single byte ranges return 206 with the right slice and
+  Content-Range, and an out of bounds range returns 416
+  """
+  with RequestManager() as ch:
+    ch.send_get(url="/kitten.jpg", headers={"Range": "bytes=100-199"})
+    res = ch.read_get()
+  assert res["status_code"] == 206
+  assert res["headers"]["Content-Range"] == "bytes 100-199/%d" %len(kitten)
+  assert res["body"] == kitten[100:200]
+
+  with RequestManager() as ch:
+    ch.send_get(url="/kitten.jpg", headers={"Range": "bytes=-10"})
+    res = ch.read_get()
+  assert res["status_code"] == 206
+  assert res["body"] == kitten[-10:]
+
+  with RequestManager() as ch:
+    ch.send_get(url="/kitten.jpg", headers={"Range": "bytes=%d-" %len(kitten)})
+    res = ch.read_get()
+  assert res["status_code"] == 416
+  assert res["headers"]["Content-Range"] == "bytes */%d" %len(kitten)
+
+
+def test_if_range():
+  """Checks if a stale If-Range validator makes the server send the whole file
+  """
+  with RequestManager() as ch:
+    headers = {"Range": "bytes=0-9", "If-Range": "\"stale\""}
+    ch.send_get(url="/index.html", headers=headers)
+    res = ch.read_get()
+  assert res["status_code"] == 200
+  assert res["body"] == root_index
+
+
+def test_seq_with_body():
+  """Checks if request bodies (plain and chunked) are consumed so the next
+  pipelined request is still parsed correctly
+  """
+  r1 = b"GET /index.html HTTP/1.1\r\nHost: 127.0.0.1\r\nContent-Length: 5\r\n\r\nhello"
+  r2 = (b"GET /subdir1/ HTTP/1.1\r\nHost: 127.0.0.1\r\nTransfer-Encoding: chunked\r\n\r\n"
+        b"5\r\nhello\r\n0\r\n\r\n")
+  r3 = b"GET /index.html HTTP/1.1\r\nHost: 127.0.0.1\r\n\r\n"
+  with RequestManager() as ch:
+    ch.send(r1+r2+r3)
+    res1 = ch.read_get()
+    res2 = ch.read_get()
+    res3 = ch.read_get()
+  assert res1["body"] == root_index
+  assert res2["body"] == subdir1_index
+  assert res3["body"] == root_index
+
+
+def test_413():
+  """Checks if a body larger than max_body_size returns 413 & closes the conn
+  """
+  with RequestManager() as ch:
+    ch.send(b"GET / HTTP/1.1\r\nHost: 127.0.0.1\r\nContent-Length: 1073741824\r\n\r\n")
+    res = ch.read_get()
+    time.sleep(1) # wait for server to close
+    assert ch.is_socket_closed() == True
+  assert res["status_code"] == 413
+
+
+def test_gzip():
+  """Checks if text files are gzipped for clients that accept it, and that
+  images are sent as is
+  """
+  import gzip
+  with RequestManager() as ch:
+    ch.send_get(url="/index.html", headers={"Accept-Encoding": "gzip"})
+    time.sleep(1)
+    data = b""
+    while b"\r\n\r\n" not in data:
+      data += ch.recv()
+    head, _, body = data.partition(b"\r\n\r\n")
+    length = int(head.split(b"Content-Length: ")[1].split(b"\r\n")[0])
+    while len(body) < length:
+      body += ch.recv()
+  assert b"Content-Encoding: gzip" in head
+  assert b"Vary: Accept-Encoding" in head
+  assert gzip.decompress(body) == root_index
+
+  with RequestManager() as ch:
+    ch.send_get(url="/kitten.jpg", headers={"Accept-Encoding": "gzip"})
+    res = ch.read_get()
+  assert "Content-Encoding" not in res["headers"]
+  assert res["body"] == kitten
+
+
+def test_http10():
+  """Checks if an HTTP/1.0 request without a Host is served and closed, and
+  that Connection: keep-alive keeps it open
+  """
+  with RequestManager() as ch:
+    ch.send(b"GET /index.html HTTP/1.0\r\n\r\n")
+    time.sleep(1)
+    data = ch.recv()
+    assert data.startswith(b"HTTP/1.1 200 OK")
+    assert b"Connection: close" in data
+    time.sleep(1)
+    assert ch.is_socket_closed() == True
+  with RequestManager() as ch:
+    ch.send(b"GET /index.html HTTP/1.0\r\nconnection: Keep-Alive\r\n\r\n")
+    res = ch.read_get()
+    assert res["headers"]["Connection"] == "keep-alive"
+    assert res["body"] == root_index
+    ch.send(b"GET /index.html HTTP/1.0\r\n\r\n")
+    res = ch.read_get()
+    assert res["body"] == root_index
+
+
+def test_505():
+  """Checks if an unknown HTTP version gets a 505 and the connection closes
+  """
+  with RequestManager() as ch:
+    ch.send(b"GET /index.html HTTP/2.0\r\nHost: 127.0.0.1\r\n\r\n")
+    res = ch.read_get()
+    time.sleep(1)
+    assert ch.is_socket_closed() == True
+  assert res["status_code"] == 505
+
+
 def test_seq_400():
   """Checks if server can handle a malformed requests in a sequence of requests.
      Expected behaviour is to return 400 when a bad req is encountered and close